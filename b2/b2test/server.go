@@ -0,0 +1,533 @@
+// Package b2test provides an in-memory fake of the B2 API for testing code
+// that uses the b2 package without talking to Backblaze.
+//
+// The fake supports authorizing, buckets, simple uploads, listing, downloads,
+// hiding and deleting files. Large files, keys and other APIs respond with a
+// bad_request error.
+package b2test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jeffh/b2client/b2"
+)
+
+const (
+	// KeyID and AppKey are the credentials the fake server accepts
+	KeyID  = "b2test-key-id"
+	AppKey = "b2test-app-key"
+
+	AccountID = "b2test-account"
+
+	authToken   = "b2test-auth-token"
+	uploadToken = "b2test-upload-token"
+
+	uploadPath = "/b2api/v2/b2_upload_file/"
+
+	defaultMaxFileCount = 100
+	maxFileCount        = 10000
+)
+
+type storedFile struct {
+	b2.File
+	data []byte
+}
+
+// Server is a fake B2 API backed by memory. It is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	m       sync.Mutex
+	buckets []b2.Bucket
+	files   []*storedFile
+	lastID  int
+	lastTS  int64
+}
+
+// NewServer starts a fake B2 server. Call Close when done with it.
+func NewServer() *Server {
+	s := &Server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// New starts a fake B2 server that is closed when the test finishes and
+// returns a RetryClient configured to use it.
+func New(t testing.TB) (*Server, *b2.RetryClient) {
+	s := NewServer()
+	t.Cleanup(s.Close)
+	return s, s.RetryClient()
+}
+
+// RetryClient returns a new RetryClient configured to use the fake server.
+func (s *Server) RetryClient() *b2.RetryClient {
+	return &b2.RetryClient{
+		KeyID:  KeyID,
+		AppKey: AppKey,
+		C:      b2.Client{BaseURL: s.URL},
+	}
+}
+
+// FileContents returns the contents of the latest uploaded version of a file
+func (s *Server) FileContents(bucketName, fileName string) ([]byte, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	b, ok := s.bucketByName(bucketName)
+	if !ok {
+		return nil, false
+	}
+	f := s.latest(b.BucketID, fileName)
+	if f == nil {
+		return nil, false
+	}
+	return append([]byte(nil), f.data...), true
+}
+
+func (s *Server) nextID(prefix string) string {
+	s.lastID++
+	return fmt.Sprintf("%s_b2test_%08d", prefix, s.lastID)
+}
+
+// nextTimestamp returns the current time in millis, increasing on every call
+// so versions of a file are always ordered.
+func (s *Server) nextTimestamp() int64 {
+	ts := time.Now().UnixNano() / int64(time.Millisecond)
+	if ts <= s.lastTS {
+		ts = s.lastTS + 1
+	}
+	s.lastTS = ts
+	return ts
+}
+
+func (s *Server) bucketByID(id string) (b2.Bucket, bool) {
+	for _, b := range s.buckets {
+		if b.BucketID == id {
+			return b, true
+		}
+	}
+	return b2.Bucket{}, false
+}
+
+func (s *Server) bucketByName(name string) (b2.Bucket, bool) {
+	for _, b := range s.buckets {
+		if b.BucketName == name {
+			return b, true
+		}
+	}
+	return b2.Bucket{}, false
+}
+
+func (s *Server) fileByID(id string) (int, *storedFile) {
+	for i, f := range s.files {
+		if f.FileID == id {
+			return i, f
+		}
+	}
+	return -1, nil
+}
+
+// latest returns the newest version of a file, or nil if it doesn't exist or
+// is hidden.
+func (s *Server) latest(bucketId, fileName string) *storedFile {
+	var newest *storedFile
+	for _, f := range s.files {
+		if f.BucketID == bucketId && f.FileName == fileName && (newest == nil || f.UploadTimestampMillis > newest.UploadTimestampMillis) {
+			newest = f
+		}
+	}
+	if newest == nil || newest.Action != b2.ActionUpload {
+		return nil
+	}
+	return newest
+}
+
+// versions returns every version of every file in a bucket, sorted by name
+// and then newest first, the order B2 lists them in.
+func (s *Server) versions(bucketId string) []*storedFile {
+	var out []*storedFile
+	for _, f := range s.files {
+		if f.BucketID == bucketId {
+			out = append(out, f)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].FileName != out[j].FileName {
+			return out[i].FileName < out[j].FileName
+		}
+		return out[i].UploadTimestampMillis > out[j].UploadTimestampMillis
+	})
+	return out
+}
+
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func errorf(status int, code, format string, args ...interface{}) *apiError {
+	return &apiError{status, code, fmt.Sprintf(format, args...)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, e *apiError) {
+	if r.Method == "HEAD" {
+		w.WriteHeader(e.status)
+		return
+	}
+	writeJSON(w, e.status, b2.ErrorResponse{Status: e.status, Code: e.code, Message: e.message})
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var e *apiError
+	switch {
+	case r.URL.Path == "/b2api/v2/b2_authorize_account":
+		e = s.authorize(w, r)
+	case strings.HasPrefix(r.URL.Path, uploadPath):
+		e = s.uploadFile(w, r)
+	case strings.HasPrefix(r.URL.Path, "/file/"):
+		e = s.downloadFileByName(w, r)
+	case r.URL.Path == "/b2api/v2/b2_download_file_by_id":
+		e = s.downloadFileByID(w, r)
+	default:
+		e = s.serveAPI(w, r)
+	}
+	if e != nil {
+		writeError(w, r, e)
+	}
+}
+
+func checkAuth(r *http.Request, token string) *apiError {
+	if r.Header.Get("Authorization") != token {
+		return errorf(401, b2.ErrCodeBadAuthToken, "Invalid authorization token")
+	}
+	return nil
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) *apiError {
+	keyID, appKey, ok := r.BasicAuth()
+	if !ok || keyID != KeyID || appKey != AppKey {
+		return errorf(401, b2.ErrCodeUnauthorized, "Invalid keyId or applicationKey")
+	}
+	writeJSON(w, 200, b2.AuthorizeAccountResponse{
+		AbsoluteMinimumPartSize: 5 * 1000 * 1000,
+		RecommendedPartSize:     100 * 1000 * 1000,
+		AccountID:               AccountID,
+		Allowed:                 b2.AuthorizeAcccountCapabilities{Capabilities: append([]string(nil), b2.AllCapabilities...)},
+		APIURL:                  s.URL,
+		AuthorizationToken:      authToken,
+		DownloadURL:             s.URL,
+	})
+	return nil
+}
+
+// serveAPI handles the JSON API calls
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) *apiError {
+	if e := checkAuth(r, authToken); e != nil {
+		return e
+	}
+	var body struct {
+		BucketID      string        `json:"bucketId"`
+		BucketName    string        `json:"bucketName"`
+		BucketType    b2.BucketType `json:"bucketType"`
+		BucketInfo    b2.BucketInfo `json:"bucketInfo"`
+		FileID        string        `json:"fileId"`
+		FileName      string        `json:"fileName"`
+		StartFileName string        `json:"startFileName"`
+		StartFileID   string        `json:"startFileId"`
+		MaxFileCount  int           `json:"maxFileCount"`
+		Prefix        string        `json:"prefix"`
+		Delimiter     string        `json:"delimiter"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return errorf(400, b2.ErrCodeBadRequest, "Invalid JSON: %s", err)
+	}
+
+	switch path.Base(r.URL.Path) {
+	case "b2_create_bucket":
+		if _, exists := s.bucketByName(body.BucketName); exists {
+			return errorf(400, "duplicate_bucket_name", "Bucket name is already in use.")
+		}
+		b := b2.Bucket{
+			AccountID:  AccountID,
+			BucketID:   s.nextID("bucket"),
+			BucketName: body.BucketName,
+			BucketType: body.BucketType,
+			BucketInfo: body.BucketInfo,
+			Revision:   1,
+		}
+		s.buckets = append(s.buckets, b)
+		writeJSON(w, 200, b)
+	case "b2_list_buckets":
+		res := b2.ListBucketsResponse{Buckets: []b2.Bucket{}}
+		for _, b := range s.buckets {
+			if (body.BucketID == "" || body.BucketID == b.BucketID) && (body.BucketName == "" || body.BucketName == b.BucketName) {
+				res.Buckets = append(res.Buckets, b)
+			}
+		}
+		writeJSON(w, 200, res)
+	case "b2_delete_bucket":
+		for i, b := range s.buckets {
+			if b.BucketID != body.BucketID {
+				continue
+			}
+			if len(s.versions(b.BucketID)) > 0 {
+				return errorf(400, "cannot_delete_non_empty_bucket", "Cannot delete non-empty bucket")
+			}
+			s.buckets = append(s.buckets[:i], s.buckets[i+1:]...)
+			writeJSON(w, 200, b)
+			return nil
+		}
+		return errorf(400, b2.ErrCodeBadRequest, "Bucket does not exist: %s", body.BucketID)
+	case "b2_get_upload_url":
+		if _, ok := s.bucketByID(body.BucketID); !ok {
+			return errorf(400, b2.ErrCodeBadRequest, "Bucket does not exist: %s", body.BucketID)
+		}
+		writeJSON(w, 200, b2.GetUploadURLResponse{
+			UploadURL:          s.URL + uploadPath + body.BucketID,
+			AuthorizationToken: uploadToken,
+		})
+	case "b2_get_file_info":
+		_, f := s.fileByID(body.FileID)
+		if f == nil {
+			return errorf(404, b2.ErrCodeNotFound, "File not present: %s", body.FileID)
+		}
+		writeJSON(w, 200, f.File)
+	case "b2_hide_file":
+		if _, ok := s.bucketByID(body.BucketID); !ok {
+			return errorf(400, b2.ErrCodeBadRequest, "Bucket does not exist: %s", body.BucketID)
+		}
+		if s.latest(body.BucketID, body.FileName) == nil {
+			return errorf(404, b2.ErrCodeNotFound, "File not present: %s", body.FileName)
+		}
+		f := &storedFile{File: b2.File{
+			AccountID:             AccountID,
+			BucketID:              body.BucketID,
+			FileID:                s.nextID("file"),
+			FileName:              body.FileName,
+			Action:                b2.ActionHide,
+			ContentType:           "application/x-bz-hide-marker",
+			FileInfo:              b2.FileInfo{},
+			UploadTimestampMillis: s.nextTimestamp(),
+		}}
+		s.files = append(s.files, f)
+		writeJSON(w, 200, f.File)
+	case "b2_delete_file_version":
+		i, f := s.fileByID(body.FileID)
+		if f == nil || f.FileName != body.FileName {
+			return errorf(400, b2.ErrCodeBadRequest, "File not present: %s %s", body.FileName, body.FileID)
+		}
+		s.files = append(s.files[:i], s.files[i+1:]...)
+		writeJSON(w, 200, b2.DeleteFileResponse{FileID: f.FileID, FileName: f.FileName})
+	case "b2_list_file_names", "b2_list_file_versions":
+		if _, ok := s.bucketByID(body.BucketID); !ok {
+			return errorf(400, b2.ErrCodeBadRequest, "Bucket does not exist: %s", body.BucketID)
+		}
+		count := body.MaxFileCount
+		if count <= 0 {
+			count = defaultMaxFileCount
+		} else if count > maxFileCount {
+			count = maxFileCount
+		}
+		allVersions := path.Base(r.URL.Path) == "b2_list_file_versions"
+		files, next := s.list(body.BucketID, allVersions, body.Prefix, body.Delimiter, body.StartFileName, body.StartFileID, count)
+		if allVersions {
+			res := b2.ListFileVersionsResponse{Files: files}
+			if next != nil {
+				res.NextFileName, res.NextFileID = next.FileName, next.FileID
+			}
+			writeJSON(w, 200, res)
+		} else {
+			res := b2.ListFileNamesResponse{Files: files}
+			if next != nil {
+				res.NextFileName = next.FileName
+			}
+			writeJSON(w, 200, res)
+		}
+	default:
+		return errorf(400, b2.ErrCodeBadRequest, "%s is not supported by b2test", r.URL.Path)
+	}
+	return nil
+}
+
+// list returns up to count files or folders in B2's order, starting at
+// startName (and startID, when listing versions). next is the first entry that
+// didn't fit, if any.
+func (s *Server) list(bucketId string, allVersions bool, prefix, delimiter, startName, startID string, count int) (files []b2.File, next *b2.File) {
+	files = []b2.File{}
+	seen := make(map[string]bool)
+	started := startID == ""
+	for _, f := range s.versions(bucketId) {
+		if !strings.HasPrefix(f.FileName, prefix) || f.FileName < startName {
+			continue
+		}
+		if !started {
+			if f.FileName == startName && f.FileID != startID {
+				continue
+			}
+			started = true
+		}
+
+		entry := f.File
+		if delimiter != "" {
+			if i := strings.Index(f.FileName[len(prefix):], delimiter); i >= 0 {
+				folder := f.FileName[:len(prefix)+i+len(delimiter)]
+				entry = b2.File{FileName: folder, Action: b2.ActionFolder, FileInfo: b2.FileInfo{}}
+			}
+		}
+		if seen[entry.FileName] && (entry.Action == b2.ActionFolder || !allVersions) {
+			continue
+		}
+		if !allVersions && entry.Action != b2.ActionFolder && s.latest(bucketId, f.FileName) != f {
+			seen[entry.FileName] = true
+			continue
+		}
+		if len(files) == count {
+			return files, &entry
+		}
+		seen[entry.FileName] = true
+		files = append(files, entry)
+	}
+	return files, nil
+}
+
+func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request) *apiError {
+	if e := checkAuth(r, uploadToken); e != nil {
+		return e
+	}
+	bucketId := strings.TrimPrefix(r.URL.Path, uploadPath)
+	if _, ok := s.bucketByID(bucketId); !ok {
+		return errorf(400, b2.ErrCodeBadRequest, "Bucket does not exist: %s", bucketId)
+	}
+	fileName, err := url.QueryUnescape(r.Header.Get("X-Bz-File-Name"))
+	if err != nil || fileName == "" {
+		return errorf(400, b2.ErrCodeBadRequest, "Invalid X-Bz-File-Name header")
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorf(400, b2.ErrCodeBadRequest, "Error reading body: %s", err)
+	}
+
+	expectedSha1 := r.Header.Get("X-Bz-Content-Sha1")
+	if expectedSha1 == b2.Sha1AtEnd {
+		if len(data) < 40 {
+			return errorf(400, b2.ErrCodeBadRequest, "Missing sha1 at end of body")
+		}
+		expectedSha1 = string(data[len(data)-40:])
+		data = data[:len(data)-40]
+	}
+	sum := sha1.Sum(data)
+	actualSha1 := hex.EncodeToString(sum[:])
+	if expectedSha1 != "" && expectedSha1 != "do_not_verify" && !strings.EqualFold(expectedSha1, actualSha1) {
+		return errorf(400, b2.ErrCodeBadRequest, "Sha1 did not match data received")
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" || contentType == b2.ContentTypeAuto {
+		contentType = mime.TypeByExtension(path.Ext(fileName))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+	}
+
+	info := b2.FileInfo{}
+	const infoPrefix = "X-Bz-Info-"
+	for k, values := range r.Header {
+		if !strings.HasPrefix(k, infoPrefix) || len(values) == 0 {
+			continue
+		}
+		value, err := url.QueryUnescape(values[0])
+		if err != nil {
+			return errorf(400, b2.ErrCodeBadRequest, "Invalid %s header", k)
+		}
+		info[strings.ToLower(k[len(infoPrefix):])] = value
+	}
+
+	f := &storedFile{
+		File: b2.File{
+			AccountID:             AccountID,
+			BucketID:              bucketId,
+			FileID:                s.nextID("file"),
+			FileName:              fileName,
+			Action:                b2.ActionUpload,
+			ContentLength:         int64(len(data)),
+			ContentSha1:           actualSha1,
+			ContentType:           contentType,
+			FileInfo:              info,
+			UploadTimestampMillis: s.nextTimestamp(),
+		},
+		data: data,
+	}
+	s.files = append(s.files, f)
+	writeJSON(w, 200, f.File)
+	return nil
+}
+
+func (s *Server) downloadFileByID(w http.ResponseWriter, r *http.Request) *apiError {
+	if e := checkAuth(r, authToken); e != nil {
+		return e
+	}
+	_, f := s.fileByID(r.URL.Query().Get("fileId"))
+	if f == nil || f.Action != b2.ActionUpload {
+		return errorf(404, b2.ErrCodeNotFound, "File not present: %s", r.URL.Query().Get("fileId"))
+	}
+	serveFile(w, r, f)
+	return nil
+}
+
+func (s *Server) downloadFileByName(w http.ResponseWriter, r *http.Request) *apiError {
+	if e := checkAuth(r, authToken); e != nil {
+		return e
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/file/"), "/", 2)
+	if len(parts) != 2 {
+		return errorf(400, b2.ErrCodeBadRequest, "Invalid download path: %s", r.URL.Path)
+	}
+	b, ok := s.bucketByName(parts[0])
+	if !ok {
+		return errorf(404, b2.ErrCodeNotFound, "Bucket not present: %s", parts[0])
+	}
+	f := s.latest(b.BucketID, parts[1])
+	if f == nil {
+		return errorf(404, b2.ErrCodeNotFound, "File not present: %s", parts[1])
+	}
+	serveFile(w, r, f)
+	return nil
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, f *storedFile) {
+	h := w.Header()
+	h.Set("Content-Type", f.ContentType)
+	h.Set("X-Bz-File-Id", f.FileID)
+	h.Set("X-Bz-File-Name", url.QueryEscape(f.FileName))
+	h.Set("X-Bz-Content-Sha1", f.ContentSha1)
+	h.Set("X-Bz-Upload-Timestamp", strconv.FormatInt(f.UploadTimestampMillis, 10))
+	for k, v := range f.FileInfo {
+		h.Set("X-Bz-Info-"+k, url.QueryEscape(fmt.Sprint(v)))
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(f.data))
+}
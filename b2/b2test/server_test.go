@@ -0,0 +1,152 @@
+package b2test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/jeffh/b2client/b2"
+)
+
+func TestUploadListDownloadDelete(t *testing.T) {
+	s, c := New(t)
+	ctx := context.Background()
+
+	bucket, err := c.CreateBucket(ctx, "test-bucket", b2.BucketTypePrivate, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	var uploaded []b2.UploadFileResponse
+	for _, name := range []string{"b.txt", "a.txt", "dir/c.txt", "a.txt"} {
+		res, err := c.UploadFile(ctx, bucket.BucketID, b2.UploadFileOptions{
+			FileName:      name,
+			Body:          ioutil.NopCloser(strings.NewReader("contents of " + name)),
+			ContentLength: int64(len("contents of " + name)),
+			ExtraHeaders:  map[string]string{"X-Bz-Info-Author": "b2test"},
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error uploading %s: %s", name, err)
+		}
+		if res.ContentType != "text/plain; charset=utf-8" || res.FileInfo["author"] != "b2test" {
+			t.Errorf("Unexpected upload response: %#v", res)
+		}
+		uploaded = append(uploaded, res)
+	}
+
+	names, err := c.ListFileNames(ctx, bucket.BucketID, &b2.ListFileNamesOptions{Delimiter: "/"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := fileNames(names.Files); got != "a.txt,b.txt,dir/" {
+		t.Errorf("Unexpected file names: %s", got)
+	}
+	if names.Files[0].FileID != uploaded[3].FileID {
+		t.Errorf("Expected the newest version of a.txt to be listed, got: %#v", names.Files[0])
+	}
+
+	versions, err := c.ListFileVersions(ctx, bucket.BucketID, &b2.ListFileVersionsOptions{MaxFileCount: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := fileNames(versions.Files); got != "a.txt,a.txt" || versions.NextFileName != "b.txt" || versions.NextFileID != uploaded[0].FileID {
+		t.Errorf("Unexpected file versions: %s next=%s %s", got, versions.NextFileName, versions.NextFileID)
+	}
+
+	res, err := c.DownloadFileByName(ctx, "test-bucket", "dir/c.txt", b2.DownloadFileOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || string(data) != "contents of dir/c.txt" {
+		t.Fatalf("Unexpected download: %q, %v", data, err)
+	}
+	f, err := b2.ParseDownloadHeaders(res.Header)
+	if err != nil || f.FileID != uploaded[2].FileID || f.FileName != "dir/c.txt" || f.ContentSha1 != uploaded[2].ContentSha1 {
+		t.Errorf("Unexpected download headers: %#v, %v", f, err)
+	}
+
+	n, err := c.DeleteAllFileVersions(ctx, bucket.BucketID, "a.txt")
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 versions deleted, got: %d, %v", n, err)
+	}
+	if _, ok := s.FileContents("test-bucket", "a.txt"); ok {
+		t.Errorf("Expected a.txt to be deleted")
+	}
+	_, err = c.DownloadFileByID(ctx, uploaded[1].FileID, nil)
+	if !errors.Is(err, b2.ErrNotFound) {
+		t.Errorf("Expected not found error, got: %v", err)
+	}
+
+	if _, err := c.DeleteBucket(ctx, bucket.BucketID); err == nil {
+		t.Errorf("Expected deleting a non-empty bucket to fail")
+	}
+	if _, err := c.DeleteBucketRecursive(ctx, bucket.BucketID); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	buckets, err := c.ListBuckets(ctx, nil)
+	if err != nil || len(buckets.Buckets) != 0 {
+		t.Errorf("Expected no buckets, got: %#v, %v", buckets, err)
+	}
+}
+
+func TestHideFile(t *testing.T) {
+	_, c := New(t)
+	ctx := context.Background()
+
+	bucket, err := c.CreateBucket(ctx, "test-bucket", b2.BucketTypePrivate, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = c.UploadFile(ctx, bucket.BucketID, b2.UploadFileOptions{
+		FileName:      "hidden.txt",
+		Body:          ioutil.NopCloser(strings.NewReader("secret")),
+		ContentLength: 6,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := c.HideFile(ctx, bucket.BucketID, "hidden.txt"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	names, err := c.ListFileNames(ctx, bucket.BucketID, nil)
+	if err != nil || len(names.Files) != 0 {
+		t.Errorf("Expected hidden file to not be listed, got: %#v, %v", names, err)
+	}
+	versions, err := c.ListFileVersions(ctx, bucket.BucketID, nil)
+	if err != nil || len(versions.Files) != 2 || versions.Files[0].Action != b2.ActionHide {
+		t.Errorf("Expected hide marker and upload versions, got: %#v, %v", versions, err)
+	}
+	_, err = c.DownloadFileByName(ctx, "test-bucket", "hidden.txt", b2.DownloadFileOptions{})
+	if !b2.IsNotFound(err) {
+		t.Errorf("Expected not found error, got: %v", err)
+	}
+}
+
+func TestRejectsBadCredentials(t *testing.T) {
+	s, c := New(t)
+	c.AppKey = "wrong"
+	c.RC.MaxAttempts = 1
+
+	_, err := c.ListBuckets(context.Background(), nil)
+	if !errors.Is(err, b2.ErrUnauthorized) {
+		t.Fatalf("Expected unauthorized error, got: %v", err)
+	}
+
+	c = s.RetryClient()
+	if _, err := c.AuthorizeIfNeeded(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+}
+
+func fileNames(files []b2.File) string {
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.FileName
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,154 @@
+package b2
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// EmptyBucket deletes every file version in a bucket, including hide markers
+// and unfinished large files, returning the number deleted. On error or
+// cancellation, the number deleted so far is returned with the error.
+// Authorizes as needed.
+func (c *RetryClient) EmptyBucket(ctx context.Context, bucketId string) (int, error) {
+	count := 0
+	err := c.ListAllFileVersions(ctx, bucketId, nil, func(f File) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.deleteVersion(ctx, f); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// DeleteBucketRecursive empties a bucket with EmptyBucket and then deletes it.
+// Returns the number of file versions deleted. Authorizes as needed.
+func (c *RetryClient) DeleteBucketRecursive(ctx context.Context, bucketId string) (int, error) {
+	count, err := c.EmptyBucket(ctx, bucketId)
+	if err != nil {
+		return count, err
+	}
+	if _, err := c.DeleteBucket(ctx, bucketId); err != nil {
+		return count, fmt.Errorf("Error while deleting bucket: %w", err)
+	}
+	return count, nil
+}
+
+// BucketFileCount returns the number of uploaded file versions in a bucket and
+// their total size, an estimate of the bucket's storage since B2 has no
+// endpoint for bucket usage. Every version is counted, not just the latest,
+// since older versions are stored too. Hide markers and unfinished large
+// files aren't counted. Lists every file version, so it may be slow for large
+// buckets. Authorizes as needed.
+func (c *RetryClient) BucketFileCount(ctx context.Context, bucketId string) (count int, totalBytes int64, err error) {
+	err = c.ListAllFileVersions(ctx, bucketId, nil, func(f File) error {
+		if f.Action == ActionUpload {
+			count++
+			totalBytes += f.ContentLength
+		}
+		return nil
+	})
+	return count, totalBytes, err
+}
+
+// ResolveBucketID returns the id of the bucket with the given name. Ids are
+// cached, use InvalidateBucketID if a bucket may have been recreated outside
+// of this client. Returns an error wrapping ErrBucketNotFound if there's no
+// bucket with that name. Authorizes as needed.
+func (c *RetryClient) ResolveBucketID(ctx context.Context, bucketName string) (string, error) {
+	if id, ok := c.bucketIDs.get(bucketName); ok {
+		return id, nil
+	}
+
+	auth, err := c.AuthorizeIfNeeded(ctx)
+	if err != nil {
+		return "", err
+	}
+	// keys restricted to a bucket may not be allowed to list buckets
+	if auth.Allowed.BucketName == bucketName && auth.Allowed.BucketID != "" {
+		c.bucketIDs.put(bucketName, auth.Allowed.BucketID)
+		return auth.Allowed.BucketID, nil
+	}
+
+	res, err := c.ListBuckets(ctx, &ListBucketsOptions{BucketName: bucketName})
+	if err != nil {
+		return "", fmt.Errorf("Error while resolving bucket %s: %w", bucketName, err)
+	}
+	for _, b := range res.Buckets {
+		if b.BucketName == bucketName {
+			c.bucketIDs.put(bucketName, b.BucketID)
+			return b.BucketID, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s", ErrBucketNotFound, bucketName)
+}
+
+// InvalidateBucketID removes a bucket name from ResolveBucketID's cache
+func (c *RetryClient) InvalidateBucketID(bucketName string) {
+	c.bucketIDs.remove(bucketName)
+}
+
+// UploadFileToBucketName is UploadFile for a bucket name instead of id.
+// Authorizes as needed.
+func (c *RetryClient) UploadFileToBucketName(ctx context.Context, bucketName string, opt UploadFileOptions) (UploadFileResponse, error) {
+	bucketId, err := c.ResolveBucketID(ctx, bucketName)
+	if err != nil {
+		if opt.Body != nil {
+			opt.Body.Close()
+		}
+		return UploadFileResponse{}, err
+	}
+	return c.UploadFile(ctx, bucketId, opt)
+}
+
+// ListFileNamesInBucketName is ListFileNames for a bucket name instead of id.
+// Authorizes as needed.
+func (c *RetryClient) ListFileNamesInBucketName(ctx context.Context, bucketName string, opt *ListFileNamesOptions) (ListFileNamesResponse, error) {
+	bucketId, err := c.ResolveBucketID(ctx, bucketName)
+	if err != nil {
+		return ListFileNamesResponse{}, err
+	}
+	return c.ListFileNames(ctx, bucketId, opt)
+}
+
+// bucketIDCache maps bucket names to ids
+type bucketIDCache struct {
+	m   sync.Mutex
+	ids map[string]string
+}
+
+func (bc *bucketIDCache) get(name string) (string, bool) {
+	bc.m.Lock()
+	defer bc.m.Unlock()
+	id, ok := bc.ids[name]
+	return id, ok
+}
+
+func (bc *bucketIDCache) put(name, id string) {
+	bc.m.Lock()
+	defer bc.m.Unlock()
+	if bc.ids == nil {
+		bc.ids = make(map[string]string)
+	}
+	bc.ids[name] = id
+}
+
+func (bc *bucketIDCache) remove(name string) {
+	bc.m.Lock()
+	defer bc.m.Unlock()
+	delete(bc.ids, name)
+}
+
+func (bc *bucketIDCache) removeID(id string) {
+	bc.m.Lock()
+	defer bc.m.Unlock()
+	for name, v := range bc.ids {
+		if v == id {
+			delete(bc.ids, name)
+		}
+	}
+}
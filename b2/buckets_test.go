@@ -0,0 +1,240 @@
+package b2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeBucketServer serves a bucket of file versions, paginated 10 at a time.
+type fakeBucketServer struct {
+	t *testing.T
+
+	versions      []File
+	deleteCalls   int
+	deletedBucket bool
+	onDelete      func() // nilable
+}
+
+func (s *fakeBucketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := decodeBody(s.t, r)
+	switch r.URL.Path {
+	case "/b2api/v2/b2_list_file_versions":
+		start := 0
+		if id, ok := body["startFileId"].(string); ok {
+			for i, f := range s.versions {
+				if f.FileID == id {
+					start = i
+				}
+			}
+		}
+		res := ListFileVersionsResponse{}
+		for i := start; i < len(s.versions); i++ {
+			if len(res.Files) == 10 {
+				res.NextFileName = s.versions[i].FileName
+				res.NextFileID = s.versions[i].FileID
+				break
+			}
+			res.Files = append(res.Files, s.versions[i])
+		}
+		writeJSON(w, 200, res)
+	case "/b2api/v2/b2_delete_file_version", "/b2api/v2/b2_cancel_large_file":
+		s.deleteCalls++
+		if s.onDelete != nil {
+			s.onDelete()
+		}
+		for i, f := range s.versions {
+			if f.FileID == body["fileId"] {
+				s.versions = append(s.versions[:i], s.versions[i+1:]...)
+				break
+			}
+		}
+		writeJSON(w, 200, DeleteFileResponse{})
+	case "/b2api/v2/b2_delete_bucket":
+		if len(s.versions) != 0 {
+			writeJSON(w, 400, ErrorResponse{Status: 400, Code: "cannot_delete_non_empty_bucket"})
+			return
+		}
+		s.deletedBucket = true
+		writeJSON(w, 200, BucketResponse{Bucket: Bucket{BucketID: body["bucketId"].(string)}})
+	default:
+		s.t.Errorf("Unexpected request: %s", r.URL.Path)
+	}
+}
+
+func newFakeBucketServer(t *testing.T, n int) *fakeBucketServer {
+	s := &fakeBucketServer{t: t}
+	for i := 0; i < n; i++ {
+		var action Action = ActionUpload
+		if i%7 == 0 {
+			action = ActionHide
+		}
+		s.versions = append(s.versions, File{FileName: fmt.Sprintf("file-%03d", i/2), FileID: strconv.Itoa(i), Action: action})
+	}
+	s.versions = append(s.versions, File{FileName: "large", FileID: "large", Action: ActionStart})
+	return s
+}
+
+func TestDeleteBucketRecursive(t *testing.T) {
+	srv := newFakeBucketServer(t, 45)
+	c := mockRetryClient(t, srv.ServeHTTP)
+
+	n, err := c.DeleteBucketRecursive(context.Background(), "bucket")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n != 46 || len(srv.versions) != 0 {
+		t.Fatalf("Expected all 46 versions to be deleted, got %d with %d remaining", n, len(srv.versions))
+	}
+	if !srv.deletedBucket {
+		t.Fatalf("Expected bucket to be deleted")
+	}
+}
+
+func TestDeleteBucketRecursiveDryRun(t *testing.T) {
+	srv := newFakeBucketServer(t, 45)
+	c := mockRetryClient(t, srv.ServeHTTP)
+	c.DryRun = true
+
+	n, err := c.DeleteBucketRecursive(context.Background(), "bucket")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n != 46 {
+		t.Fatalf("Expected 46 versions to be reported, got %d", n)
+	}
+	if srv.deleteCalls != 0 || len(srv.versions) != 46 || srv.deletedBucket {
+		t.Fatalf("Expected nothing to be deleted, got %d deletes with %d remaining", srv.deleteCalls, len(srv.versions))
+	}
+}
+
+func TestBucketFileCount(t *testing.T) {
+	srv := newFakeBucketServer(t, 45)
+	expectedCount, expectedBytes := 0, int64(0)
+	for i := range srv.versions {
+		srv.versions[i].ContentLength = int64(i + 1)
+		if srv.versions[i].Action == ActionUpload {
+			expectedCount++
+			expectedBytes += int64(i + 1)
+		}
+	}
+	c := mockRetryClient(t, srv.ServeHTTP)
+
+	count, totalBytes, err := c.BucketFileCount(context.Background(), "bucket")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if count != expectedCount || totalBytes != expectedBytes {
+		t.Fatalf("Expected %d files with %d bytes, got %d files with %d bytes", expectedCount, expectedBytes, count, totalBytes)
+	}
+	if count == len(srv.versions) {
+		t.Fatalf("Expected hide markers and unfinished large files to be excluded")
+	}
+}
+
+func TestEmptyBucketCancelled(t *testing.T) {
+	srv := newFakeBucketServer(t, 45)
+	c := mockRetryClient(t, srv.ServeHTTP)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv.onDelete = func() {
+		if srv.deleteCalls == 15 {
+			cancel()
+		}
+	}
+
+	n, err := c.EmptyBucket(ctx, "bucket")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got: %v", err)
+	}
+	// the delete in flight when cancelled may or may not be counted
+	if n != 14 && n != 15 {
+		t.Fatalf("Expected partial count, got: %d", n)
+	}
+	if srv.deleteCalls != 15 {
+		t.Fatalf("Expected deleting to stop once cancelled, got %d deletes", srv.deleteCalls)
+	}
+}
+
+func TestResolveBucketID(t *testing.T) {
+	listCalls := 0
+	buckets := map[string]string{"photos": "bucket-1", "logs": "bucket-2"}
+	var uploadBuckets []string
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/b2api/v2/b2_list_buckets":
+			listCalls++
+			body := decodeBody(t, r)
+			res := ListBucketsResponse{}
+			if id, ok := buckets[body["bucketName"].(string)]; ok {
+				res.Buckets = append(res.Buckets, Bucket{BucketID: id, BucketName: body["bucketName"].(string)})
+			}
+			writeJSON(w, 200, res)
+		case "/b2api/v2/b2_get_upload_url":
+			uploadBuckets = append(uploadBuckets, decodeBody(t, r)["bucketId"].(string))
+			writeJSON(w, 200, UploadURLResponse{UploadURL: "http://" + r.Host + "/upload", AuthorizationToken: "upload-token"})
+		case "/upload":
+			writeJSON(w, 200, UploadFileResponse{FileID: "id"})
+		default:
+			t.Errorf("Unexpected request: %s", r.URL.Path)
+		}
+	})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		id, err := c.ResolveBucketID(ctx, "photos")
+		if err != nil || id != "bucket-1" {
+			t.Fatalf("Expected bucket-1, got: %#v, %v", id, err)
+		}
+	}
+	if listCalls != 1 {
+		t.Fatalf("Expected a cache hit, got %d list calls", listCalls)
+	}
+
+	buckets["photos"] = "bucket-3"
+	c.InvalidateBucketID("photos")
+	if id, err := c.ResolveBucketID(ctx, "photos"); err != nil || id != "bucket-3" {
+		t.Fatalf("Expected bucket-3 after invalidating, got: %#v, %v", id, err)
+	}
+	if listCalls != 2 {
+		t.Fatalf("Expected a cache miss, got %d list calls", listCalls)
+	}
+
+	_, err := c.ResolveBucketID(ctx, "missing")
+	if !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("Expected ErrBucketNotFound, got: %v", err)
+	}
+	if _, err := c.ResolveBucketID(ctx, "missing"); listCalls != 4 || err == nil {
+		t.Fatalf("Expected unknown buckets to not be cached, got %d list calls", listCalls)
+	}
+
+	_, err = c.UploadFileToBucketName(ctx, "logs", UploadFileOptions{
+		FileName:      "log.txt",
+		ContentLength: 5,
+		Body:          Closer(strings.NewReader("hello")),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if fmt.Sprint(uploadBuckets) != "[bucket-2]" {
+		t.Fatalf("Expected upload to bucket-2, got: %v", uploadBuckets)
+	}
+}
+
+func TestResolveBucketIDWithRestrictedKey(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request: %s", r.URL.Path)
+	})
+	c.C.lastAuth.Allowed.BucketID = "bucket-1"
+	c.C.lastAuth.Allowed.BucketName = "photos"
+
+	id, err := c.ResolveBucketID(context.Background(), "photos")
+	if err != nil || id != "bucket-1" {
+		t.Fatalf("Expected bucket-1, got: %#v, %v", id, err)
+	}
+}
@@ -3,24 +3,29 @@ package b2
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
 	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Values for Client.TestMode, which ask B2 to simulate failures so that
+// error handling can be exercised against the real service.
 const (
-	debugRequests        = false
-	debugResponses       = false
-	testRetries          = false
-	testExpireSomeTokens = false
-	testCapExceeded      = false
+	TestModeFailSomeUploads             = "fail_some_uploads"
+	TestModeExpireSomeAccountAuthTokens = "expire_some_account_authorization_tokens"
+	TestModeForceCapExceeded            = "force_cap_exceeded"
 )
 
 // Logger is the interface for B2 Client Logging
@@ -48,34 +53,196 @@ type TempFileStorage struct {
 
 var _ TempStorage = (*TempFileStorage)(nil)
 
+// Store copies r into a new temporary file. Closing the returned reader
+// removes the file.
 func (fs *TempFileStorage) Store(r io.Reader) (io.ReadCloser, int64, error) {
 	f, err := ioutil.TempFile(fs.Dir, fs.Pattern)
 	if err != nil {
 		return nil, 0, err
 	}
+	tf := &tempFile{f}
 	n, err := io.Copy(f, r)
 	if err != nil {
+		tf.Close()
 		return nil, 0, err
 	}
 	_, err = f.Seek(0, os.SEEK_SET)
 	if err != nil {
+		tf.Close()
 		return nil, 0, err
 	}
 
-	return f, n, nil
+	return tf, n, nil
+}
+
+// tempFile removes the underlying file when closed
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	if rmErr := os.Remove(f.Name()); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// MemoryTempStorage implements TempStorage by buffering contents in memory,
+// for environments without a writable temporary directory.
+type MemoryTempStorage struct {
+	MaxBytes int64 // optional, maximum bytes to buffer per reader (0 = no limit)
+}
+
+var _ TempStorage = (*MemoryTempStorage)(nil)
+
+func (ms *MemoryTempStorage) Store(r io.Reader) (io.ReadCloser, int64, error) {
+	if ms.MaxBytes > 0 {
+		r = io.LimitReader(r, ms.MaxBytes+1)
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ms.MaxBytes > 0 && n > ms.MaxBytes {
+		return nil, 0, fmt.Errorf("Error while buffering more than %d bytes: %w", ms.MaxBytes, ErrTempStorageFull)
+	}
+	return &memoryTempFile{bytes.NewReader(buf.Bytes())}, n, nil
+}
+
+// memoryTempFile drops its buffer on Close so it can be garbage collected,
+// even if the reader is still referenced.
+type memoryTempFile struct {
+	*bytes.Reader
+}
+
+func (f *memoryTempFile) Close() error {
+	f.Reader = bytes.NewReader(nil)
+	return nil
 }
 
 // Client manages most of the low-level operations for the B2 API.
-// Client is not thread safe.
+// Client is safe for concurrent use once configured, its fields should not be
+// modified while requests are in flight.
 // Most likely you're looking for RetryClient
+//
+// Prefer NewClient over constructing a Client directly.
 type Client struct {
 	UserAgent string      // UserAgent for us to B2 (Defaults to DefaultUserAgent())
+	BaseURL   string      // optional, base URL to authorize against (Defaults to DefaultBaseURL)
 	C         http.Client // Underlying HTTP Client
 	L         Logger      // nilable, optional logger
 	TS        TempStorage // nilable, used for temp storage of uploads
 
-	m        sync.Mutex
-	lastAuth *AuthorizeAccountResponse // last successful auth response
+	DebugRequests  bool   // optional, logs request headers and bodies to L
+	DebugResponses bool   // optional, logs response bodies to L
+	TestMode       string // optional, sent as X-Bz-Test-Mode (see TestMode* constants)
+
+	// optional, called with every request just before it's sent, after auth
+	// headers are set. Useful for propagating trace headers from the
+	// request's context.
+	RequestInterceptor func(req *http.Request)
+
+	Metrics Metrics // nilable, optional, observes every request
+	Clock   Clock   // nilable, optional, defaults to SystemClock
+
+	// optional, limits each request, including reading its response body, on
+	// top of any deadline the request's context has. RetryClient retries
+	// requests that time out, each with a new Timeout.
+	Timeout time.Duration
+
+	m            sync.Mutex
+	lastAuth     *AuthorizeAccountResponse // last successful auth response
+	authorizedAt time.Time                 // when lastAuth was received
+}
+
+// ClientOption configures a Client created by NewClient
+type ClientOption func(c *Client)
+
+// DefaultMaxIdleConnsPerHost is how many idle connections to each B2 host
+// DefaultTransport keeps for reuse
+const DefaultMaxIdleConnsPerHost = 64
+
+// DefaultTransport returns a new http.Transport tuned for B2. It's
+// http.DefaultTransport with room for DefaultMaxIdleConnsPerHost idle
+// connections per host instead of 2. Nearly every request goes to the same API
+// or upload host, so with net/http's default, concurrent uploads close and
+// redial connections (and redo TLS handshakes) after nearly every request.
+func DefaultTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 4 * DefaultMaxIdleConnsPerHost
+	t.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	return t
+}
+
+// NewClient returns a Client configured with the given options. Without
+// options, the Client uses DefaultTransport() and DefaultUserAgent().
+func NewClient(opts ...ClientOption) *Client {
+	c := &Client{C: http.Client{Transport: DefaultTransport()}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithHTTPClient uses a copy of hc to make requests
+func WithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) { c.C = *hc }
+}
+
+// WithLogger logs requests and responses to l when debugging is enabled
+func WithLogger(l Logger) ClientOption {
+	return func(c *Client) { c.L = l }
+}
+
+// WithTempStorage buffers uploads of unknown length in ts
+func WithTempStorage(ts TempStorage) ClientOption {
+	return func(c *Client) { c.TS = ts }
+}
+
+// WithUserAgent sets the User-Agent header sent to B2
+func WithUserAgent(userAgent string) ClientOption {
+	return func(c *Client) { c.UserAgent = userAgent }
+}
+
+// WithDebug logs request and/or response details to the Client's logger
+func WithDebug(requests, responses bool) ClientOption {
+	return func(c *Client) {
+		c.DebugRequests = requests
+		c.DebugResponses = responses
+	}
+}
+
+// WithTestMode asks B2 to simulate failures, see the TestMode* constants
+func WithTestMode(mode string) ClientOption {
+	return func(c *Client) { c.TestMode = mode }
+}
+
+// WithRequestInterceptor calls fn with every request before it's sent
+func WithRequestInterceptor(fn func(req *http.Request)) ClientOption {
+	return func(c *Client) { c.RequestInterceptor = fn }
+}
+
+// WithMetrics reports every request to m
+func WithMetrics(m Metrics) ClientOption {
+	return func(c *Client) { c.Metrics = m }
+}
+
+// WithClock uses clock instead of the system clock, see Clock
+func WithClock(clock Clock) ClientOption {
+	return func(c *Client) { c.Clock = clock }
+}
+
+// WithTimeout limits each request to d, see Client.Timeout
+func WithTimeout(d time.Duration) ClientOption {
+	return func(c *Client) { c.Timeout = d }
+}
+
+// WithBaseURL authorizes against baseURL instead of DefaultBaseURL. Subsequent
+// requests use the URLs returned by authorization.
+func WithBaseURL(baseURL string) ClientOption {
+	return func(c *Client) { c.BaseURL = baseURL }
 }
 
 func (c *Client) InvalidateAuthorization() {
@@ -84,11 +251,30 @@ func (c *Client) InvalidateAuthorization() {
 	c.lastAuth = nil
 }
 
+// AuthorizedAt returns when the current authorization was received, or the
+// zero time if the client isn't authorized.
+func (c *Client) AuthorizedAt() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.lastAuth == nil {
+		return time.Time{}
+	}
+	return c.authorizedAt
+}
+
+func (c *Client) clock() Clock {
+	if c.Clock != nil {
+		return c.Clock
+	}
+	return SystemClock
+}
+
 func (c *Client) LastAuth() *AuthorizeAccountResponse {
 	c.m.Lock()
 	defer c.m.Unlock()
 	if c.lastAuth != nil {
 		auth := *c.lastAuth
+		auth.Allowed.Capabilities = append([]string(nil), auth.Allowed.Capabilities...)
 		return &auth
 	}
 	return nil
@@ -102,14 +288,17 @@ func (c *Client) logf(format string, values ...interface{}) {
 
 func (c *Client) getUserAgent() string {
 	if c.UserAgent == "" {
-		c.UserAgent = DefaultUserAgent()
+		return DefaultUserAgent()
 	}
 	return c.UserAgent
 }
 
 func (c *Client) request(ctx context.Context, baseURL, method, endpoint string, body interface{}) (*http.Request, error) {
 	if baseURL == "" {
-		baseURL = "https://api.backblazeb2.com"
+		baseURL = strings.TrimSuffix(c.BaseURL, "/")
+	}
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
 	}
 	var req *http.Request
 	var err error
@@ -121,21 +310,15 @@ func (c *Client) request(ctx context.Context, baseURL, method, endpoint string,
 		if err := e.Encode(body); err != nil {
 			return nil, err
 		}
-		if debugRequests {
-			c.logf("request-body: %s", buf.String())
+		if c.DebugRequests {
+			c.logf("request-body: %s", redactRequestBody(buf.String()))
 		}
-		req, err = http.NewRequest(method, baseURL+endpoint, buf)
+		req, err = http.NewRequestWithContext(ctx, method, baseURL+endpoint, buf)
 	}
 	if req != nil {
 		req.Header.Set("User-Agent", c.getUserAgent())
-		if testRetries {
-			req.Header.Set("X-Bz-Test-Mode", "fail_some_uploads")
-		}
-		if testExpireSomeTokens {
-			req.Header.Set("X-Bz-Test-Mode", "expire_some_account_authorization_tokens")
-		}
-		if testCapExceeded {
-			req.Header.Set("X-Bz-Test-Mode", "force_cap_exceeded")
+		if c.TestMode != "" {
+			req.Header.Set("X-Bz-Test-Mode", c.TestMode)
 		}
 	}
 	return req, err
@@ -178,11 +361,44 @@ func (c *Client) downloadRequest(ctx context.Context, method, endpoint string, b
 	return req, err
 }
 
-func (c *Client) do(req *http.Request, out interface{}) error {
+func (c *Client) intercept(req *http.Request) {
+	if c.RequestInterceptor != nil {
+		c.RequestInterceptor(req)
+	}
+}
+
+// withTimeout returns req with its context limited to c.Timeout, if set, and
+// a func to release the context's resources.
+func (c *Client) withTimeout(req *http.Request) (*http.Request, context.CancelFunc) {
+	if c.Timeout <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), c.Timeout)
+	return req.WithContext(ctx), cancel
+}
+
+// cancelOnClose cancels a request's context once its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (c *Client) do(req *http.Request, out interface{}) (err error) {
+	c.intercept(req)
+	req, cancel := c.withTimeout(req)
+	defer cancel()
 	start := time.Now()
+	status := 0
+	defer func() { c.observe(req, status, start, err) }()
 	c.logf("http=request method=%s url=%s raw=false time=%s", req.Method, req.URL.String(), logStrTime(start))
-	if debugRequests {
-		c.logf("request-headers: %#v", req.Header)
+	if c.DebugRequests {
+		c.logf("request-headers: %#v", redactHeaders(req.Header))
 	}
 	res, err := c.C.Do(req)
 	if err != nil {
@@ -191,61 +407,93 @@ func (c *Client) do(req *http.Request, out interface{}) error {
 		return err
 	}
 	defer res.Body.Close()
+	status = res.StatusCode
 
-	d := json.NewDecoder(res.Body)
 	if res.StatusCode == 200 {
-		err := d.Decode(out)
+		err := decodeJSON(res, out)
 		if err != nil {
 			end := time.Now()
 			c.logf("http=response method=%s url=%s ok=false raw=false status=%d time=%s duration=%s err_type=json-decode err=%#v", req.Method, req.URL.String(), res.StatusCode, logStrTime(end), end.Sub(start).String(), err.Error())
-			return fmt.Errorf("Failed to parse JSON from response: %w", err)
+			return err
 		}
 	} else {
 		resErr := &ErrorResponse{}
-		err := d.Decode(&resErr)
+		err := decodeJSON(res, &resErr)
 		if err != nil {
 			end := time.Now()
 			c.logf("http=response method=%s url=%s ok=false raw=false status=%d time=%s duration=%s err_type=json-decode err=%#v", req.Method, req.URL.String(), res.StatusCode, logStrTime(end), end.Sub(start).String(), err.Error())
-			return fmt.Errorf("Failed to parse JSON from response: %w", err)
-		}
-		seconds, err := strconv.Atoi(res.Header.Get("Retry-After"))
-		if err == nil {
-			resErr.RetryAfter = time.Duration(seconds) * time.Second
+			return err
 		}
+		resErr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), c.clock().Now())
 		end := time.Now()
 		c.logf("http=response method=%s url=%s ok=false raw=false status=%d time=%s duration=%s err_type=api-error err=%#v", req.Method, req.URL.String(), res.StatusCode, logStrTime(end), end.Sub(start).String(), resErr.Error())
-		if debugResponses {
+		if c.DebugResponses {
 			c.logf("response-body: %#v", resErr)
 		}
 		return resErr
 	}
 	end := time.Now()
 	c.logf("http=response method=%s url=%s ok=true raw=false status=%d time=%s duration=%s", req.Method, req.URL.String(), res.StatusCode, logStrTime(end), end.Sub(start).String())
-	if debugResponses {
+	if c.DebugResponses {
 		c.logf("response-body: %#v", out)
 	}
 	return nil
 }
 
-func (c *Client) doRaw(req *http.Request) (*http.Response, error) {
+// decodeJSON reads the response body and decodes it into out. Returns an
+// *ErrDecode with the raw body if it isn't valid JSON.
+func decodeJSON(res *http.Response, out interface{}) error {
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("Failed to read response: %w", err)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return &ErrDecode{Status: res.StatusCode, RawBody: body, Err: err}
+	}
+	return nil
+}
+
+func (c *Client) doRaw(req *http.Request) (res *http.Response, err error) {
+	c.intercept(req)
 	start := time.Now()
+	defer func() {
+		status := 0
+		if res != nil {
+			status = res.StatusCode
+		}
+		c.observe(req, status, start, err)
+	}()
 	c.logf("http=request method=%s url=%s raw=true time=%s", req.Method, req.URL.String(), logStrTime(start))
-	res, err := c.C.Do(req)
+	req, cancel := c.withTimeout(req)
+	res, err = c.C.Do(req)
 	if err != nil {
+		cancel()
 		end := time.Now()
 		c.logf("http=response method=%s url=%s ok=false raw=true time=%s duration=%s err_type=network err=%#v", req.Method, req.URL.String(), logStrTime(end), end.Sub(start).String(), err.Error())
 		return res, err
 	}
+	// the body is read after returning, so the timeout lasts until it's closed
+	res.Body = &cancelOnClose{res.Body, cancel}
 
-	if res.StatusCode != 200 {
-		d := json.NewDecoder(res.Body)
+	if res.StatusCode == http.StatusNotModified {
+		end := time.Now()
+		c.logf("http=response method=%s url=%s ok=false raw=true status=%d time=%s duration=%s err_type=not-modified", req.Method, req.URL.String(), res.StatusCode, logStrTime(end), end.Sub(start).String())
+		return res, ErrNotModified
+	}
+	if res.StatusCode != 200 && res.StatusCode != http.StatusPartialContent {
 		resErr := &ErrorResponse{}
-		err := d.Decode(&resErr)
-		if err != nil {
-			end := time.Now()
-			c.logf("http=response method=%s url=%s ok=false raw=true status=%d time=%s duration=%s err_type=json-decode err=%#v", req.Method, req.URL.String(), res.StatusCode, logStrTime(end), end.Sub(start).String(), err.Error())
-			return res, fmt.Errorf("Failed to parse JSON from response: %w", err)
+		if req.Method == "HEAD" {
+			// HEAD responses have no body describing the error
+			resErr = errorResponseForStatus(res.StatusCode)
+		} else {
+			err := decodeJSON(res, &resErr)
+			if err != nil {
+				end := time.Now()
+				c.logf("http=response method=%s url=%s ok=false raw=true status=%d time=%s duration=%s err_type=json-decode err=%#v", req.Method, req.URL.String(), res.StatusCode, logStrTime(end), end.Sub(start).String(), err.Error())
+				return res, err
+			}
 		}
+		resErr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"), c.clock().Now())
 		end := time.Now()
 		c.logf("http=response method=%s url=%s ok=false raw=true status=%d time=%s duration=%s err_type=api-error err=%#v", req.Method, req.URL.String(), res.StatusCode, logStrTime(end), end.Sub(start).String(), resErr.Error())
 		return res, resErr
@@ -259,6 +507,17 @@ func (c *Client) doRaw(req *http.Request) (*http.Response, error) {
 // tokens can be used for other API calls. Stores authorization for future API
 // calls.
 func (c *Client) Authorize(ctx context.Context, keyId, appKey string) (AuthorizeAccountResponse, error) {
+	r, err := c.RequestAuthorization(ctx, keyId, appKey)
+	if err == nil {
+		c.SetAuth(&r)
+	}
+	return r, err
+}
+
+// RequestAuthorization exchanges a keyId and appKey for an authorization
+// token like Authorize, but doesn't store it. Useful for obtaining a token to
+// share with other processes, which can use it via SetAuth.
+func (c *Client) RequestAuthorization(ctx context.Context, keyId, appKey string) (AuthorizeAccountResponse, error) {
 	req, err := c.request(ctx, "", "GET", "/b2api/v2/b2_authorize_account", nil)
 	if err != nil {
 		return AuthorizeAccountResponse{}, err
@@ -266,14 +525,33 @@ func (c *Client) Authorize(ctx context.Context, keyId, appKey string) (Authorize
 	req.SetBasicAuth(keyId, appKey)
 	var r AuthorizeAccountResponse
 	err = c.do(req, &r)
-	if err == nil {
-		c.m.Lock()
-		c.lastAuth = &r
-		c.m.Unlock()
-	}
 	return r, err
 }
 
+// SetAuth stores a copy of an authorization obtained elsewhere, like from
+// RequestAuthorization in another process, for future API calls. The
+// authorization is treated as if it was received now; use SetAuthAt if it's
+// older. A nil auth is the same as InvalidateAuthorization.
+func (c *Client) SetAuth(auth *AuthorizeAccountResponse) {
+	c.SetAuthAt(auth, c.clock().Now())
+}
+
+// SetAuthAt is like SetAuth, but records that the authorization was received
+// at authorizedAt, so that AuthorizedAt and RetryClient.AuthTTL account for
+// its age.
+func (c *Client) SetAuthAt(auth *AuthorizeAccountResponse, authorizedAt time.Time) {
+	if auth == nil {
+		c.InvalidateAuthorization()
+		return
+	}
+	a := *auth
+	a.Allowed.Capabilities = append([]string(nil), auth.Allowed.Capabilities...)
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.lastAuth = &a
+	c.authorizedAt = authorizedAt
+}
+
 // CancelLargeFile cancels an inprogress file upload. Requires Authorize to be called first.
 func (c *Client) CancelLargeFile(ctx context.Context, fileId string) (CancelLargeFileResponse, error) {
 	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_cancel_large_file", &requestByFileID{fileId})
@@ -298,14 +576,20 @@ type CopyFileOptions struct {
 	SourceFileId        string            `json:"sourceFileId"` // required
 	FileName            string            `json:"fileName"`     // required
 	DestinationBucketId string            `json:"destinationBucketId,omitempty"`
-	Range               string            `json:"range,omitempty"` // in form: "bytes=1000-2000"
+	Range               ByteRange         `json:"range,omitempty"` // in form: "bytes=1000-2000"
 	MetadataDirective   MetadataDirective `json:"metadataDirective,omitempty"`
 	ContentType         string            `json:"contentType,omitempty"`
 	FileInfo            FileInfo          `json:"fileInfo,omitempty"`
+
+	SourceServerSideEncryption      *SSE `json:"sourceServerSideEncryption,omitempty"`      // optional, required if the source uses SSEModeC
+	DestinationServerSideEncryption *SSE `json:"destinationServerSideEncryption,omitempty"` // optional
 }
 
 // CopyFile copies a file in the bucket to another location. Requires Authorize to be called first.
 func (c *Client) CopyFile(ctx context.Context, opt CopyFileOptions) (CopyFileResponse, error) {
+	if err := opt.Range.validateBounded(); err != nil {
+		return CopyFileResponse{}, err
+	}
 	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_copy_file", &opt)
 	if err != nil {
 		return CopyFileResponse{}, err
@@ -317,15 +601,21 @@ func (c *Client) CopyFile(ctx context.Context, opt CopyFileOptions) (CopyFileRes
 }
 
 type CopyPartOptions struct {
-	SourceFileId string `json:"sourceFileId"`    // required
-	LargeFileId  string `json:"largeFileId"`     // required
-	PartNumber   int    `json:"partNumber"`      // required
-	Range        string `json:"range,omitempty"` // in form: "bytes=1000-2000"
+	SourceFileId string    `json:"sourceFileId"`    // required
+	LargeFileId  string    `json:"largeFileId"`     // required
+	PartNumber   int       `json:"partNumber"`      // required
+	Range        ByteRange `json:"range,omitempty"` // in form: "bytes=1000-2000"
+
+	SourceServerSideEncryption      *SSE `json:"sourceServerSideEncryption,omitempty"`      // optional, required if the source uses SSEModeC
+	DestinationServerSideEncryption *SSE `json:"destinationServerSideEncryption,omitempty"` // optional, required if the large file uses SSEModeC
 }
 
 // CopyPart copies a part of a large file in the bucket to another location.
 // Requires Authorize to be called first.
 func (c *Client) CopyPart(ctx context.Context, opt CopyPartOptions) (CopyPartResponse, error) {
+	if err := opt.Range.validateBounded(); err != nil {
+		return CopyPartResponse{}, err
+	}
 	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_copy_part", &opt)
 	if err != nil {
 		return CopyPartResponse{}, err
@@ -337,9 +627,11 @@ func (c *Client) CopyPart(ctx context.Context, opt CopyPartOptions) (CopyPartRes
 }
 
 type CreateBucketOptions struct {
-	BucketInfo     BucketInfo      // optional
-	CorsRules      []CorsRule      // optional
-	LifecycleRules []LifecycleRule // optional
+	BucketInfo                  BucketInfo      // optional
+	CorsRules                   []CorsRule      // optional
+	LifecycleRules              []LifecycleRule // optional
+	DefaultServerSideEncryption *SSE            // optional, only SSEModeB2 is supported
+	FileLockEnabled             *bool           // optional, file lock can only be enabled on new buckets
 }
 
 // CreateBucket creates a new bucket in the given account. Requires Authorize to be called first.
@@ -351,11 +643,17 @@ func (c *Client) CreateBucket(ctx context.Context, bucketName string, bt BucketT
 		BucketInfo     BucketInfo      `json:"bucketInfo,omitempty"`
 		CorsRules      []CorsRule      `json:"corsRules,omitempty"`
 		LifecycleRules []LifecycleRule `json:"lifecycleRules,omitempty"`
+
+		DefaultServerSideEncryption *SSE  `json:"defaultServerSideEncryption,omitempty"`
+		FileLockEnabled             *bool `json:"fileLockEnabled,omitempty"`
 	}
 	var o CreateBucketOptions
 	if opt != nil {
 		o = *opt
 	}
+	if err := validateBucketRules(o.CorsRules, o.LifecycleRules); err != nil {
+		return BucketResponse{}, err
+	}
 	auth := c.LastAuth()
 	if auth == nil {
 		return BucketResponse{}, ErrAuthTokenMissing
@@ -367,6 +665,8 @@ func (c *Client) CreateBucket(ctx context.Context, bucketName string, bt BucketT
 		o.BucketInfo,
 		o.CorsRules,
 		o.LifecycleRules,
+		o.DefaultServerSideEncryption,
+		o.FileLockEnabled,
 	})
 	if err != nil {
 		return BucketResponse{}, err
@@ -388,6 +688,9 @@ type CreateKeyOptions struct {
 
 // CreateKey creates a new API key with permissions. Requires Authorize to be called first.
 func (c *Client) CreateKey(ctx context.Context, opt CreateKeyOptions) (KeyResponse, error) {
+	if err := ValidateCapabilities(opt.Capabilities); err != nil {
+		return KeyResponse{}, err
+	}
 	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_create_key", &opt)
 	if err != nil {
 		return KeyResponse{}, err
@@ -421,11 +724,27 @@ func (c *Client) DeleteBucket(ctx context.Context, bucketId string) (BucketRespo
 
 // DeleteFileVersion deletes a version of a file. Requires Authorize to be called first.
 func (c *Client) DeleteFileVersion(ctx context.Context, fileId, fileName string) (DeleteFileResponse, error) {
+	return c.DeleteFileVersionWithOptions(ctx, DeleteFileVersionOptions{FileID: fileId, FileName: fileName})
+}
+
+type DeleteFileVersionOptions struct {
+	FileID   string // required
+	FileName string // required
+
+	// Deletes the version even if it's under a governance mode retention.
+	// Requires the bypassGovernance capability. Versions under compliance
+	// mode retention can't be deleted and fail with ErrAccessDenied.
+	BypassGovernance bool // optional
+}
+
+// DeleteFileVersionWithOptions deletes a version of a file. Requires Authorize to be called first.
+func (c *Client) DeleteFileVersionWithOptions(ctx context.Context, opt DeleteFileVersionOptions) (DeleteFileResponse, error) {
 	type request struct {
-		FileId   string `json:"fileId"`
-		FileName string `json:"fileName"`
+		FileId           string `json:"fileId"`
+		FileName         string `json:"fileName"`
+		BypassGovernance bool   `json:"bypassGovernance,omitempty"`
 	}
-	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_delete_file_version", &request{fileId, fileName})
+	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_delete_file_version", &request{opt.FileID, opt.FileName, opt.BypassGovernance})
 	if err != nil {
 		return DeleteFileResponse{}, err
 	}
@@ -451,13 +770,45 @@ func (c *Client) DeleteKey(ctx context.Context, appKeyId string) (KeyResponse, e
 }
 
 type DownloadFileOptions struct {
-	Range              string // optional
-	ContentDisposition string // optional, overrides file specified value
-	ContentLanguage    string // optional, overrides file specified value
-	Expires            string // optional, RFC 2616, overrides file specified value
-	CacheControl       string // optional, overrides file specified value
-	ContentEncoding    string // optional, overrides file specified value
-	ContentType        string // optional, overrides file specified value
+	Range              ByteRange // optional, in form: "bytes=1000-2000", see ByteRange.Validate
+	ContentDisposition string    // optional, overrides file specified value
+	ContentLanguage    string    // optional, overrides file specified value
+	Expires            string    // optional, RFC 2616, overrides file specified value
+	CacheControl       string    // optional, overrides file specified value
+	ContentEncoding    string    // optional, overrides file specified value
+	ContentType        string    // optional, overrides file specified value
+
+	ServerSideEncryption *SSE // optional, required if the file uses SSEModeC
+
+	// optional, conditional download headers. If the file hasn't changed,
+	// the download fails with ErrNotModified.
+	IfModifiedSince time.Time // optional, sent as If-Modified-Since
+	IfNoneMatch     string    // optional, sent as If-None-Match
+
+	// optional, used by DownloadFileToWriter to verify the downloaded
+	// content against the file's sha1. Ignored for ranged downloads.
+	VerifySha1 bool
+
+	// optional, sent as Accept-Encoding. When empty, net/http asks for gzip
+	// and transparently decompresses gzip encoded files, so the content no
+	// longer matches the sha1 of the stored bytes. Setting any value, like
+	// "identity" for the exact stored bytes or "gzip" to save bandwidth,
+	// turns that off. Defaults to "gzip" if Decompress or VerifySha1 is set.
+	AcceptEncoding string
+
+	// optional, used by DownloadFileToWriter to gunzip the content if the
+	// response's Content-Encoding is gzip, like files uploaded with
+	// ContentEncoding "gzip". VerifySha1 checks the compressed bytes B2
+	// stored, not the decompressed ones written.
+	Decompress bool
+
+	// optional, used by DownloadFileToPath to keep files that have no sha1
+	// to verify. Otherwise they're removed and ErrNoChecksum is returned.
+	AllowUnverified bool
+
+	// optional, called as the response body is read with the total from
+	// Content-Length, or -1 if the response doesn't have one.
+	Progress ProgressFunc
 }
 
 func (opt DownloadFileOptions) setOnRequest(req *http.Request, fileId string) {
@@ -485,29 +836,54 @@ func (opt DownloadFileOptions) setOnRequest(req *http.Request, fileId string) {
 		q.Set("b2ContentType", opt.ContentType)
 	}
 	req.URL.RawQuery = q.Encode()
+	if opt.Range != "" {
+		req.Header.Set("Range", opt.Range.String())
+	}
+	if !opt.IfModifiedSince.IsZero() {
+		req.Header.Set("If-Modified-Since", opt.IfModifiedSince.UTC().Format(http.TimeFormat))
+	}
+	if opt.IfNoneMatch != "" {
+		req.Header.Set("If-None-Match", opt.IfNoneMatch)
+	}
+	if opt.AcceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", opt.AcceptEncoding)
+	} else if opt.Decompress || opt.VerifySha1 {
+		// otherwise the transport transparently decompresses gzip encoded
+		// files, hiding the stored bytes the sha1 is of
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	opt.ServerSideEncryption.setCustomerKeyOnRequest(req)
 }
 
 // DownloadFileByID downloads a file using the authorization previously retrieved via Authorize.
 // Requires readFiles capabilities
 func (c *Client) DownloadFileByID(ctx context.Context, fileId string, opt *DownloadFileOptions) (*http.Response, error) {
-	req, err := c.downloadRequest(ctx, "GET", "/b2api/v2/b2_download_file_by_id", nil)
-	if err != nil {
-		return nil, err
-	}
-
 	var o DownloadFileOptions
 	if opt != nil {
 		o = *opt
 	}
+	if err := o.Range.Validate(); err != nil {
+		return nil, err
+	}
+
+	req, err := c.downloadRequest(ctx, "GET", "/b2api/v2/b2_download_file_by_id", nil)
+	if err != nil {
+		return nil, err
+	}
 	o.setOnRequest(req, fileId)
 
-	return c.doRaw(req)
+	res, err := c.doRaw(req)
+	o.trackProgress(res, err)
+	return res, err
 }
 
 // DownloadFileByName downloads a file using the authorization previously retrieved via Authorize.
 // Requires readFiles capabilities
 func (c *Client) DownloadFileByName(ctx context.Context, bucketName, fileName string, opt DownloadFileOptions) (*http.Response, error) {
-	path := fmt.Sprintf("/files/%s/%s", bucketName, fileName)
+	if err := opt.Range.Validate(); err != nil {
+		return nil, err
+	}
+	path := downloadPath(bucketName, fileName)
 	req, err := c.downloadRequest(ctx, "GET", path, nil)
 	if err != nil {
 		return nil, err
@@ -515,7 +891,53 @@ func (c *Client) DownloadFileByName(ctx context.Context, bucketName, fileName st
 
 	opt.setOnRequest(req, "")
 
-	return c.doRaw(req)
+	res, err := c.doRaw(req)
+	opt.trackProgress(res, err)
+	return res, err
+}
+
+// trackProgress wraps the body of a successful download to report progress
+func (opt DownloadFileOptions) trackProgress(res *http.Response, err error) {
+	if opt.Progress == nil || err != nil || res == nil || res.Body == nil {
+		return
+	}
+	res.Body = &progressReader{R: res.Body, Fn: opt.Progress, Total: res.ContentLength}
+}
+
+// HeadFileByID returns the metadata of a file using a HEAD request to
+// download it, without transferring its contents. Requires readFiles
+// capabilities
+func (c *Client) HeadFileByID(ctx context.Context, fileId string) (HeadFileResponse, error) {
+	req, err := c.downloadRequest(ctx, "HEAD", "/b2api/v2/b2_download_file_by_id", nil)
+	if err != nil {
+		return HeadFileResponse{}, err
+	}
+	DownloadFileOptions{}.setOnRequest(req, fileId)
+	return c.doHead(req)
+}
+
+// HeadFileByName returns the metadata of the latest version of a file using
+// a HEAD request to download it, without transferring its contents. Requires
+// readFiles capabilities
+func (c *Client) HeadFileByName(ctx context.Context, bucketName, fileName string) (HeadFileResponse, error) {
+	path := downloadPath(bucketName, fileName)
+	req, err := c.downloadRequest(ctx, "HEAD", path, nil)
+	if err != nil {
+		return HeadFileResponse{}, err
+	}
+	return c.doHead(req)
+}
+
+func (c *Client) doHead(req *http.Request) (HeadFileResponse, error) {
+	res, err := c.doRaw(req)
+	if res != nil && res.Body != nil {
+		res.Body.Close()
+	}
+	if err != nil {
+		return HeadFileResponse{}, err
+	}
+	f, err := ParseDownloadHeaders(res.Header)
+	return HeadFileResponse(f), err
 }
 
 // FinishLargeFile combines all previously uploaded file parts into one large
@@ -526,7 +948,7 @@ func (c *Client) FinishLargeFile(ctx context.Context, fileId string, partSha1s [
 		FileId        string   `json:"fileId"`
 		PartSha1Array []string `json:"partSha1Array"`
 	}
-	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_finish_large_files", &request{fileId, partSha1s})
+	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_finish_large_file", &request{fileId, partSha1s})
 	if err != nil {
 		return FinishLargeFileResponse{}, err
 	}
@@ -562,6 +984,21 @@ func (c *Client) GetDownloadAuthorization(ctx context.Context, opt GetDownloadAu
 	return r, err
 }
 
+// GetBucketNotificationRules returns the event notification rules of a
+// bucket. Requires Authorize to have been called.
+func (c *Client) GetBucketNotificationRules(ctx context.Context, bucketId string) (GetBucketNotificationRulesResponse, error) {
+	// event notifications are only available in v3 of the API
+	endpoint := "/b2api/v3/b2_get_bucket_notification_rules?bucketId=" + url.QueryEscape(bucketId)
+	req, err := c.authRequest(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return GetBucketNotificationRulesResponse{}, err
+	}
+
+	var r GetBucketNotificationRulesResponse
+	err = c.do(req, &r)
+	return r, err
+}
+
 // GetFileInfo returns metadata about a file stored in B2. Requires Authorize
 // to have been called.
 func (c *Client) GetFileInfo(ctx context.Context, fileId string) (GetFileInfoResponse, error) {
@@ -651,9 +1088,25 @@ func (c *Client) ListBuckets(ctx context.Context, opt *ListBucketsOptions) (List
 	return r, err
 }
 
+// MaxListFileCount is the most files B2 returns from a single list call.
+// Larger MaxFileCounts are clamped to it.
+const MaxListFileCount = 10000
+
+// normalizeMaxFileCount clamps n to MaxListFileCount, returning an error if
+// it's negative. 0 is left as is for B2's default of 100.
+func normalizeMaxFileCount(n int) (int, error) {
+	if n < 0 {
+		return 0, fmt.Errorf("Invalid MaxFileCount %d: must be between 0 and %d", n, MaxListFileCount)
+	}
+	if n > MaxListFileCount {
+		return MaxListFileCount, nil
+	}
+	return n, nil
+}
+
 type ListFileNamesOptions struct {
 	StartFileName string // optional, starting offset filename for pagination
-	MaxFileCount  int    // optional, number of files to return, 0 = default of 100, fee on every 1000 items returned
+	MaxFileCount  int    // optional, number of files to return, 0 = default of 100, clamped to MaxListFileCount, fee on every 1000 items returned
 	Prefix        string // optional, objects must have this key prefix
 	Delimiter     string // optional, empty means list all files, "/" means list top level files and folders
 }
@@ -670,11 +1123,15 @@ func (c *Client) ListFileNames(ctx context.Context, bucketId string, opt *ListFi
 	if opt != nil {
 		o = *opt
 	}
+	maxFileCount, err := normalizeMaxFileCount(o.MaxFileCount)
+	if err != nil {
+		return ListFileNamesResponse{}, err
+	}
 
 	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_list_file_names", &request{
 		bucketId,
 		o.StartFileName,
-		o.MaxFileCount,
+		maxFileCount,
 		o.Prefix,
 		o.Delimiter,
 	})
@@ -690,7 +1147,7 @@ func (c *Client) ListFileNames(ctx context.Context, bucketId string, opt *ListFi
 type ListFileVersionsOptions struct {
 	StartFileName string // optional, starting offset filename for pagination
 	StartFileId   string // optional, first file id to return, must set StartFileName if this is provided
-	MaxFileCount  int    // optional, number of files to return, 0 = default of 100, fee on every 1000 items returned
+	MaxFileCount  int    // optional, number of files to return, 0 = default of 100, clamped to MaxListFileCount, fee on every 1000 items returned
 	Prefix        string // optional, objects must have this key prefix
 	Delimiter     string // optional, empty means list all files, "/" means list top level files and folders
 }
@@ -709,12 +1166,16 @@ func (c *Client) ListFileVersions(ctx context.Context, bucketId string, opt *Lis
 	if opt != nil {
 		o = *opt
 	}
+	maxFileCount, err := normalizeMaxFileCount(o.MaxFileCount)
+	if err != nil {
+		return ListFileVersionsResponse{}, err
+	}
 
 	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_list_file_versions", &request{
 		bucketId,
 		o.StartFileName,
 		o.StartFileId,
-		o.MaxFileCount,
+		maxFileCount,
 		o.Prefix,
 		o.Delimiter,
 	})
@@ -735,8 +1196,8 @@ type ListKeysOptions struct {
 func (c *Client) ListKeys(ctx context.Context, opt ListKeysOptions) (ListKeysResponse, error) {
 	type request struct {
 		AccountId             string `json:"accountId"`
-		MaxKeyCount           int    `json:"maxKeyCount"`
-		StartApplicationKeyId string `json:"startApplicationKeyId"`
+		MaxKeyCount           int    `json:"maxKeyCount,omitempty"`
+		StartApplicationKeyId string `json:"startApplicationKeyId,omitempty"`
 	}
 
 	auth := c.LastAuth()
@@ -793,9 +1254,9 @@ type ListUnfinishedLargeFilesOptions struct {
 func (c *Client) ListUnfinishedLargeFiles(ctx context.Context, bucketId string, opt ListUnfinishedLargeFilesOptions) (ListUnfinishedLargeFilesResponse, error) {
 	type request struct {
 		BucketId     string `json:"bucketId"`
-		NamePrefix   string `json:"namePrefix"`
-		StartFileId  string `json:"startFileId"`
-		MaxPartCount int    `json:"maxPartCount"`
+		NamePrefix   string `json:"namePrefix,omitempty"`
+		StartFileId  string `json:"startFileId,omitempty"`
+		MaxFileCount int    `json:"maxFileCount,omitempty"`
 	}
 
 	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_list_unfinished_large_files", &request{
@@ -813,19 +1274,58 @@ func (c *Client) ListUnfinishedLargeFiles(ctx context.Context, bucketId string,
 	return r, err
 }
 
+// SetBucketNotificationRules replaces all the event notification rules of a
+// bucket. Requires Authorize to have been called.
+func (c *Client) SetBucketNotificationRules(ctx context.Context, bucketId string, rules []NotificationRule) (SetBucketNotificationRulesResponse, error) {
+	type request struct {
+		BucketId string             `json:"bucketId"`
+		Rules    []NotificationRule `json:"eventNotificationRules"`
+	}
+	if rules == nil {
+		rules = []NotificationRule{}
+	}
+
+	// event notifications are only available in v3 of the API
+	req, err := c.authRequest(ctx, "POST", "/b2api/v3/b2_set_bucket_notification_rules", &request{bucketId, rules})
+	if err != nil {
+		return SetBucketNotificationRulesResponse{}, err
+	}
+
+	var r SetBucketNotificationRulesResponse
+	err = c.do(req, &r)
+	return r, err
+}
+
+type StartLargeFileOptions struct {
+	FileName             string    // required
+	ContentType          string    // required, use ContentTypeAuto to let B2 determine it
+	FileInfo             *FileInfo // optional
+	ServerSideEncryption *SSE      // optional
+}
+
 func (c *Client) StartLargeFile(ctx context.Context, bucketId, fileName, contentType string, fileInfo *FileInfo) (StartLargeFileResponse, error) {
+	return c.StartLargeFileWithOptions(ctx, bucketId, StartLargeFileOptions{
+		FileName:    fileName,
+		ContentType: contentType,
+		FileInfo:    fileInfo,
+	})
+}
+
+func (c *Client) StartLargeFileWithOptions(ctx context.Context, bucketId string, opt StartLargeFileOptions) (StartLargeFileResponse, error) {
 	type request struct {
-		BucketId    string    `json:"bucketId"`
-		FileName    string    `json:"namePrefix"`
-		ContentType string    `json:"startFileId"`
-		FileInfo    *FileInfo `json:"fileInfo,omitempty"`
+		BucketId             string    `json:"bucketId"`
+		FileName             string    `json:"fileName"`
+		ContentType          string    `json:"contentType"`
+		FileInfo             *FileInfo `json:"fileInfo,omitempty"`
+		ServerSideEncryption *SSE      `json:"serverSideEncryption,omitempty"`
 	}
 
-	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_list_unfinished_large_files", &request{
+	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_start_large_file", &request{
 		bucketId,
-		fileName,
-		contentType,
-		fileInfo,
+		opt.FileName,
+		opt.ContentType,
+		opt.FileInfo,
+		opt.ServerSideEncryption,
 	})
 	if err != nil {
 		return StartLargeFileResponse{}, err
@@ -837,11 +1337,13 @@ func (c *Client) StartLargeFile(ctx context.Context, bucketId, fileName, content
 }
 
 type UpdateBucketOptions struct {
-	BucketType     BucketType      // optional
-	BucketInfo     BucketInfo      // optional
-	CorsRules      []CorsRule      // optional
-	LifecycleRules []LifecycleRule // optional
-	IfRevisionIs   *int            // optional
+	BucketType                  BucketType      // optional
+	BucketInfo                  BucketInfo      // optional
+	CorsRules                   []CorsRule      // optional
+	LifecycleRules              []LifecycleRule // optional
+	IfRevisionIs                *int            // optional
+	DefaultServerSideEncryption *SSE            // optional, only SSEModeB2 is supported
+	DefaultRetention            *FileRetention  // optional, requires file lock to be enabled on the bucket
 }
 
 func (c *Client) UpdateBucket(ctx context.Context, bucketId string, opt UpdateBucketOptions) (UpdateBucketResponse, error) {
@@ -853,8 +1355,14 @@ func (c *Client) UpdateBucket(ctx context.Context, bucketId string, opt UpdateBu
 		CorsRules      []CorsRule      `json:"corsRules,omitempty"`
 		LifecycleRules []LifecycleRule `json:"lifecycleRules,omitempty"`
 		IfRevisionIs   *int            `json:"ifRevisionIs,omitempty"`
+
+		DefaultServerSideEncryption *SSE           `json:"defaultServerSideEncryption,omitempty"`
+		DefaultRetention            *FileRetention `json:"defaultRetention,omitempty"`
 	}
 
+	if err := validateBucketRules(opt.CorsRules, opt.LifecycleRules); err != nil {
+		return UpdateBucketResponse{}, err
+	}
 	auth := c.LastAuth()
 	if auth == nil {
 		return UpdateBucketResponse{}, ErrAuthTokenMissing
@@ -868,6 +1376,8 @@ func (c *Client) UpdateBucket(ctx context.Context, bucketId string, opt UpdateBu
 		opt.CorsRules,
 		opt.LifecycleRules,
 		opt.IfRevisionIs,
+		opt.DefaultServerSideEncryption,
+		opt.DefaultRetention,
 	})
 	if err != nil {
 		return UpdateBucketResponse{}, err
@@ -879,12 +1389,16 @@ func (c *Client) UpdateBucket(ctx context.Context, bucketId string, opt UpdateBu
 }
 
 type UploadFileOptions struct {
-	FileName      string        // required
-	ContentType   string        // required, use ContentTypeHide to hide, empty defaults to auto
-	ContentLength int64         // required, use ContentLengthDetermineUsingTempStorage to determine it using temp storage
-	Body          io.ReadCloser // required
+	FileName    string // required
+	ContentType string // required, use ContentTypeHide to hide, empty defaults to auto
+	// optional, if ContentType is empty, detect it with DetectContentType
+	// instead of letting B2 pick it
+	AutoDetectContentType bool
+	ContentLength         int64         // required, use ContentLengthDetermineUsingTempStorage to determine it using temp storage
+	Body                  io.ReadCloser // required
 
 	ContentSha1 string // required, leave empty to interpret from body
+	ContentMd5  string // optional, hex md5 of the content, sent as Content-MD5 for additional integrity checking
 
 	SrcLastModified     *time.Time        // optional
 	ContentDisposition  string            // optional, RFC 2616
@@ -893,7 +1407,14 @@ type UploadFileOptions struct {
 	CacheControl        string            // optional
 	ContentEncoding     string            // optional, RFC 2616
 	DownloadContentType string            // optional, RFC 2616
+	Info                map[string]string // optional, custom file info by name, characters B2 disallows in names become underscores
 	ExtraHeaders        map[string]string // extra headers to add, currently must be prefixed with "X-Bz-Info-*" and * should use underscores over hyphens
+
+	ServerSideEncryption *SSE // optional, defaults to the bucket's default encryption
+
+	// optional, called from the goroutine writing the request as Body is read.
+	// Reports bytes of Body, excluding any appended sha1.
+	Progress ProgressFunc
 }
 
 func (c *Client) UploadFile(ctx context.Context, uploadURL, authToken string, opt UploadFileOptions) (UploadFileResponse, error) {
@@ -904,6 +1425,10 @@ func (c *Client) UploadFile(ctx context.Context, uploadURL, authToken string, op
 
 	err = opt.setOnRequest(req, c.TS)
 	if err != nil {
+		if req.Body != nil {
+			// releases any temp storage, like Client.Do would have
+			req.Body.Close()
+		}
 		return UploadFileResponse{}, err
 	}
 
@@ -912,7 +1437,19 @@ func (c *Client) UploadFile(ctx context.Context, uploadURL, authToken string, op
 	return r, err
 }
 
+// readerLength returns the remaining length of r. Readers that can seek are
+// measured in place, otherwise r is buffered into ts (or memory if ts is nil).
 func readerLength(ts TempStorage, r io.ReadCloser) (io.ReadCloser, int64, error) {
+	if s, cur, ok := seekable(r); ok {
+		end, err := s.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, err
+		}
+		if _, err = s.Seek(cur, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+		return r, end - cur, nil
+	}
 	if ts == nil {
 		buf := bytes.NewBuffer(nil)
 		n, err := io.Copy(buf, r)
@@ -929,6 +1466,28 @@ func readerLength(ts TempStorage, r io.ReadCloser) (io.ReadCloser, int64, error)
 	}
 }
 
+// detectBodyContentType detects the content type of body, returning a reader
+// with the same contents since body may not be seekable.
+func detectBodyContentType(fileName string, body io.ReadCloser) (io.ReadCloser, string, error) {
+	if rs, _, ok := seekable(body); ok {
+		contentType, err := detectContentType(fileName, rs)
+		return body, contentType, err
+	}
+	peek := make([]byte, sniffLen)
+	n, err := io.ReadFull(body, peek)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return body, "", err
+	}
+	peek = peek[:n]
+	rc := &readCloser{io.MultiReader(bytes.NewReader(peek), body), body}
+	return rc, DetectContentType(fileName, peek), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
 func (opt *UploadFileOptions) setOnRequest(r *http.Request, ts TempStorage) error {
 	r.Header.Set("X-Bz-File-Name", opt.FileName)
 	if opt.ContentType == "" {
@@ -948,6 +1507,20 @@ func (opt *UploadFileOptions) setOnRequest(r *http.Request, ts TempStorage) erro
 		}
 	}
 
+	if opt.ContentType == "" && opt.AutoDetectContentType {
+		var contentType string
+		var err error
+		body, contentType, err = detectBodyContentType(opt.FileName, body)
+		if err != nil {
+			return fmt.Errorf("Error while detecting content type: %w", err)
+		}
+		r.Header.Set("Content-Type", contentType)
+	}
+
+	if opt.Progress != nil {
+		body = &progressReader{R: body, Fn: opt.Progress, Total: length}
+	}
+
 	if opt.ContentSha1 == "" || opt.ContentSha1 == Sha1AtEnd {
 		rdr := &HashedPostfixedReader{R: body, H: sha1.New()}
 		r.Body = rdr
@@ -959,8 +1532,16 @@ func (opt *UploadFileOptions) setOnRequest(r *http.Request, ts TempStorage) erro
 	}
 	r.ContentLength = length
 
+	if opt.ContentMd5 != "" {
+		sum, err := hex.DecodeString(opt.ContentMd5)
+		if err != nil || len(sum) != md5.Size {
+			return fmt.Errorf("Invalid ContentMd5 %#v: expected %d hex encoded bytes", opt.ContentMd5, md5.Size)
+		}
+		r.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum))
+	}
+
 	if opt.SrcLastModified != nil {
-		r.Header.Set("X-Bz-src_last_modified_millis", strconv.Itoa(int(opt.SrcLastModified.Unix())))
+		r.Header.Set("X-Bz-Info-src_last_modified_millis", strconv.FormatInt(timeToMillis(*opt.SrcLastModified), 10))
 	}
 
 	if opt.ContentDisposition != "" {
@@ -987,17 +1568,35 @@ func (opt *UploadFileOptions) setOnRequest(r *http.Request, ts TempStorage) erro
 		r.Header.Set("X-Bz-Info-b2-content-type", opt.DownloadContentType)
 	}
 
+	opt.ServerSideEncryption.setOnRequest(r)
+
+	info, err := sanitizeInfo(opt.Info)
+	if err != nil {
+		return err
+	}
+	for name, v := range info {
+		r.Header.Set(fileInfoHeaderPrefix+name, encodeFileInfoValue(v))
+	}
+
 	for k, v := range opt.ExtraHeaders {
 		r.Header.Set(k, v)
 	}
-	return nil
+
+	return checkFileInfoHeaders(r.Header)
 }
 
 type UploadFilePartOptions struct {
+	PartNumber    int           // required, 1-based index of the part, up to 10000
 	ContentType   string        // required, use ContentTypeHide to hide, empty defaults to auto
 	ContentLength int64         // required, if negative use temp storage to buffer the result for caching
 	Body          io.ReadCloser // required
-	ContentSha1   string        // required, sha1 of the part being uploaded, leave empty to interpret from body
+	ContentSha1   string        // required, sha1 of the part being uploaded, leave empty or use Sha1AtEnd to interpret from body
+
+	ServerSideEncryption *SSE // optional, required if the large file uses SSEModeC
+
+	// optional, called from the goroutine writing the request as Body is read.
+	// Reports bytes of Body, excluding any appended sha1.
+	Progress ProgressFunc
 }
 
 func (c *Client) UploadPart(ctx context.Context, uploadPartURL, uploadPartAuthToken string, opt UploadFilePartOptions) (UploadPartResponse, error) {
@@ -1008,6 +1607,10 @@ func (c *Client) UploadPart(ctx context.Context, uploadPartURL, uploadPartAuthTo
 
 	err = opt.setOnRequest(req, c.TS)
 	if err != nil {
+		if req.Body != nil {
+			// releases any temp storage, like Client.Do would have
+			req.Body.Close()
+		}
 		return UploadPartResponse{}, err
 	}
 
@@ -1017,6 +1620,7 @@ func (c *Client) UploadPart(ctx context.Context, uploadPartURL, uploadPartAuthTo
 }
 
 func (opt *UploadFilePartOptions) setOnRequest(r *http.Request, ts TempStorage) error {
+	r.Header.Set("X-Bz-Part-Number", strconv.Itoa(opt.PartNumber))
 	if opt.ContentType == "" {
 		r.Header.Set("Content-Type", ContentTypeAuto)
 	} else {
@@ -1034,14 +1638,20 @@ func (opt *UploadFilePartOptions) setOnRequest(r *http.Request, ts TempStorage)
 		}
 	}
 
-	if opt.ContentSha1 == "" {
-		rdr := &HashedPostfixedReader{R: opt.Body, H: sha1.New()}
+	if opt.Progress != nil {
+		body = &progressReader{R: body, Fn: opt.Progress, Total: length}
+	}
+
+	if opt.ContentSha1 == "" || opt.ContentSha1 == Sha1AtEnd {
+		rdr := &HashedPostfixedReader{R: body, H: sha1.New()}
 		r.Body = rdr
 		length += 40 // sha1 -> hex is 40 bytes
+		r.Header.Set("X-Bz-Content-Sha1", Sha1AtEnd)
 	} else {
-		r.Body = opt.Body
+		r.Body = body
 		r.Header.Set("X-Bz-Content-Sha1", opt.ContentSha1)
 	}
 	r.ContentLength = length
+	opt.ServerSideEncryption.setCustomerKeyOnRequest(r)
 	return nil
 }
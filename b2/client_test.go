@@ -3,7 +3,19 @@ package b2
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestListingBuckets(t *testing.T) {
@@ -113,3 +125,1372 @@ func TestFileManagement(t *testing.T) {
 		}
 	})
 }
+
+func TestLargeFileManagement(t *testing.T) {
+	c, ok := liveTestRetryClient(t, true)
+	if !ok {
+		return
+	}
+
+	ctx := context.Background()
+	res, err := c.StartLargeFile(ctx, integrationConfig.BucketID, "test-large", ContentTypeText, nil)
+	if err != nil {
+		t.Fatalf("Failed to start large file: %s", err)
+	}
+
+	if res.FileName != "test-large" {
+		t.Fatalf("Expected filename of started file to match (%#v != %#v)", res.FileName, "test-large")
+	}
+
+	if res.Action != ActionStart {
+		t.Fatalf("Expected state of started file to match (%#v != %#v)", res.Action, ActionStart)
+	}
+
+	cancelRes, err := c.CancelLargeFile(ctx, res.FileID)
+	if err != nil {
+		t.Fatalf("Failed to cancel large file: %s", err)
+	}
+
+	if cancelRes.FileId != res.FileID {
+		t.Fatalf("Expected FileIDs to match when cancelling: %#v != %#v", cancelRes.FileId, res.FileID)
+	}
+}
+
+func TestStartLargeFileRequest(t *testing.T) {
+	var body map[string]interface{}
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/b2api/v2/b2_start_large_file" {
+			t.Errorf("Unexpected endpoint: %s", r.URL.Path)
+		}
+		body = decodeBody(t, r)
+		writeJSON(w, 200, File{FileID: "4_z", FileName: "big.bin", Action: ActionStart})
+	})
+
+	info := FileInfo{"author": "jeff"}
+	res, err := c.StartLargeFile(context.Background(), "bucket", "big.bin", ContentTypeText, &info)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if res.FileID != "4_z" {
+		t.Fatalf("Expected FileID to be decoded, got: %#v", res.FileID)
+	}
+
+	expected := map[string]interface{}{
+		"bucketId":    "bucket",
+		"fileName":    "big.bin",
+		"contentType": ContentTypeText,
+	}
+	for k, v := range expected {
+		if body[k] != v {
+			t.Errorf("Expected %s=%#v, got: %#v", k, v, body[k])
+		}
+	}
+	if fi, ok := body["fileInfo"].(map[string]interface{}); !ok || fi["author"] != "jeff" {
+		t.Errorf("Expected fileInfo to be sent, got: %#v", body["fileInfo"])
+	}
+	if len(body) != 4 {
+		t.Errorf("Expected only documented fields, got: %#v", body)
+	}
+}
+
+func TestUploadFileSrcLastModifiedHeader(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://localhost", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	modified := time.Date(2020, time.March, 4, 5, 6, 7, 890*int(time.Millisecond), time.UTC)
+	opt := UploadFileOptions{
+		FileName:        "test",
+		ContentLength:   5,
+		ContentSha1:     "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+		Body:            Closer(bytes.NewBufferString("hello")),
+		SrcLastModified: &modified,
+	}
+	if err := opt.setOnRequest(req, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := "1583298367890"
+	if got := req.Header.Get("X-Bz-Info-src_last_modified_millis"); got != expected {
+		t.Fatalf("Expected src_last_modified_millis = %#v, got: %#v", expected, got)
+	}
+}
+
+func TestUploadFileInfoHeaders(t *testing.T) {
+	newOpt := func(info map[string]string) UploadFileOptions {
+		return UploadFileOptions{
+			FileName:      "test",
+			ContentLength: 5,
+			ContentSha1:   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+			Body:          Closer(bytes.NewBufferString("hello")),
+			CacheControl:  "max-age=60",
+			Info:          info,
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "http://localhost", nil)
+	opt := newOpt(map[string]string{"my key": "a b+c/d", "author": "José"})
+	if err := opt.setOnRequest(req, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := req.Header.Get("X-Bz-Info-my_key"); got != "a%20b%2Bc%2Fd" {
+		t.Errorf("Expected X-Bz-Info-my_key to be percent-encoded, got: %#v", got)
+	}
+	if got := req.Header.Get("X-Bz-Info-author"); got != "Jos%C3%A9" {
+		t.Errorf("Expected X-Bz-Info-author to be percent-encoded, got: %#v", got)
+	}
+	if info, err := opt.fileInfo(); err != nil || info["my_key"] != "a b+c/d" {
+		t.Errorf("Expected large file info to use the sanitized name, got: %#v, %v", info, err)
+	}
+
+	req, _ = http.NewRequest("POST", "http://localhost", nil)
+	opt = newOpt(map[string]string{"???": "x"})
+	if err := opt.setOnRequest(req, nil); err == nil || !strings.Contains(err.Error(), "Invalid Info key") {
+		t.Errorf("Expected invalid key error, got: %v", err)
+	}
+	if _, err := opt.fileInfo(); err == nil || !strings.Contains(err.Error(), "Invalid Info key") {
+		t.Errorf("Expected invalid key error for large file info, got: %v", err)
+	}
+
+	req, _ = http.NewRequest("POST", "http://localhost", nil)
+	opt = newOpt(map[string]string{"my key": "a", "my_key": "b"})
+	const collision = `Invalid Info keys "my key" and "my_key": both are sent as "my_key"`
+	if err := opt.setOnRequest(req, nil); err == nil || err.Error() != collision {
+		t.Errorf("Expected colliding keys error, got: %v", err)
+	}
+	if _, err := opt.fileInfo(); err == nil || err.Error() != collision {
+		t.Errorf("Expected colliding keys error for large file info, got: %v", err)
+	}
+
+	info := map[string]string{}
+	for i := 0; i < MaxFileInfoEntries; i++ {
+		info[fmt.Sprintf("key%d", i)] = "v"
+	}
+	req, _ = http.NewRequest("POST", "http://localhost", nil)
+	opt = newOpt(info)
+	var tooMany *ErrTooManyFileInfo
+	if err := opt.setOnRequest(req, nil); !errors.As(err, &tooMany) || tooMany.Entries != 11 {
+		t.Errorf("Expected too many file info error including CacheControl, got: %v", err)
+	}
+}
+
+func TestUploadFileInfoLimits(t *testing.T) {
+	modified := time.Date(2020, time.March, 4, 5, 6, 7, 0, time.UTC)
+	newOpt := func(entries int, value string) UploadFileOptions {
+		// 2 reserved entries, 1 extra header, the rest in Info
+		info := map[string]string{}
+		for i := 0; i < entries-3; i++ {
+			info[fmt.Sprintf("key%d", i)] = value
+		}
+		return UploadFileOptions{
+			FileName:        "test",
+			ContentLength:   5,
+			ContentSha1:     "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+			Body:            Closer(bytes.NewBufferString("hello")),
+			SrcLastModified: &modified,
+			CacheControl:    "max-age=60",
+			ExtraHeaders:    map[string]string{"X-Bz-Info-extra": "v"},
+			Info:            info,
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "http://localhost", nil)
+	opt := newOpt(MaxFileInfoEntries, "v")
+	if err := opt.setOnRequest(req, nil); err != nil {
+		t.Fatalf("Expected %d entries to be allowed, got: %s", MaxFileInfoEntries, err)
+	}
+
+	var tooMany *ErrTooManyFileInfo
+	req, _ = http.NewRequest("POST", "http://localhost", nil)
+	opt = newOpt(MaxFileInfoEntries+1, "v")
+	if err := opt.setOnRequest(req, nil); !errors.As(err, &tooMany) || tooMany.Entries != MaxFileInfoEntries+1 {
+		t.Fatalf("Expected ErrTooManyFileInfo for %d entries, got: %v", MaxFileInfoEntries+1, err)
+	}
+
+	req, _ = http.NewRequest("POST", "http://localhost", nil)
+	opt = newOpt(4, strings.Repeat("a", MaxFileInfoHeaderBytes))
+	err := opt.setOnRequest(req, nil)
+	if !errors.As(err, &tooMany) || tooMany.Bytes <= MaxFileInfoHeaderBytes || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("Expected ErrTooManyFileInfo for oversized values, got: %v", err)
+	}
+
+	// large files send the same info to b2_start_large_file
+	opt = newOpt(MaxFileInfoEntries, "v")
+	if _, err := opt.fileInfo(); err != nil {
+		t.Fatalf("Expected %d large file info entries to be allowed, got: %s", MaxFileInfoEntries, err)
+	}
+	opt = newOpt(MaxFileInfoEntries+1, "v")
+	if _, err := opt.fileInfo(); !errors.As(err, &tooMany) || tooMany.Entries != MaxFileInfoEntries+1 {
+		t.Fatalf("Expected ErrTooManyFileInfo for %d large file info entries, got: %v", MaxFileInfoEntries+1, err)
+	}
+	opt = newOpt(4, strings.Repeat("a", MaxFileInfoHeaderBytes))
+	if _, err := opt.fileInfo(); !errors.As(err, &tooMany) || tooMany.Bytes <= MaxFileInfoHeaderBytes {
+		t.Fatalf("Expected ErrTooManyFileInfo for oversized large file info, got: %v", err)
+	}
+
+	opt = newOpt(4, "v")
+	opt.ExtraHeaders["X-Bz-Info-extra"] = "a%20b%2Bc"
+	if info, err := opt.fileInfo(); err != nil || info["extra"] != "a b+c" {
+		t.Fatalf("Expected ExtraHeaders info to be percent-decoded, got: %#v, %v", info, err)
+	}
+	opt.ExtraHeaders["X-Bz-Info-extra"] = "100%"
+	if _, err := opt.fileInfo(); err == nil || !strings.Contains(err.Error(), "Invalid X-Bz-Info-extra header") {
+		t.Fatalf("Expected invalid percent-encoding error, got: %v", err)
+	}
+}
+
+func TestUploadFileContentMd5Header(t *testing.T) {
+	newOpt := func(md5 string) UploadFileOptions {
+		return UploadFileOptions{
+			FileName:      "test",
+			ContentLength: 5,
+			ContentSha1:   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+			ContentMd5:    md5,
+			Body:          Closer(bytes.NewBufferString("hello")),
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "http://localhost", nil)
+	opt := newOpt("5d41402abc4b2a76b9719d911017c592")
+	if err := opt.setOnRequest(req, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "XUFAKrxLKna5cZ2REBfFkg=="
+	if got := req.Header.Get("Content-MD5"); got != expected {
+		t.Fatalf("Expected Content-MD5 = %#v, got: %#v", expected, got)
+	}
+
+	req, _ = http.NewRequest("POST", "http://localhost", nil)
+	opt = newOpt("")
+	if err := opt.setOnRequest(req, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := req.Header["Content-Md5"]; ok {
+		t.Fatalf("Expected no Content-MD5 header, got: %#v", req.Header.Get("Content-MD5"))
+	}
+
+	req, _ = http.NewRequest("POST", "http://localhost", nil)
+	opt = newOpt("not-hex")
+	if err := opt.setOnRequest(req, nil); err == nil {
+		t.Fatalf("Expected error for invalid ContentMd5")
+	}
+}
+
+func TestUploadFileProgress(t *testing.T) {
+	var uploaded []byte
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		uploaded, _ = ioutil.ReadAll(r.Body)
+		writeJSON(w, 200, UploadFileResponse{FileID: "id"})
+	})
+
+	data := bytes.Repeat([]byte("hello world"), 10000)
+	var reported, total int64
+	calls := 0
+	_, err := c.UploadFile(context.Background(), c.lastAuth.APIURL+"/upload", "token", UploadFileOptions{
+		FileName:      "test",
+		ContentLength: int64(len(data)),
+		Body:          Closer(bytes.NewReader(data)),
+		Progress: func(n, t int64) {
+			calls++
+			reported, total = n, t
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if len(uploaded) != len(data)+40 {
+		t.Fatalf("Expected %d bytes uploaded, got: %d", len(data)+40, len(uploaded))
+	}
+	if calls == 0 {
+		t.Fatalf("Expected progress to be reported")
+	}
+	if reported != int64(len(data)) || total != int64(len(data)) {
+		t.Fatalf("Expected progress %d/%d, got: %d/%d", len(data), len(data), reported, total)
+	}
+}
+
+func TestFileResponseDecodesContentMd5(t *testing.T) {
+	var f UploadFileResponse
+	err := json.Unmarshal([]byte(`{"fileId": "id", "contentMd5": "5d41402abc4b2a76b9719d911017c592"}`), &f)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if f.ContentMd5 != "5d41402abc4b2a76b9719d911017c592" {
+		t.Fatalf("Expected ContentMd5 to be decoded, got: %#v", f.ContentMd5)
+	}
+}
+
+func TestClientConcurrentRequests(t *testing.T) {
+	var m sync.Mutex
+	agents := make(map[string]int)
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		agents[r.Header.Get("User-Agent")]++
+		m.Unlock()
+		writeJSON(w, 200, ListFileNamesResponse{})
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := c.ListFileNames(context.Background(), "bucket", nil); err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := c.ListBuckets(context.Background(), nil); err != nil {
+				t.Errorf("Unexpected error: %s", err)
+			}
+			c.LastAuth()
+		}()
+	}
+	wg.Wait()
+
+	if len(agents) != 1 || agents[DefaultUserAgent()] != 40 {
+		t.Fatalf("Expected all requests to use the default user agent, got: %#v", agents)
+	}
+}
+
+func TestRequestWithBodyCarriesContext(t *testing.T) {
+	called := false
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		writeJSON(w, 200, ListFileNamesResponse{})
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req, err := c.authRequest(ctx, "POST", "/b2api/v2/b2_list_file_names", &requestByFileID{"id"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if req.Context().Err() != context.Canceled {
+		t.Fatalf("Expected request to carry cancelled context, got: %v", req.Context().Err())
+	}
+
+	_, err = c.ListFileNames(ctx, "bucket", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got: %v", err)
+	}
+	if called {
+		t.Fatalf("Expected cancelled request to not reach the server")
+	}
+}
+
+func TestUploadPartSha1AtEndUsesBufferedBody(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://localhost", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	opt := UploadFilePartOptions{
+		ContentLength: ContentLengthDetermineUsingTempStorage,
+		Body:          Closer(bytes.NewBufferString("hello world")),
+	}
+	if err := opt.setOnRequest(req, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if got := req.Header.Get("X-Bz-Content-Sha1"); got != Sha1AtEnd {
+		t.Fatalf("Expected X-Bz-Content-Sha1 = %#v, got: %#v", Sha1AtEnd, got)
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "hello world2aae6c35c94fcfb415dbe95f408b9ce91ee846ed"
+	if string(b) != expected {
+		t.Fatalf("Expected body %#v, got: %#v", expected, string(b))
+	}
+	if req.ContentLength != int64(len(expected)) {
+		t.Fatalf("Expected ContentLength = %d, got: %d", len(expected), req.ContentLength)
+	}
+}
+
+func TestUploadPartSha1AtEnd(t *testing.T) {
+	for _, sha1 := range []string{"", Sha1AtEnd} {
+		var (
+			header        http.Header
+			body          []byte
+			contentLength int64
+		)
+		c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+			header = r.Header
+			contentLength = r.ContentLength
+			body, _ = ioutil.ReadAll(r.Body)
+			writeJSON(w, 200, UploadPartResponse{FileID: "large", PartNumber: 2})
+		})
+
+		_, err := c.UploadPart(context.Background(), c.lastAuth.APIURL+"/upload", "token", UploadFilePartOptions{
+			PartNumber:    2,
+			ContentLength: 11,
+			ContentSha1:   sha1,
+			Body:          Closer(bytes.NewBufferString("hello world")),
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		if got := header.Get("X-Bz-Content-Sha1"); got != Sha1AtEnd {
+			t.Errorf("Expected X-Bz-Content-Sha1 = %#v, got: %#v", Sha1AtEnd, got)
+		}
+		if got := header.Get("X-Bz-Part-Number"); got != "2" {
+			t.Errorf("Expected X-Bz-Part-Number = 2, got: %#v", got)
+		}
+		expected := "hello world2aae6c35c94fcfb415dbe95f408b9ce91ee846ed"
+		if string(body) != expected {
+			t.Errorf("Expected body %#v, got: %#v", expected, string(body))
+		}
+		if contentLength != 11+40 {
+			t.Errorf("Expected Content-Length = %d, got: %d", 11+40, contentLength)
+		}
+	}
+}
+
+func TestDownloadFileByNameEncodesPath(t *testing.T) {
+	cases := []struct {
+		FileName string
+		Path     string
+	}{
+		{"hello.txt", "/file/my-bucket/hello.txt"},
+		{"a b/c?d#e.txt", "/file/my-bucket/a%20b/c%3Fd%23e.txt"},
+		{"1+1=2;x", "/file/my-bucket/1%2B1=2%3Bx"},
+		{"photos/kätzchen/猫.jpg", "/file/my-bucket/photos/k%C3%A4tzchen/%E7%8C%AB.jpg"},
+		{"percent%20literal", "/file/my-bucket/percent%2520literal"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.FileName, func(t *testing.T) {
+			var path string
+			clt := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.EscapedPath()
+				w.Write([]byte("ok"))
+			})
+
+			res, err := clt.DownloadFileByName(context.Background(), "my-bucket", c.FileName, DownloadFileOptions{})
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			res.Body.Close()
+
+			if path != c.Path {
+				t.Fatalf("Expected path %#v, got: %#v", c.Path, path)
+			}
+		})
+	}
+}
+
+func TestHeadFile(t *testing.T) {
+	var paths []string
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("Expected HEAD request, got: %s", r.Method)
+		}
+		paths = append(paths, r.URL.RequestURI())
+		if r.URL.Query().Get("fileId") == "missing" || r.URL.Path == "/file/bucket/missing" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("X-Bz-File-Id", "4_z1")
+		w.Header().Set("X-Bz-File-Name", "hello.txt")
+		w.Header().Set("Content-Length", "11")
+		w.Write([]byte("hello world"))
+	})
+
+	ctx := context.Background()
+	res, err := c.HeadFileByID(ctx, "4_z1")
+	if err != nil || res.FileID != "4_z1" || res.ContentLength != 11 {
+		t.Fatalf("Expected parsed metadata, got: %#v, %v", res, err)
+	}
+
+	res, err = c.HeadFileByName(ctx, "bucket", "hello.txt")
+	if err != nil || res.FileName != "hello.txt" {
+		t.Fatalf("Expected parsed metadata, got: %#v, %v", res, err)
+	}
+
+	for _, f := range []func() error{
+		func() error { _, err := c.HeadFileByID(ctx, "missing"); return err },
+		func() error { _, err := c.HeadFileByName(ctx, "bucket", "missing"); return err },
+	} {
+		err := f()
+		if e, ok := err.(*ErrorResponse); !ok || e.Status != 404 || e.Code != ErrCodeNotFound {
+			t.Fatalf("Expected not found error, got: %#v", err)
+		}
+	}
+
+	expected := []string{
+		"/b2api/v2/b2_download_file_by_id?fileId=4_z1",
+		"/file/bucket/hello.txt",
+		"/b2api/v2/b2_download_file_by_id?fileId=missing",
+		"/file/bucket/missing",
+	}
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected %#v, got: %#v", expected, paths)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Fatalf("Expected %#v, got: %#v", expected, paths)
+		}
+	}
+}
+
+func TestBucketNotificationRules(t *testing.T) {
+	rule := NotificationRule{
+		Name:             "uploads",
+		EventTypes:       []string{EventObjectCreatedAll},
+		ObjectNamePrefix: "photos/",
+		TargetConfiguration: NotificationTargetConfiguration{
+			TargetType:              NotificationTargetTypeWebhook,
+			URL:                     "https://example.com/webhook",
+			CustomHeaders:           []NotificationHeader{{Name: "X-Source", Value: "b2"}},
+			HmacSha256SigningSecret: "sEcReT",
+		},
+		IsEnabled: true,
+	}
+
+	var setBody map[string]interface{}
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/b2api/v3/b2_set_bucket_notification_rules":
+			setBody = decodeBody(t, r)
+			writeJSON(w, 200, map[string]interface{}{
+				"bucketId":               "bucket",
+				"eventNotificationRules": setBody["eventNotificationRules"],
+			})
+		case "/b2api/v3/b2_get_bucket_notification_rules":
+			if r.URL.Query().Get("bucketId") != "bucket" {
+				t.Errorf("Expected bucketId query parameter, got: %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"bucketId": "bucket", "eventNotificationRules": [{
+				"eventTypes": ["b2:ObjectCreated:*"],
+				"isEnabled": true,
+				"isSuspended": true,
+				"name": "uploads",
+				"objectNamePrefix": "photos/",
+				"suspensionReason": "webhook failed",
+				"targetConfiguration": {"targetType": "webhook", "url": "https://example.com/webhook"}
+			}]}`))
+		default:
+			t.Errorf("Unexpected request: %s", r.URL.Path)
+		}
+	})
+
+	ctx := context.Background()
+	setRes, err := c.SetBucketNotificationRules(ctx, "bucket", []NotificationRule{rule})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(setRes.Rules) != 1 || setRes.Rules[0].TargetConfiguration.CustomHeaders[0].Value != "b2" {
+		t.Fatalf("Expected rules to be returned, got: %#v", setRes)
+	}
+
+	rules := setBody["eventNotificationRules"].([]interface{})
+	sent := rules[0].(map[string]interface{})
+	target := sent["targetConfiguration"].(map[string]interface{})
+	if sent["name"] != "uploads" || sent["objectNamePrefix"] != "photos/" || sent["isEnabled"] != true ||
+		sent["eventTypes"].([]interface{})[0] != EventObjectCreatedAll {
+		t.Fatalf("Unexpected rule sent: %#v", sent)
+	}
+	if target["targetType"] != "webhook" || target["url"] != "https://example.com/webhook" || target["hmacSha256SigningSecret"] != "sEcReT" {
+		t.Fatalf("Unexpected target configuration sent: %#v", target)
+	}
+	if _, ok := sent["isSuspended"]; ok {
+		t.Fatalf("Expected read-only fields to not be sent: %#v", sent)
+	}
+
+	getRes, err := c.GetBucketNotificationRules(ctx, "bucket")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(getRes.Rules) != 1 || !getRes.Rules[0].IsSuspended || getRes.Rules[0].SuspensionReason != "webhook failed" {
+		t.Fatalf("Expected rules to be decoded, got: %#v", getRes)
+	}
+}
+
+func TestUploadFileServerSideEncryptionHeader(t *testing.T) {
+	for _, sse := range []*SSE{nil, {Mode: SSEModeB2}} {
+		req, err := http.NewRequest("POST", "http://localhost", nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		opt := UploadFileOptions{
+			FileName:             "test",
+			ContentLength:        5,
+			Body:                 Closer(bytes.NewBufferString("hello")),
+			ServerSideEncryption: sse,
+		}
+		if err := opt.setOnRequest(req, nil); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		got, ok := req.Header["X-Bz-Server-Side-Encryption"]
+		if sse == nil && ok {
+			t.Fatalf("Expected no encryption header by default, got: %#v", got)
+		}
+		if sse != nil && (len(got) != 1 || got[0] != SSEAlgorithmAES256) {
+			t.Fatalf("Expected encryption header to be AES256, got: %#v", got)
+		}
+	}
+}
+
+func TestServerSideEncryptionRequestBodies(t *testing.T) {
+	bodies := map[string]map[string]interface{}{}
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		bodies[r.URL.Path] = decodeBody(t, r)
+		writeJSON(w, 200, File{ServerSideEncryption: &SSE{Mode: SSEModeB2, Algorithm: SSEAlgorithmAES256}})
+	})
+
+	ctx := context.Background()
+	sse := &SSE{Mode: SSEModeB2}
+	res, err := c.CopyFile(ctx, CopyFileOptions{SourceFileId: "src", FileName: "dst", DestinationServerSideEncryption: sse})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if res.ServerSideEncryption == nil || res.ServerSideEncryption.Mode != SSEModeB2 {
+		t.Fatalf("Expected encryption of response to be decoded, got: %#v", res.ServerSideEncryption)
+	}
+	if _, err := c.StartLargeFileWithOptions(ctx, "bucket", StartLargeFileOptions{FileName: "f", ContentType: ContentTypeAuto, ServerSideEncryption: sse}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got, _ := bodies["/b2api/v2/b2_start_large_file"]["serverSideEncryption"].(map[string]interface{}); got["mode"] != "SSE-B2" {
+		t.Fatalf("Expected serverSideEncryption to be sent, got: %#v", bodies["/b2api/v2/b2_start_large_file"])
+	}
+	if _, err := c.StartLargeFile(ctx, "bucket", "f", ContentTypeAuto, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	copyBody := bodies["/b2api/v2/b2_copy_file"]
+	expected := map[string]interface{}{"mode": "SSE-B2", "algorithm": "AES256"}
+	if got, _ := copyBody["destinationServerSideEncryption"].(map[string]interface{}); len(got) != 2 || got["mode"] != expected["mode"] || got["algorithm"] != expected["algorithm"] {
+		t.Fatalf("Expected destinationServerSideEncryption = %#v, got: %#v", expected, copyBody["destinationServerSideEncryption"])
+	}
+	startBody := bodies["/b2api/v2/b2_start_large_file"]
+	if _, ok := startBody["serverSideEncryption"]; ok {
+		t.Fatalf("Expected no serverSideEncryption by default, got: %#v", startBody)
+	}
+}
+
+func TestServerSideEncryptionCustomerKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xAB}, 32)
+	const encodedKey = "q6urq6urq6urq6urq6urq6urq6urq6urq6urq6urq6s="
+	const encodedKeyMd5 = "6Z+00jTp9DFT5j+l/q0WFA=="
+	sse := &SSE{Mode: SSEModeC, Key: key}
+
+	var methods []string
+	var copyBody map[string]interface{}
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/b2api/v2/b2_copy_file" {
+			copyBody = decodeBody(t, r)
+			writeJSON(w, 200, File{})
+			return
+		}
+		methods = append(methods, r.Method)
+		if got := r.Header.Get("X-Bz-Server-Side-Encryption-Customer-Algorithm"); got != SSEAlgorithmAES256 {
+			t.Errorf("Expected customer algorithm header, got: %#v", got)
+		}
+		if got := r.Header.Get("X-Bz-Server-Side-Encryption-Customer-Key"); got != encodedKey {
+			t.Errorf("Expected customer key header, got: %#v", got)
+		}
+		if got := r.Header.Get("X-Bz-Server-Side-Encryption-Customer-Key-Md5"); got != encodedKeyMd5 {
+			t.Errorf("Expected customer key md5 header, got: %#v", got)
+		}
+		if _, ok := r.Header["X-Bz-Server-Side-Encryption"]; ok {
+			t.Errorf("Expected SSE-B2 header to not be sent for SSE-C")
+		}
+		if r.Method == "POST" {
+			writeJSON(w, 200, File{})
+		} else {
+			w.Write([]byte("hello"))
+		}
+	})
+
+	ctx := context.Background()
+	auth := c.LastAuth()
+	_, err := c.UploadFile(ctx, auth.APIURL+"/upload", "token", UploadFileOptions{
+		FileName:             "secret.txt",
+		ContentLength:        5,
+		Body:                 Closer(bytes.NewBufferString("hello")),
+		ServerSideEncryption: sse,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	res, err := c.DownloadFileByID(ctx, "id", &DownloadFileOptions{ServerSideEncryption: sse})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res.Body.Close()
+
+	if len(methods) != 2 || methods[0] != "POST" || methods[1] != "GET" {
+		t.Fatalf("Expected an upload and download, got: %#v", methods)
+	}
+
+	_, err = c.CopyFile(ctx, CopyFileOptions{
+		SourceFileId:                    "src",
+		FileName:                        "dst",
+		SourceServerSideEncryption:      sse,
+		DestinationServerSideEncryption: sse,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, k := range []string{"sourceServerSideEncryption", "destinationServerSideEncryption"} {
+		got, _ := copyBody[k].(map[string]interface{})
+		if got["mode"] != SSEModeC || got["algorithm"] != SSEAlgorithmAES256 || got["customerKey"] != encodedKey || got["customerKeyMd5"] != encodedKeyMd5 {
+			t.Fatalf("Expected %s to include the customer key, got: %#v", k, copyBody[k])
+		}
+	}
+}
+
+func TestServerSideEncryptionKeyIsNotLogged(t *testing.T) {
+	sse := &SSE{Mode: SSEModeC, Key: []byte("0123456789abcdef0123456789abcdef")}
+	body, err := json.Marshal(CopyFileOptions{SourceFileId: "src", FileName: "dst", DestinationServerSideEncryption: sse})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	logged := []string{
+		redactRequestBody(string(body)),
+		fmt.Sprintf("%v %+v %#v %s", *sse, *sse, *sse, *sse),
+	}
+	for _, s := range logged {
+		if strings.Contains(s, sse.customerKey()) || strings.Contains(s, string(sse.Key)) {
+			t.Fatalf("Expected key to be redacted, got: %s", s)
+		}
+	}
+}
+
+func TestBucketDefaultServerSideEncryption(t *testing.T) {
+	var bodies []map[string]interface{}
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		bodies = append(bodies, decodeBody(t, r))
+		w.Write([]byte(`{
+			"bucketId": "bucket",
+			"defaultServerSideEncryption": {
+				"isClientAuthorizedToRead": true,
+				"value": {"algorithm": "AES256", "mode": "SSE-B2"}
+			}
+		}`))
+	})
+
+	ctx := context.Background()
+	sse := &SSE{Mode: SSEModeB2}
+	created, err := c.CreateBucket(ctx, "name", BucketTypePrivate, &CreateBucketOptions{DefaultServerSideEncryption: sse})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if e := created.DefaultServerSideEncryption; e == nil || !e.IsClientAuthorizedToRead || e.Value.Mode != SSEModeB2 {
+		t.Fatalf("Expected default encryption to be decoded, got: %#v", created.DefaultServerSideEncryption)
+	}
+	if _, err := c.UpdateBucket(ctx, "bucket", UpdateBucketOptions{DefaultServerSideEncryption: sse}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := c.CreateBucket(ctx, "name", BucketTypePrivate, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := c.UpdateBucket(ctx, "bucket", UpdateBucketOptions{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	for i, body := range bodies {
+		got, ok := body["defaultServerSideEncryption"].(map[string]interface{})
+		if i < 2 && (got["mode"] != SSEModeB2 || got["algorithm"] != SSEAlgorithmAES256) {
+			t.Fatalf("Expected defaultServerSideEncryption to be sent, got: %#v", body)
+		}
+		if i >= 2 && ok {
+			t.Fatalf("Expected defaultServerSideEncryption to be omitted, got: %#v", body)
+		}
+	}
+}
+
+func TestBucketFileLock(t *testing.T) {
+	var bodies []map[string]interface{}
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		bodies = append(bodies, decodeBody(t, r))
+		w.Write([]byte(`{
+			"bucketId": "bucket",
+			"fileLockConfiguration": {
+				"isClientAuthorizedToRead": true,
+				"value": {
+					"defaultRetention": {"mode": "governance", "period": {"duration": 7, "unit": "days"}},
+					"isFileLockEnabled": true
+				}
+			}
+		}`))
+	})
+
+	ctx := context.Background()
+	enabled := true
+	created, err := c.CreateBucket(ctx, "name", BucketTypePrivate, &CreateBucketOptions{FileLockEnabled: &enabled})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	lock := created.FileLockConfiguration
+	if lock == nil || lock.Value == nil || !lock.Value.IsFileLockEnabled ||
+		lock.Value.DefaultRetention.Mode != RetentionModeGovernance || lock.Value.DefaultRetention.Period.Duration != 7 {
+		t.Fatalf("Expected file lock configuration to be decoded, got: %#v", lock)
+	}
+	if bodies[0]["fileLockEnabled"] != true {
+		t.Fatalf("Expected fileLockEnabled to be sent, got: %#v", bodies[0])
+	}
+
+	_, err = c.UpdateBucket(ctx, "bucket", UpdateBucketOptions{DefaultRetention: &FileRetention{
+		Mode:   RetentionModeGovernance,
+		Period: &RetentionPeriod{Duration: 7, Unit: RetentionUnitDays},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	retention, _ := bodies[1]["defaultRetention"].(map[string]interface{})
+	period, _ := retention["period"].(map[string]interface{})
+	if retention["mode"] != "governance" || period["duration"] != 7.0 || period["unit"] != "days" {
+		t.Fatalf("Expected defaultRetention to be sent, got: %#v", bodies[1])
+	}
+
+	if _, err := c.CreateBucket(ctx, "name", BucketTypePrivate, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := bodies[2]["fileLockEnabled"]; ok {
+		t.Fatalf("Expected fileLockEnabled to be omitted by default, got: %#v", bodies[2])
+	}
+}
+
+type testLogger struct{ lines []string }
+
+func (l *testLogger) Printf(format string, values ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, values...))
+}
+
+func TestNewClient(t *testing.T) {
+	c := NewClient()
+	if c.UserAgent != "" || c.BaseURL != "" || c.L != nil || c.TS != nil || c.C.Timeout != 0 {
+		t.Fatalf("Expected zero value defaults, got: %#v", c)
+	}
+	if tr, ok := c.C.Transport.(*http.Transport); !ok || tr.MaxIdleConnsPerHost != DefaultMaxIdleConnsPerHost {
+		t.Fatalf("Expected DefaultTransport, got: %#v", c.C.Transport)
+	}
+	if c.getUserAgent() != DefaultUserAgent() {
+		t.Fatalf("Expected default user agent, got: %#v", c.getUserAgent())
+	}
+
+	hc := &http.Client{Timeout: time.Minute}
+	l := &testLogger{}
+	ts := &TempFileStorage{Dir: "tmp"}
+	c = NewClient(
+		WithHTTPClient(hc),
+		WithLogger(l),
+		WithTempStorage(ts),
+		WithUserAgent("agent"),
+		WithBaseURL("http://localhost:1234"),
+	)
+	if c.C.Timeout != time.Minute {
+		t.Errorf("Expected http client to be applied, got: %#v", c.C)
+	}
+	if c.L != l {
+		t.Errorf("Expected logger to be applied, got: %#v", c.L)
+	}
+	if c.TS != ts {
+		t.Errorf("Expected temp storage to be applied, got: %#v", c.TS)
+	}
+	if c.UserAgent != "agent" {
+		t.Errorf("Expected user agent to be applied, got: %#v", c.UserAgent)
+	}
+	if c.BaseURL != "http://localhost:1234" {
+		t.Errorf("Expected base url to be applied, got: %#v", c.BaseURL)
+	}
+}
+
+// newConnCountingServer returns a server responding to every request with an
+// empty bucket list, and a func returning how many connections it accepted.
+func newConnCountingServer(tb testing.TB) (*httptest.Server, func() int64) {
+	var conns int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, ListBucketsResponse{})
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.Start()
+	tb.Cleanup(srv.Close)
+	return srv, func() int64 { return atomic.LoadInt64(&conns) }
+}
+
+func TestDefaultTransportReusesConnections(t *testing.T) {
+	srv, conns := newConnCountingServer(t)
+	c := NewClient()
+	c.lastAuth = mockAuth(srv.URL)
+
+	for i := 0; i < 50; i++ {
+		if _, err := c.ListBuckets(context.Background(), nil); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if n := conns(); n != 1 {
+		t.Fatalf("Expected sequential requests to reuse 1 connection, got: %d", n)
+	}
+}
+
+func BenchmarkDefaultTransportParallel(b *testing.B) {
+	srv, conns := newConnCountingServer(b)
+	c := NewClient()
+	c.lastAuth = mockAuth(srv.URL)
+
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := c.ListBuckets(context.Background(), nil); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(conns()), "conns")
+}
+
+func TestAuthorizeUsesBaseURL(t *testing.T) {
+	var keyID, path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		keyID, _, _ = r.BasicAuth()
+		writeJSON(w, 200, mockAuth("http://"+r.Host))
+	}))
+	defer srv.Close()
+
+	c := NewClient(WithBaseURL(srv.URL + "/"))
+	auth, err := c.Authorize(context.Background(), "key", "secret")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if path != "/b2api/v2/b2_authorize_account" || keyID != "key" {
+		t.Fatalf("Expected authorize request to base url, got: %#v with key %#v", path, keyID)
+	}
+	if auth.APIURL != srv.URL || c.LastAuth() == nil {
+		t.Fatalf("Expected authorization to be stored, got: %#v", auth)
+	}
+
+	rc := &RetryClient{KeyID: "retry-key", AppKey: "secret", C: Client{BaseURL: srv.URL}}
+	if _, err := rc.AuthorizeIfNeeded(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if keyID != "retry-key" {
+		t.Fatalf("Expected RetryClient to authorize against base url, got key: %#v", keyID)
+	}
+}
+
+func TestNonJSONResponseIncludesRawBody(t *testing.T) {
+	for _, status := range []int{200, 502} {
+		t.Run(fmt.Sprintf("status=%d", status), func(t *testing.T) {
+			c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(status)
+				fmt.Fprint(w, "<html><body>Bad Gateway</body></html>")
+			})
+
+			_, err := c.ListBuckets(context.Background(), &ListBucketsOptions{})
+			var decErr *ErrDecode
+			if !errors.As(err, &decErr) {
+				t.Fatalf("expected *ErrDecode, got %#v", err)
+			}
+			if decErr.Status != status {
+				t.Errorf("expected status %d, got %d", status, decErr.Status)
+			}
+			if string(decErr.RawBody) != "<html><body>Bad Gateway</body></html>" {
+				t.Errorf("unexpected raw body: %q", decErr.RawBody)
+			}
+			if !strings.Contains(err.Error(), "Bad Gateway") {
+				t.Errorf("expected error to include the body, got %q", err.Error())
+			}
+		})
+	}
+}
+
+func TestErrDecodeTruncatesBody(t *testing.T) {
+	err := &ErrDecode{Status: 200, RawBody: bytes.Repeat([]byte("x"), 1000), Err: errors.New("bad")}
+	if msg := err.Error(); len(msg) > 400 || !strings.HasSuffix(msg, "...") {
+		t.Errorf("expected truncated message, got %q", msg)
+	}
+}
+
+func TestRequestHeadersAreRedacted(t *testing.T) {
+	sse := &SSE{Mode: SSEModeC, Key: []byte("0123456789abcdef0123456789abcdef")}
+	req, err := http.NewRequest("GET", "https://example.com", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	req.Header.Set("Authorization", "secret-auth-token")
+	sse.setCustomerKeyOnRequest(req)
+
+	logged := fmt.Sprintf("request-headers: %#v", redactHeaders(req.Header))
+	for _, secret := range []string{"secret-auth-token", sse.customerKey()} {
+		if strings.Contains(logged, secret) {
+			t.Fatalf("Expected %q to be redacted, got: %s", secret, logged)
+		}
+	}
+	if !strings.Contains(logged, sse.customerKeyMd5()) {
+		t.Errorf("Expected non-secret headers to be logged, got: %s", logged)
+	}
+	if req.Header.Get("Authorization") != "secret-auth-token" {
+		t.Errorf("Expected the request's headers to be left untouched")
+	}
+}
+
+func TestTestModeHeader(t *testing.T) {
+	var modes []string
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		modes = append(modes, r.Header.Get("X-Bz-Test-Mode"))
+		writeJSON(w, 200, ListBucketsResponse{})
+	})
+
+	if _, err := c.ListBuckets(context.Background(), &ListBucketsOptions{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	c.TestMode = TestModeForceCapExceeded
+	if _, err := c.ListBuckets(context.Background(), &ListBucketsOptions{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []string{"", TestModeForceCapExceeded}
+	if fmt.Sprint(modes) != fmt.Sprint(expected) {
+		t.Fatalf("Expected test modes %#v, got: %#v", expected, modes)
+	}
+}
+
+func TestDebugLogging(t *testing.T) {
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, ListBucketsResponse{})
+	})
+	l := &testLogger{}
+	c.L = l
+
+	hasPrefix := func(prefix string) bool {
+		for _, line := range l.lines {
+			if strings.HasPrefix(line, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if _, err := c.ListBuckets(context.Background(), &ListBucketsOptions{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if hasPrefix("request-headers:") || hasPrefix("request-body:") || hasPrefix("response-body:") {
+		t.Fatalf("Expected no debug logs by default, got: %#v", l.lines)
+	}
+
+	c.DebugRequests = true
+	c.DebugResponses = true
+	if _, err := c.ListBuckets(context.Background(), &ListBucketsOptions{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, prefix := range []string{"request-headers:", "request-body:", "response-body:"} {
+		if !hasPrefix(prefix) {
+			t.Errorf("Expected a %q log line, got: %#v", prefix, l.lines)
+		}
+	}
+}
+
+func TestRequestInterceptor(t *testing.T) {
+	type traceKey struct{}
+	var received []http.Header
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Clone())
+		if r.Method == "GET" {
+			w.Write([]byte("contents"))
+			return
+		}
+		writeJSON(w, 200, ListBucketsResponse{})
+	})
+	var seenAuth []string
+	c.RequestInterceptor = func(req *http.Request) {
+		seenAuth = append(seenAuth, req.Header.Get("Authorization"))
+		if trace, ok := req.Context().Value(traceKey{}).(string); ok {
+			req.Header.Set("Traceparent", trace)
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), traceKey{}, "00-trace-span-01")
+	if _, err := c.ListBuckets(ctx, &ListBucketsOptions{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res, err := c.DownloadFileByID(ctx, "file", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res.Body.Close()
+
+	if len(received) != 2 || len(seenAuth) != 2 {
+		t.Fatalf("Expected the interceptor to see 2 requests, got %d (server got %d)", len(seenAuth), len(received))
+	}
+	for i, h := range received {
+		if seenAuth[i] != "test-token" {
+			t.Errorf("Expected interceptor to see auth header, got: %#v", seenAuth[i])
+		}
+		if h.Get("Traceparent") != "00-trace-span-01" {
+			t.Errorf("Expected trace header to be sent, got: %#v", h)
+		}
+	}
+}
+
+func TestMemoryTempStorage(t *testing.T) {
+	ts := &MemoryTempStorage{MaxBytes: 10}
+
+	rc, n, err := ts.Store(strings.NewReader("0123456789"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n != 10 {
+		t.Fatalf("Expected 10 bytes, got: %d", n)
+	}
+	data, err := ioutil.ReadAll(rc)
+	if err != nil || string(data) != "0123456789" {
+		t.Fatalf("Unexpected contents: %q, %v", data, err)
+	}
+
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if f := rc.(*memoryTempFile); f.Size() != 0 {
+		t.Fatalf("Expected Close to release the buffer, still have %d bytes", f.Size())
+	}
+
+	_, _, err = ts.Store(strings.NewReader("0123456789a"))
+	if !errors.Is(err, ErrTempStorageFull) {
+		t.Fatalf("Expected ErrTempStorageFull, got: %v", err)
+	}
+
+	unlimited := &MemoryTempStorage{}
+	if _, n, err := unlimited.Store(bytes.NewReader(make([]byte, 1024))); err != nil || n != 1024 {
+		t.Fatalf("Expected 1024 bytes without a limit, got: %d, %v", n, err)
+	}
+}
+
+func TestTempFileStorageRemovesFileOnClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "b2client-temp-storage")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ts := &TempFileStorage{Dir: dir}
+
+	rc, n, err := ts.Store(strings.NewReader("hello"))
+	if err != nil || n != 5 {
+		t.Fatalf("Unexpected result: %d, %v", n, err)
+	}
+	name := rc.(*tempFile).Name()
+	if _, err := os.Stat(name); err != nil {
+		t.Fatalf("Expected temp file to exist: %s", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("Expected temp file to be removed, got: %v", err)
+	}
+
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		writeJSON(w, 200, UploadFileResponse{})
+	})
+	c.TS = ts
+	for i := 0; i < 5; i++ {
+		_, err := c.UploadFile(context.Background(), c.LastAuth().APIURL+"/upload", "token", UploadFileOptions{
+			FileName:      "file.txt",
+			Body:          Closer(strings.NewReader("contents")),
+			ContentLength: ContentLengthDetermineUsingTempStorage,
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	_, err = c.UploadFile(context.Background(), c.LastAuth().APIURL+"/upload", "token", UploadFileOptions{
+		FileName:      "file.txt",
+		Body:          Closer(strings.NewReader("contents")),
+		ContentLength: ContentLengthDetermineUsingTempStorage,
+		ContentMd5:    "invalid",
+	})
+	if err == nil {
+		t.Fatalf("Expected invalid md5 error")
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("Expected temp files to be removed, found %d", len(files))
+	}
+}
+
+func TestUploadFileAutoDetectContentType(t *testing.T) {
+	type received struct {
+		ContentType string
+		Body        string
+	}
+	var got []received
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got = append(got, received{r.Header.Get("Content-Type"), string(body[:len(body)-40])})
+		writeJSON(w, 200, UploadFileResponse{})
+	})
+
+	png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	uploads := []UploadFileOptions{
+		{FileName: "page.html", Body: Closer(strings.NewReader("<p>hi</p>")), ContentLength: 9, AutoDetectContentType: true},
+		{FileName: "image", Body: Closer(strings.NewReader(png)), ContentLength: int64(len(png)), AutoDetectContentType: true},
+		{FileName: "seekable", Body: readerAtCloser{bytes.NewReader([]byte(png))}, ContentLength: int64(len(png)), AutoDetectContentType: true},
+		{FileName: "page.html", Body: Closer(strings.NewReader("<p>hi</p>")), ContentLength: 9},
+		{FileName: "page.html", Body: Closer(strings.NewReader("<p>hi</p>")), ContentLength: 9, ContentType: ContentTypeText, AutoDetectContentType: true},
+		{FileName: "piped", Body: pipeOf(t, png), ContentLength: int64(len(png)), AutoDetectContentType: true},
+	}
+	expected := []received{
+		{"text/html; charset=utf-8", "<p>hi</p>"},
+		{"image/png", png},
+		{"image/png", png},
+		{ContentTypeAuto, "<p>hi</p>"},
+		{ContentTypeText, "<p>hi</p>"},
+		{"image/png", png},
+	}
+	for _, opt := range uploads {
+		if _, err := c.UploadFile(context.Background(), c.LastAuth().APIURL+"/upload", "token", opt); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %#v, got: %#v", expected, got)
+	}
+}
+
+func TestListFilesMaxFileCount(t *testing.T) {
+	var got []interface{}
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, decodeBody(t, r)["maxFileCount"])
+		writeJSON(w, 200, ListFileNamesResponse{})
+	})
+	ctx := context.Background()
+
+	for _, n := range []int{0, 1000, MaxListFileCount, MaxListFileCount + 1} {
+		if _, err := c.ListFileNames(ctx, "bucket", &ListFileNamesOptions{MaxFileCount: n}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if _, err := c.ListFileVersions(ctx, "bucket", &ListFileVersionsOptions{MaxFileCount: n}); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	expected := []interface{}{nil, nil, 1000.0, 1000.0, 10000.0, 10000.0, 10000.0, 10000.0}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("Expected maxFileCounts %v, got: %v", expected, got)
+	}
+
+	got = nil
+	if _, err := c.ListFileNames(ctx, "bucket", &ListFileNamesOptions{MaxFileCount: -1}); err == nil || !strings.Contains(err.Error(), "MaxFileCount") {
+		t.Fatalf("Expected MaxFileCount error, got: %v", err)
+	}
+	if _, err := c.ListFileVersions(ctx, "bucket", &ListFileVersionsOptions{MaxFileCount: -1}); err == nil || !strings.Contains(err.Error(), "MaxFileCount") {
+		t.Fatalf("Expected MaxFileCount error, got: %v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("Expected no requests for invalid counts, got: %v", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		Value    string
+		Expected time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"0", 0},
+		{"-5", 0},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	}
+	for _, c := range cases {
+		if got := parseRetryAfter(c.Value, now); got != c.Expected {
+			t.Errorf("Expected parseRetryAfter(%q) = %s, got: %s", c.Value, c.Expected, got)
+		}
+	}
+}
+
+func TestErrorResponseRetryAfter(t *testing.T) {
+	clock := newFakeClock()
+	var retryAfter string
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", retryAfter)
+		writeJSON(w, 503, ErrorResponse{Status: 503, Code: "service_unavailable"})
+	})
+	c.Clock = clock
+
+	for value, expected := range map[string]time.Duration{
+		"3": 3 * time.Second,
+		clock.Now().Add(time.Minute).Format(http.TimeFormat): time.Minute,
+		"garbage": 0,
+	} {
+		retryAfter = value
+		_, err := c.ListBuckets(context.Background(), &ListBucketsOptions{})
+		var resErr *ErrorResponse
+		if !errors.As(err, &resErr) || resErr.RetryAfter != expected {
+			t.Errorf("Expected RetryAfter %s for %q, got: %#v", expected, value, err)
+		}
+	}
+}
+
+func TestSetAuthSharesAuthorization(t *testing.T) {
+	authorizations := 0
+	var srvURL string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/b2api/v2/b2_authorize_account":
+			authorizations++
+			auth := mockAuth(srvURL)
+			auth.AuthorizationToken = "shared-token"
+			writeJSON(w, 200, auth)
+		case "/b2api/v2/b2_list_buckets":
+			if got := r.Header.Get("Authorization"); got != "shared-token" {
+				writeJSON(w, 401, ErrorResponse{Status: 401, Code: ErrCodeBadAuthToken})
+				return
+			}
+			writeJSON(w, 200, ListBucketsResponse{})
+		}
+	}
+	issuer := mockClient(t, handler)
+	srvURL = issuer.BaseURL
+	issuer.InvalidateAuthorization()
+
+	auth, err := issuer.RequestAuthorization(context.Background(), "key-id", "app-key")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if issuer.LastAuth() != nil {
+		t.Fatalf("Expected RequestAuthorization to not store the authorization")
+	}
+
+	c := &RetryClient{}
+	c.C.BaseURL = srvURL
+	c.SetAuth(&auth)
+	auth.AuthorizationToken = "modified"
+	if _, err := c.ListBuckets(context.Background(), nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if authorizations != 1 {
+		t.Fatalf("Expected a single authorization, got: %d", authorizations)
+	}
+
+	c.SetAuth(nil)
+	if c.C.LastAuth() != nil {
+		t.Fatalf("Expected SetAuth(nil) to clear the authorization")
+	}
+}
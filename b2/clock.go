@@ -0,0 +1,71 @@
+package b2
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for authorization expiry, retries, and
+// backoff. Replace it to test timing without sleeping.
+type Clock interface {
+	Now() time.Time
+	// After waits for d to pass and then sends the current time on the
+	// returned channel, like time.After
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock used by default, backed by the time package
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// sleepContext sleeps for d or until ctx is done, whichever is first.
+func sleepContext(ctx context.Context, clock Clock, d time.Duration) error {
+	var after <-chan time.Time
+	if _, ok := clock.(systemClock); ok {
+		// stop the timer so it's freed as soon as ctx is done
+		t := time.NewTimer(d)
+		defer t.Stop()
+		after = t.C
+	} else {
+		after = clock.After(d)
+	}
+	select {
+	case <-after:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// lockedSource is a rand.Source that is safe for concurrent use
+type lockedSource struct {
+	m   sync.Mutex
+	src rand.Source
+}
+
+// NewLockedSource returns a rand.Source seeded with seed that is safe for
+// concurrent use, suitable for RetryConfig.Rand.
+func NewLockedSource(seed int64) rand.Source {
+	return &lockedSource{src: rand.NewSource(seed)}
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.src.Seed(seed)
+}
+
+// defaultSource is used by RetryConfigs without a Rand
+var defaultSource = NewLockedSource(time.Now().UnixNano())
@@ -0,0 +1,346 @@
+package b2
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DownloadFileToWriter downloads a file by id, copying its contents to w. The
+// response body is always closed. Returns the file's metadata from the
+// response headers. Authorizes as needed.
+//
+// Returns ErrNotModified without writing to w if opt has conditional headers
+// and the file hasn't changed.
+func (c *RetryClient) DownloadFileToWriter(ctx context.Context, fileId string, w io.Writer, opt *DownloadFileOptions) (File, error) {
+	res, err := c.DownloadFileByID(ctx, fileId, opt)
+	if res != nil && res.Body != nil {
+		defer res.Body.Close()
+	}
+	if errors.Is(err, ErrNotModified) {
+		f, _ := ParseDownloadHeaders(res.Header)
+		return f, err
+	}
+	if err != nil {
+		return File{}, err
+	}
+
+	f, err := ParseDownloadHeaders(res.Header)
+	if err != nil {
+		return f, err
+	}
+
+	var expectedSha1 string
+	if opt != nil && opt.VerifySha1 && opt.Range == "" {
+		expectedSha1 = f.expectedSha1()
+	}
+
+	// the sha1 is of the stored bytes, so hash before decompressing
+	var body io.Reader = res.Body
+	h := sha1.New()
+	if expectedSha1 != "" {
+		body = io.TeeReader(body, h)
+	}
+	if opt != nil && opt.Decompress && strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return f, fmt.Errorf("Error while decompressing %s: %w", fileId, err)
+		}
+		defer zr.Close()
+		body = zr
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		return f, err
+	}
+	if expectedSha1 == "" {
+		return f, nil
+	}
+	if actual := fmt.Sprintf("%x", h.Sum(nil)); actual != expectedSha1 {
+		return f, fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, expectedSha1, actual)
+	}
+	return f, nil
+}
+
+// DownloadFileToPath downloads a whole file by id to path, replacing any
+// existing file atomically. The file is downloaded to a temporary file in the
+// same directory, which is renamed to path only once its sha1 has been
+// verified, so interrupted or corrupt downloads never leave a partial file at
+// path. The temporary file is removed on error. Authorizes as needed.
+//
+// Files without a sha1, like large files uploaded without large_file_sha1,
+// can't be verified and return ErrNoChecksum unless opt.AllowUnverified is
+// set.
+//
+// The downloaded file keeps the mode of the file it replaces, or 0644.
+func (c *RetryClient) DownloadFileToPath(ctx context.Context, fileId, path string, opt *DownloadFileOptions) (File, error) {
+	var o DownloadFileOptions
+	if opt != nil {
+		o = *opt
+	}
+	if o.Range != "" {
+		return File{}, fmt.Errorf("Error while downloading %s to %s: ranges aren't supported, got %s", fileId, path, o.Range)
+	}
+	o.VerifySha1 = true
+
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return File{}, fmt.Errorf("Error while creating temp file to download to: %w", err)
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	f, err := c.DownloadFileToWriter(ctx, fileId, tmp, &o)
+	if err != nil {
+		return f, err
+	}
+	if f.expectedSha1() == "" && !o.AllowUnverified {
+		return f, fmt.Errorf("Error while downloading %s to %s: %w", fileId, path, ErrNoChecksum)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return f, fmt.Errorf("Error while downloading %s to %s: %w", fileId, path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return f, fmt.Errorf("Error while downloading %s to %s: %w", fileId, path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return f, fmt.Errorf("Error while downloading %s to %s: %w", fileId, path, err)
+	}
+	ok = true
+	return f, nil
+}
+
+// PublicDownloadURL returns the URL to download the latest version of a file
+// by name, which can be used without authorization if the bucket is public.
+// Authorizes as needed.
+func (c *RetryClient) PublicDownloadURL(ctx context.Context, bucketName, fileName string) (string, error) {
+	downloadURL, err := c.DownloadURL(ctx)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(downloadURL, "/") + downloadPath(bucketName, fileName), nil
+}
+
+// PublicDownloadURLWithToken is like PublicDownloadURL, but includes token
+// from GetDownloadAuthorization so the URL can be used to download files from
+// private buckets until the token expires. Authorizes as needed.
+func (c *RetryClient) PublicDownloadURLWithToken(ctx context.Context, bucketName, fileName, token string) (string, error) {
+	u, err := c.PublicDownloadURL(ctx, bucketName, fileName)
+	if err != nil {
+		return "", err
+	}
+	return u + "?Authorization=" + url.QueryEscape(token), nil
+}
+
+// MaxDownloadAuthorizationDuration is the longest B2 allows a download
+// authorization to be valid for
+const MaxDownloadAuthorizationDuration = 7 * 24 * time.Hour
+
+// SignedDownloadURL returns a URL to download fileName from a private bucket
+// that is valid for validFor, rounded up to the second. The same token
+// authorizes downloading any file starting with fileName, see
+// PublicDownloadURLWithToken. Returns an error if validFor isn't between 1
+// second and MaxDownloadAuthorizationDuration. Authorizes as needed.
+func (c *RetryClient) SignedDownloadURL(ctx context.Context, bucketName, fileName string, validFor time.Duration) (string, error) {
+	seconds := int((validFor + time.Second - 1) / time.Second)
+	if validFor <= 0 || validFor > MaxDownloadAuthorizationDuration {
+		return "", fmt.Errorf("Invalid download authorization duration %s: must be between 1s and %s", validFor, MaxDownloadAuthorizationDuration)
+	}
+	bucketId, err := c.ResolveBucketID(ctx, bucketName)
+	if err != nil {
+		return "", err
+	}
+	auth, err := c.GetDownloadAuthorization(ctx, GetDownloadAuthorizationOptions{
+		BucketId:               bucketId,
+		FileNamePrefix:         fileName,
+		ValidDurationInSeconds: seconds,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error while authorizing download of %s: %w", fileName, err)
+	}
+	return c.PublicDownloadURLWithToken(ctx, bucketName, fileName, auth.AuthorizationToken)
+}
+
+// DownloadFileRangesToWriterAt downloads a file by id of total bytes as
+// chunk sized ranges, concurrency at a time, writing each range to w at its
+// offset. Requests for each range are retried independently. Authorizes as
+// needed.
+//
+// Returns an error wrapping ErrRangeNotHonored if the server responds to a
+// range with anything other than that exact range.
+func (c *RetryClient) DownloadFileRangesToWriterAt(ctx context.Context, fileId string, total int64, chunk int64, concurrency int, w io.WriterAt) error {
+	if chunk <= 0 {
+		return fmt.Errorf("Invalid chunk size: %d", chunk)
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	downloadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		m        sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+		work     = make(chan int64)
+	)
+	fail := func(err error) {
+		m.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		m.Unlock()
+		cancel()
+	}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range work {
+				end := start + chunk - 1
+				if end >= total {
+					end = total - 1
+				}
+				if err := c.downloadRangeToWriterAt(downloadCtx, fileId, start, end, w); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+sendLoop:
+	for start := int64(0); start < total; start += chunk {
+		select {
+		case work <- start:
+		case <-downloadCtx.Done():
+			break sendLoop
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+// downloadRangeToWriterAt downloads bytes [start, end] of a file to w
+func (c *RetryClient) downloadRangeToWriterAt(ctx context.Context, fileId string, start, end int64, w io.WriterAt) error {
+	r := FromTo(start, end)
+	res, err := c.DownloadFileByID(ctx, fileId, &DownloadFileOptions{Range: r})
+	if res != nil && res.Body != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("Error while downloading %s: %w", r, err)
+	}
+
+	expected := fmt.Sprintf("bytes %d-%d/", start, end)
+	if res.StatusCode != http.StatusPartialContent || !strings.HasPrefix(res.Header.Get("Content-Range"), expected) {
+		return fmt.Errorf("%w: requested %s, got status %d with Content-Range %#v", ErrRangeNotHonored, r, res.StatusCode, res.Header.Get("Content-Range"))
+	}
+
+	n, err := io.Copy(&offsetWriter{w, start}, io.LimitReader(res.Body, end-start+1))
+	if err != nil {
+		return fmt.Errorf("Error while downloading %s: %w", r, err)
+	}
+	if n != end-start+1 {
+		return fmt.Errorf("Error while downloading %s: %w", r, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// offsetWriter writes sequentially to an io.WriterAt starting at offset
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
+
+// expectedSha1 returns the sha1 of the file's contents, or an empty string if
+// it isn't known. Large files don't have a ContentSha1, but may have the
+// large_file_sha1 file info set by the uploader.
+func (f *File) expectedSha1() string {
+	sum := strings.TrimPrefix(f.ContentSha1, "unverified:")
+	if sum == "none" || sum == "" {
+		sum = f.FileInfo.LargeFileSha1()
+	}
+	return strings.ToLower(sum)
+}
+
+// ParseDownloadHeaders extracts file metadata from the headers of a download
+// response. This is the same metadata GetFileInfo returns.
+func ParseDownloadHeaders(h http.Header) (File, error) {
+	f := File{
+		FileID:      h.Get("X-Bz-File-Id"),
+		ContentSha1: h.Get("X-Bz-Content-Sha1"),
+		ContentType: h.Get("Content-Type"),
+		Action:      ActionUpload,
+	}
+
+	name, err := url.QueryUnescape(h.Get("X-Bz-File-Name"))
+	if err != nil {
+		return f, fmt.Errorf("Invalid X-Bz-File-Name header: %w", err)
+	}
+	f.FileName = name
+
+	if v := h.Get("Content-Length"); v != "" {
+		f.ContentLength, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("Invalid Content-Length header: %w", err)
+		}
+	}
+
+	if v := h.Get("X-Bz-Upload-Timestamp"); v != "" {
+		f.UploadTimestampMillis, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("Invalid X-Bz-Upload-Timestamp header: %w", err)
+		}
+	}
+
+	const infoPrefix = "X-Bz-Info-"
+	for k, values := range h {
+		if len(values) == 0 || !strings.HasPrefix(http.CanonicalHeaderKey(k), infoPrefix) {
+			continue
+		}
+		if f.FileInfo == nil {
+			f.FileInfo = FileInfo{}
+		}
+		value, err := url.QueryUnescape(values[0])
+		if err != nil {
+			return f, fmt.Errorf("Invalid %s header: %w", k, err)
+		}
+		// B2 stores file info names in lowercase
+		f.FileInfo[strings.ToLower(k[len(infoPrefix):])] = value
+	}
+	return f, nil
+}
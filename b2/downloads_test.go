@@ -0,0 +1,596 @@
+package b2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadFileToWriter(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/b2api/v2/b2_download_file_by_id" || r.URL.Query().Get("fileId") != "4_z1" {
+			t.Errorf("Unexpected request: %s", r.URL)
+		}
+		w.Header().Set("Content-Type", ContentTypeText)
+		w.Header().Set("X-Bz-File-Id", "4_z1")
+		w.Header().Set("X-Bz-File-Name", "hello.txt")
+		w.Header().Set("X-Bz-Content-Sha1", "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed")
+		w.Write([]byte("hello world"))
+	})
+
+	var buf bytes.Buffer
+	f, err := c.DownloadFileToWriter(context.Background(), "4_z1", &buf, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if buf.String() != "hello world" {
+		t.Fatalf("Expected downloaded content, got: %#v", buf.String())
+	}
+	expected := File{
+		FileID:        "4_z1",
+		FileName:      "hello.txt",
+		ContentSha1:   "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed",
+		ContentType:   ContentTypeText,
+		ContentLength: 11,
+		Action:        ActionUpload,
+	}
+	if f.FileID != expected.FileID || f.FileName != expected.FileName || f.ContentSha1 != expected.ContentSha1 ||
+		f.ContentType != expected.ContentType || f.ContentLength != expected.ContentLength || f.Action != expected.Action {
+		t.Fatalf("Expected %#v, got: %#v", expected, f)
+	}
+}
+
+func TestDownloadFileToWriterError(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 400, ErrorResponse{Status: 400, Code: ErrCodeBadRequest, Message: "bad file id"})
+	})
+
+	var buf bytes.Buffer
+	_, err := c.DownloadFileToWriter(context.Background(), "bad", &buf, nil)
+	if e, ok := err.(*ErrorResponse); !ok || e.Code != ErrCodeBadRequest {
+		t.Fatalf("Expected bad request error, got: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("Expected nothing to be written, got: %#v", buf.String())
+	}
+}
+
+func TestDownloadRetryAfter(t *testing.T) {
+	requests := 0
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", "2")
+			writeJSON(w, 503, ErrorResponse{Status: 503, Code: "service_unavailable"})
+			return
+		}
+		w.Write([]byte("hello"))
+	})
+
+	res, err := c.C.DownloadFileByID(context.Background(), "id", nil)
+	var resErr *ErrorResponse
+	if !errors.As(err, &resErr) || resErr.RetryAfter != 2*time.Second {
+		t.Fatalf("Expected RetryAfter to be set on download errors, got: %#v", err)
+	}
+	res.Body.Close()
+
+	requests = 0
+	clock := newFakeClock()
+	c.RC.Clock = clock
+	var buf bytes.Buffer
+	if _, err := c.DownloadFileToWriter(context.Background(), "id", &buf, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if sleeps := clock.Sleeps(); len(sleeps) != 1 || sleeps[0] != 2*time.Second {
+		t.Fatalf("Expected retry to wait for Retry-After, got: %v", sleeps)
+	}
+}
+
+func TestParseDownloadHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Type", "image/jpeg")
+	h.Set("Content-Length", "46")
+	h.Set("X-Bz-File-Id", "4_h4a48fe8875c6214145260818_f000000000000472a_d20140104_m032022_c001_v0000123_t0104")
+	h.Set("X-Bz-File-Name", "photos/cute+kitten%2Bpuppy%20%E2%9C%93.jpg")
+	h.Set("X-Bz-Content-Sha1", "bae5ed658ab3546aee12f23f36392f35dba1ebdd")
+	h.Set("X-Bz-Upload-Timestamp", "1389243222000")
+	h.Set("X-Bz-Info-src_last_modified_millis", "1389243200000")
+	h.Set("X-Bz-Info-Author", "J%C3%BCrgen")
+
+	f, err := ParseDownloadHeaders(h)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if f.FileName != "photos/cute kitten+puppy ✓.jpg" {
+		t.Errorf("Expected file name to be decoded, got: %#v", f.FileName)
+	}
+	if f.FileID != h.Get("X-Bz-File-Id") {
+		t.Errorf("Expected FileID, got: %#v", f.FileID)
+	}
+	if f.ContentLength != 46 {
+		t.Errorf("Expected ContentLength of 46, got: %d", f.ContentLength)
+	}
+	if f.ContentSha1 != "bae5ed658ab3546aee12f23f36392f35dba1ebdd" {
+		t.Errorf("Expected ContentSha1, got: %#v", f.ContentSha1)
+	}
+	if f.ContentType != "image/jpeg" {
+		t.Errorf("Expected ContentType, got: %#v", f.ContentType)
+	}
+	if f.UploadTimestampMillis != 1389243222000 {
+		t.Errorf("Expected UploadTimestampMillis, got: %d", f.UploadTimestampMillis)
+	}
+	if len(f.FileInfo) != 2 || f.FileInfo["src_last_modified_millis"] != "1389243200000" || f.FileInfo["author"] != "Jürgen" {
+		t.Errorf("Expected FileInfo to be decoded, got: %#v", f.FileInfo)
+	}
+}
+
+func TestParseDownloadHeadersInvalid(t *testing.T) {
+	cases := map[string]string{
+		"X-Bz-File-Name":        "bad%zzname",
+		"Content-Length":        "abc",
+		"X-Bz-Upload-Timestamp": "yesterday",
+		"X-Bz-Info-key":         "%",
+	}
+	for k, v := range cases {
+		h := http.Header{}
+		h.Set(k, v)
+		if _, err := ParseDownloadHeaders(h); err == nil {
+			t.Errorf("Expected error for %s: %#v", k, v)
+		}
+	}
+}
+
+func TestDownloadFileToWriterVerifySha1(t *testing.T) {
+	const helloSha1 = "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed"
+	cases := []struct {
+		Name          string
+		Sha1          string
+		LargeFileSha1 string
+		Range         ByteRange
+		Err           error
+	}{
+		{"matching", helloSha1, "", "", nil},
+		{"unverified matching", "unverified:" + helloSha1, "", "", nil},
+		{"mismatching", "da39a3ee5e6b4b0d3255bfef95601890afd80709", "", "", ErrChecksumMismatch},
+		{"none is skipped", "none", "", "", nil},
+		{"none falls back to large_file_sha1", "none", helloSha1, "", nil},
+		{"none with mismatching large_file_sha1", "none", "da39a3ee5e6b4b0d3255bfef95601890afd80709", "", ErrChecksumMismatch},
+		{"ranges are skipped", "da39a3ee5e6b4b0d3255bfef95601890afd80709", "", "bytes=0-10", nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			clt := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Bz-Content-Sha1", c.Sha1)
+				if c.LargeFileSha1 != "" {
+					w.Header().Set("X-Bz-Info-large_file_sha1", c.LargeFileSha1)
+				}
+				w.Write([]byte("hello world"))
+			})
+
+			var buf bytes.Buffer
+			_, err := clt.DownloadFileToWriter(context.Background(), "id", &buf, &DownloadFileOptions{
+				VerifySha1: true,
+				Range:      c.Range,
+			})
+			if c.Err == nil && err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if c.Err != nil && !errors.Is(err, c.Err) {
+				t.Fatalf("Expected %v, got: %v", c.Err, err)
+			}
+		})
+	}
+}
+
+func TestDownloadFileToWriterDecompress(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("hello world"))
+	zw.Close()
+	compressedSha1 := fmt.Sprintf("%x", sha1.Sum(compressed.Bytes()))
+
+	clt := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Bz-Content-Sha1", compressedSha1)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	})
+
+	var buf bytes.Buffer
+	_, err := clt.DownloadFileToWriter(context.Background(), "id", &buf, &DownloadFileOptions{Decompress: true, VerifySha1: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if buf.String() != "hello world" {
+		t.Fatalf("Expected decompressed content, got: %q", buf.String())
+	}
+
+	buf.Reset()
+	_, err = clt.DownloadFileToWriter(context.Background(), "id", &buf, &DownloadFileOptions{VerifySha1: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !bytes.Equal(buf.Bytes(), compressed.Bytes()) {
+		t.Fatalf("Expected raw gzip content without Decompress, got: %q", buf.String())
+	}
+}
+
+func TestDownloadFileToWriterAcceptEncoding(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("hello world"))
+	zw.Close()
+	compressedSha1 := fmt.Sprintf("%x", sha1.Sum(compressed.Bytes()))
+
+	var acceptEncoding []string
+	clt := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = append(acceptEncoding, r.Header.Get("Accept-Encoding"))
+		w.Header().Set("X-Bz-Content-Sha1", compressedSha1)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	})
+
+	for _, verify := range []bool{true, false} {
+		var buf bytes.Buffer
+		_, err := clt.DownloadFileToWriter(context.Background(), "id", &buf, &DownloadFileOptions{AcceptEncoding: "identity", VerifySha1: verify})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if !bytes.Equal(buf.Bytes(), compressed.Bytes()) {
+			t.Fatalf("Expected the exact stored bytes, got: %q", buf.String())
+		}
+	}
+	if len(acceptEncoding) != 2 || acceptEncoding[0] != "identity" || acceptEncoding[1] != "identity" {
+		t.Fatalf("Expected Accept-Encoding: identity, got: %#v", acceptEncoding)
+	}
+}
+
+func TestDownloadFileToWriterProgress(t *testing.T) {
+	data := bytes.Repeat([]byte("hello world"), 10000)
+	for _, knownLength := range []bool{true, false} {
+		c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+			if knownLength {
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			}
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush() // forces chunked encoding if no length is set
+			w.Write(data[len(data)/2:])
+		})
+
+		expectedTotal := int64(len(data))
+		if !knownLength {
+			expectedTotal = -1
+		}
+		var last int64
+		_, err := c.DownloadFileToWriter(context.Background(), "id", ioutil.Discard, &DownloadFileOptions{
+			Progress: func(n, total int64) {
+				if n <= last {
+					t.Errorf("Expected progress to increase, got %d after %d", n, last)
+				}
+				if total != expectedTotal {
+					t.Errorf("Expected total %d, got: %d", expectedTotal, total)
+				}
+				last = n
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if last != int64(len(data)) {
+			t.Fatalf("Expected final progress of %d, got: %d", len(data), last)
+		}
+	}
+}
+
+func TestDownloadFileToWriterConditional(t *testing.T) {
+	lastModified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Bz-File-Id", "4_z1")
+		w.Header().Set("X-Bz-File-Name", "hello.txt")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello world"))
+	})
+
+	cases := []struct {
+		Name        string
+		Opt         DownloadFileOptions
+		NotModified bool
+	}{
+		{"unconditional", DownloadFileOptions{}, false},
+		{"etag matches", DownloadFileOptions{IfNoneMatch: `"v1"`}, true},
+		{"etag differs", DownloadFileOptions{IfNoneMatch: `"v0"`}, false},
+		{"not modified since", DownloadFileOptions{IfModifiedSince: lastModified.Add(time.Hour)}, true},
+		{"modified since", DownloadFileOptions{IfModifiedSince: lastModified.Add(-time.Hour)}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			opt := tc.Opt
+			f, err := c.DownloadFileToWriter(context.Background(), "4_z1", &buf, &opt)
+			if tc.NotModified {
+				if !errors.Is(err, ErrNotModified) {
+					t.Fatalf("Expected ErrNotModified, got: %v", err)
+				}
+				if buf.Len() != 0 {
+					t.Errorf("Expected nothing to be written, got: %q", buf.String())
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Unexpected error: %s", err)
+				}
+				if buf.String() != "hello world" {
+					t.Errorf("Unexpected contents: %q", buf.String())
+				}
+			}
+			if f.FileID != "4_z1" {
+				t.Errorf("Expected file metadata, got: %#v", f)
+			}
+		})
+	}
+}
+
+func TestDownloadFileRange(t *testing.T) {
+	data := []byte("0123456789")
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	})
+
+	cases := []struct {
+		Range    ByteRange
+		Expected string
+	}{
+		{"", "0123456789"},
+		{FromTo(2, 4), "234"},
+		{From(7), "789"},
+		{Suffix(2), "89"},
+	}
+	for _, tc := range cases {
+		res, err := c.DownloadFileByID(context.Background(), "id", &DownloadFileOptions{Range: tc.Range})
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %s", tc.Range, err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil || string(body) != tc.Expected {
+			t.Errorf("Expected %q for range %q, got: %q, %v", tc.Expected, tc.Range, body, err)
+		}
+	}
+}
+
+// memWriterAt is an in-memory io.WriterAt
+type memWriterAt struct {
+	m   sync.Mutex
+	buf []byte
+}
+
+func (w *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if end := int(off) + len(p); end > len(w.buf) {
+		w.buf = append(w.buf, make([]byte, end-len(w.buf))...)
+	}
+	return copy(w.buf[off:], p), nil
+}
+
+func TestDownloadFileRangesToWriterAt(t *testing.T) {
+	blob := make([]byte, 1000)
+	for i := range blob {
+		blob[i] = byte(i * 7)
+	}
+
+	cases := []struct {
+		Chunk       int64
+		Concurrency int
+	}{
+		{100, 4},
+		{333, 2},
+		{1000, 1},
+		{5000, 3},
+		{1, 16},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("chunk=%d concurrency=%d", tc.Chunk, tc.Concurrency), func(t *testing.T) {
+			var m sync.Mutex
+			requests := 0
+			c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+				m.Lock()
+				requests++
+				m.Unlock()
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+			})
+
+			w := &memWriterAt{}
+			err := c.DownloadFileRangesToWriterAt(context.Background(), "id", int64(len(blob)), tc.Chunk, tc.Concurrency, w)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if !bytes.Equal(w.buf, blob) {
+				t.Fatalf("Expected reassembled contents to match")
+			}
+			expectedRequests := (int64(len(blob)) + tc.Chunk - 1) / tc.Chunk
+			if int64(requests) != expectedRequests {
+				t.Errorf("Expected %d requests, got %d", expectedRequests, requests)
+			}
+		})
+	}
+}
+
+func TestDownloadFileRangesToWriterAtRequiresPartialContent(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// ignores the range
+		w.Write(bytes.Repeat([]byte("a"), 100))
+	})
+
+	err := c.DownloadFileRangesToWriterAt(context.Background(), "id", 100, 10, 2, &memWriterAt{})
+	if !errors.Is(err, ErrRangeNotHonored) {
+		t.Fatalf("Expected ErrRangeNotHonored, got: %v", err)
+	}
+
+	c = mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// responds with a different range
+		w.Header().Set("Content-Range", "bytes 0-9/100")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(bytes.Repeat([]byte("a"), 10))
+	})
+	err = c.DownloadFileRangesToWriterAt(context.Background(), "id", 100, 10, 2, &memWriterAt{})
+	if !errors.Is(err, ErrRangeNotHonored) {
+		t.Fatalf("Expected ErrRangeNotHonored, got: %v", err)
+	}
+}
+
+func TestDownloadFileToPath(t *testing.T) {
+	const helloSha1 = "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed"
+	cases := []struct {
+		Name       string
+		Sha1       string
+		Truncate   bool
+		Unverified bool
+		Err        error
+	}{
+		{"success", helloSha1, false, false, nil},
+		{"checksum mismatch", "da39a3ee5e6b4b0d3255bfef95601890afd80709", false, false, ErrChecksumMismatch},
+		{"interrupted", helloSha1, true, false, io.ErrUnexpectedEOF},
+		{"no checksum", "none", false, false, ErrNoChecksum},
+		{"no checksum allowed", "none", false, true, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			clt := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Bz-File-Id", "id")
+				w.Header().Set("X-Bz-File-Name", "hello.txt")
+				w.Header().Set("X-Bz-Content-Sha1", c.Sha1)
+				if c.Truncate {
+					w.Header().Set("Content-Length", "100")
+				}
+				w.Write([]byte("hello world"))
+			})
+
+			dir, err := ioutil.TempDir("", "b2-download")
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			path := filepath.Join(dir, "hello.txt")
+			if err := ioutil.WriteFile(path, []byte("old"), 0600); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			f, err := clt.DownloadFileToPath(context.Background(), "id", path, &DownloadFileOptions{AllowUnverified: c.Unverified})
+			if c.Err != nil && !errors.Is(err, c.Err) {
+				t.Fatalf("Expected %v, got: %v", c.Err, err)
+			}
+			expected := "old"
+			if c.Err == nil {
+				if err != nil {
+					t.Fatalf("Unexpected error: %s", err)
+				}
+				if f.FileName != "hello.txt" {
+					t.Errorf("Unexpected file: %#v", f)
+				}
+				expected = "hello world"
+			}
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil || string(data) != expected {
+				t.Errorf("Expected %q at path, got: %q, %v", expected, data, err)
+			}
+			if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+				t.Errorf("Expected file mode to be kept, got: %v, %v", fi.Mode(), err)
+			}
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil || len(entries) != 1 {
+				t.Errorf("Expected temp files to be removed, got: %v, %v", entries, err)
+			}
+		})
+	}
+}
+
+func TestPublicDownloadURL(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		auth := mockAuth("http://" + r.Host)
+		auth.DownloadURL = "https://f000.backblazeb2.com"
+		writeJSON(w, 200, auth)
+	})
+	c.InvalidateAuthorization()
+	ctx := context.Background()
+
+	cases := map[string]string{
+		"hello.txt":        "https://f000.backblazeb2.com/file/bucket/hello.txt",
+		"dir/a file+1.txt": "https://f000.backblazeb2.com/file/bucket/dir/a%20file%2B1.txt",
+		"photos/日本/猫?.jpg": "https://f000.backblazeb2.com/file/bucket/photos/%E6%97%A5%E6%9C%AC/%E7%8C%AB%3F.jpg",
+	}
+	for name, expected := range cases {
+		got, err := c.PublicDownloadURL(ctx, "bucket", name)
+		if err != nil || got != expected {
+			t.Errorf("Expected PublicDownloadURL(%q) = %s, got: %s, %v", name, expected, got, err)
+		}
+	}
+
+	got, err := c.PublicDownloadURLWithToken(ctx, "bucket", "dir/a.txt", "3_token/with+chars")
+	if expected := "https://f000.backblazeb2.com/file/bucket/dir/a.txt?Authorization=3_token%2Fwith%2Bchars"; err != nil || got != expected {
+		t.Errorf("Expected %s, got: %s, %v", expected, got, err)
+	}
+}
+
+func TestSignedDownloadURL(t *testing.T) {
+	var durations []interface{}
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body := decodeBody(t, r)
+		switch r.URL.Path {
+		case "/b2api/v2/b2_list_buckets":
+			writeJSON(w, 200, ListBucketsResponse{Buckets: []Bucket{{BucketName: "bucket", BucketID: "b1"}}})
+		case "/b2api/v2/b2_get_download_authorization":
+			if body["bucketId"] != "b1" || body["fileNamePrefix"] != "dir/a file.txt" {
+				t.Errorf("Unexpected request: %#v", body)
+			}
+			durations = append(durations, body["validDurationInSeconds"])
+			writeJSON(w, 200, GetDownloadAuthorizationResponse{BucketID: "b1", FileNamePrefix: "dir/a file.txt", AuthorizationToken: "3_token"})
+		default:
+			t.Errorf("Unexpected request: %s", r.URL.Path)
+		}
+	})
+	ctx := context.Background()
+	downloadURL := c.C.LastAuth().DownloadURL
+
+	for _, d := range []time.Duration{time.Second, 1500 * time.Millisecond, MaxDownloadAuthorizationDuration} {
+		got, err := c.SignedDownloadURL(ctx, "bucket", "dir/a file.txt", d)
+		if expected := downloadURL + "/file/bucket/dir/a%20file.txt?Authorization=3_token"; err != nil || got != expected {
+			t.Fatalf("Expected %s, got: %s, %v", expected, got, err)
+		}
+	}
+	if fmt.Sprint(durations) != "[1 2 604800]" {
+		t.Fatalf("Expected durations rounded up to seconds, got: %v", durations)
+	}
+
+	for _, d := range []time.Duration{0, -time.Second, MaxDownloadAuthorizationDuration + time.Second} {
+		if _, err := c.SignedDownloadURL(ctx, "bucket", "a.txt", d); err == nil {
+			t.Errorf("Expected error for duration %s", d)
+		}
+	}
+	if len(durations) != 3 {
+		t.Fatalf("Expected no requests for invalid durations, got: %v", durations)
+	}
+}
@@ -3,11 +3,95 @@ package b2
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"time"
 )
 
 var ErrAuthTokenMissing = errors.New("auth token is required")
 
+// ErrChecksumMismatch is returned when downloaded content doesn't match its
+// expected sha1.
+var ErrChecksumMismatch = errors.New("sha1 checksum mismatch")
+
+// ErrNoChecksum is returned by DownloadFileToPath when the file has no sha1 to
+// verify, like a large file uploaded without large_file_sha1.
+var ErrNoChecksum = errors.New("no sha1 checksum to verify")
+
+// ErrBucketNotFound is returned when looking up a bucket by name that doesn't
+// exist.
+var ErrBucketNotFound = errors.New("bucket not found")
+
+// ErrNotModified is returned by downloads using IfModifiedSince or IfNoneMatch
+// when the file hasn't changed.
+var ErrNotModified = errors.New("file not modified")
+
+// ErrRangeNotHonored is returned when a ranged download responds with a
+// different range, or the whole file.
+var ErrRangeNotHonored = errors.New("range not honored by server")
+
+// ErrTempStorageFull is returned by MemoryTempStorage when a reader has more
+// than MaxBytes of data.
+var ErrTempStorageFull = errors.New("temp storage size limit exceeded")
+
+// ErrMissingCapability is returned when the authorized key lacks a capability
+// required for an operation.
+type ErrMissingCapability struct {
+	Capability string
+}
+
+func (e *ErrMissingCapability) Error() string {
+	return fmt.Sprintf("authorized key is missing the %s capability", e.Capability)
+}
+
+// ErrTooManyFileInfo is returned before uploading a file with more file info
+// than B2 allows, either more than MaxFileInfoEntries entries or more than
+// MaxFileInfoHeaderBytes of X-Bz-Info-* headers.
+type ErrTooManyFileInfo struct {
+	Entries int // number of file info entries, including ones with special meaning
+	Bytes   int // total length of X-Bz-Info-* header names and values
+}
+
+func (e *ErrTooManyFileInfo) Error() string {
+	if e.Entries > MaxFileInfoEntries {
+		return fmt.Sprintf("too many file info entries: %d, B2 allows at most %d", e.Entries, MaxFileInfoEntries)
+	}
+	return fmt.Sprintf("file info headers are too large: %d bytes, B2 allows at most %d", e.Bytes, MaxFileInfoHeaderBytes)
+}
+
+// ErrInvalidRange is returned before sending a request with a malformed
+// ByteRange, instead of the opaque error B2 would respond with.
+type ErrInvalidRange struct {
+	Range  ByteRange
+	Reason string
+}
+
+func (e *ErrInvalidRange) Error() string {
+	return fmt.Sprintf("invalid range %#v: %s", string(e.Range), e.Reason)
+}
+
+// ErrDecode is returned when a response body isn't the JSON B2 is expected
+// to respond with, like an HTML error page from a proxy.
+type ErrDecode struct {
+	Status  int
+	RawBody []byte
+	Err     error
+}
+
+// maxDecodeErrSnippet is how much of the raw body ErrDecode's message includes
+const maxDecodeErrSnippet = 256
+
+func (e *ErrDecode) Error() string {
+	snippet := e.RawBody
+	suffix := ""
+	if len(snippet) > maxDecodeErrSnippet {
+		snippet = snippet[:maxDecodeErrSnippet]
+		suffix = "..."
+	}
+	return fmt.Sprintf("Failed to parse JSON from response (status %d): %s: %q%s", e.Status, e.Err, snippet, suffix)
+}
+
+func (e *ErrDecode) Unwrap() error { return e.Err }
+
 func IsTimeoutErr(err error) bool {
 	type timeoutErr interface {
 		error
@@ -32,12 +116,97 @@ type ErrorResponse struct {
 func (e *ErrorResponse) IsBadRequest() bool         { return e.Status == 400 }
 func (e *ErrorResponse) IsUnauthorized() bool       { return e.Status == 401 }
 func (e *ErrorResponse) IsForbidden() bool          { return e.Status == 403 }
-func (e *ErrorResponse) IsNotFound() bool           { return e.Status == 404 }
+func (e *ErrorResponse) IsNotFound() bool           { return e.Status == 404 || e.Code == ErrCodeNotFound }
 func (e *ErrorResponse) IsRequestTimeout() bool     { return e.Status == 408 }
 func (e *ErrorResponse) IsTooManyRequests() bool    { return e.Status == 429 }
 func (e *ErrorResponse) IsInternalError() bool      { return e.Status == 500 }
 func (e *ErrorResponse) IsServiceUnavailable() bool { return e.Status == 503 }
 
+func (e *ErrorResponse) IsDownloadCapExceeded() bool { return e.Code == ErrCodeDownloadCapExceeded }
+
+// IsAccessDenied returns true if the key isn't allowed to perform the
+// request, like deleting a file version that's under retention. Retrying with
+// the same key won't help.
+func (e *ErrorResponse) IsAccessDenied() bool { return e.Code == ErrCodeAccessDenied }
+
+// IsCapExceeded returns true if any of the account's storage, download, or
+// transaction caps have been exceeded. This isn't transient, requests will
+// keep failing until the cap is raised or reset.
+func (e *ErrorResponse) IsCapExceeded() bool {
+	switch e.Code {
+	case ErrCodeDownloadCapExceeded, ErrCodeStorageCapExceeded, ErrCodeTransactionCapExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsNotFound returns true if err is or wraps an ErrorResponse indicating that
+// the requested file, bucket, or key doesn't exist.
+func IsNotFound(err error) bool {
+	var e *ErrorResponse
+	return errors.As(err, &e) && e.IsNotFound()
+}
+
+// IsCapExceeded returns true if err is or wraps an ErrorResponse indicating
+// that an account cap has been exceeded.
+func IsCapExceeded(err error) bool {
+	var e *ErrorResponse
+	return errors.As(err, &e) && e.IsCapExceeded()
+}
+
+// errorResponseForStatus builds an ErrorResponse for responses that don't
+// include an error body, like HEAD requests.
+func errorResponseForStatus(status int) *ErrorResponse {
+	e := &ErrorResponse{Status: status, Message: http.StatusText(status)}
+	switch status {
+	case 400:
+		e.Code = ErrCodeBadRequest
+	case 401:
+		e.Code = ErrCodeUnauthorized
+	case 404:
+		e.Code = ErrCodeNotFound
+	case 416:
+		e.Code = ErrCodeRangeNotSatisfiable
+	}
+	return e
+}
+
+// Sentinel errors for B2's error codes, for use with errors.Is:
+//
+//	if errors.Is(err, b2.ErrExpiredAuthToken) { ... }
+var (
+	ErrBadRequest             = errors.New(ErrCodeBadRequest)
+	ErrUnauthorized           = errors.New(ErrCodeUnauthorized)
+	ErrAccessDenied           = errors.New(ErrCodeAccessDenied)
+	ErrBadAuthToken           = errors.New(ErrCodeBadAuthToken)
+	ErrExpiredAuthToken       = errors.New(ErrCodeExpiredAuthToken)
+	ErrDownloadCapExceeded    = errors.New(ErrCodeDownloadCapExceeded)
+	ErrStorageCapExceeded     = errors.New(ErrCodeStorageCapExceeded)
+	ErrTransactionCapExceeded = errors.New(ErrCodeTransactionCapExceeded)
+	ErrNotFound               = errors.New(ErrCodeNotFound)
+	ErrRangeNotSatisfiable    = errors.New(ErrCodeRangeNotSatisfiable)
+)
+
+var errCodeSentinels = map[string]error{
+	ErrCodeBadRequest:             ErrBadRequest,
+	ErrCodeUnauthorized:           ErrUnauthorized,
+	ErrCodeAccessDenied:           ErrAccessDenied,
+	ErrCodeBadAuthToken:           ErrBadAuthToken,
+	ErrCodeExpiredAuthToken:       ErrExpiredAuthToken,
+	ErrCodeDownloadCapExceeded:    ErrDownloadCapExceeded,
+	ErrCodeStorageCapExceeded:     ErrStorageCapExceeded,
+	ErrCodeTransactionCapExceeded: ErrTransactionCapExceeded,
+	ErrCodeNotFound:               ErrNotFound,
+	ErrCodeRangeNotSatisfiable:    ErrRangeNotSatisfiable,
+}
+
+// Is reports whether target is the sentinel error for this response's code.
+func (e *ErrorResponse) Is(target error) bool {
+	sentinel, ok := errCodeSentinels[e.Code]
+	return ok && target == sentinel
+}
+
 func (e *ErrorResponse) Timeout() bool {
 	return e.IsRequestTimeout() || e.IsTooManyRequests()
 }
@@ -47,11 +216,14 @@ func (e *ErrorResponse) Error() string {
 }
 
 const (
-	ErrCodeBadRequest          = "bad_request"
-	ErrCodeUnauthorized        = "unauthorized"
-	ErrCodeBadAuthToken        = "bad_auth_token"
-	ErrCodeExpiredAuthToken    = "expired_auth_token"
-	ErrCodeDownloadCapExceeded = "download_cap_exceeded"
-	ErrCodeNotFound            = "not_found"
-	ErrCodeRangeNotSatisfiable = "range_not_satisfiable"
+	ErrCodeBadRequest             = "bad_request"
+	ErrCodeUnauthorized           = "unauthorized"
+	ErrCodeAccessDenied           = "access_denied"
+	ErrCodeBadAuthToken           = "bad_auth_token"
+	ErrCodeExpiredAuthToken       = "expired_auth_token"
+	ErrCodeDownloadCapExceeded    = "download_cap_exceeded"
+	ErrCodeStorageCapExceeded     = "storage_cap_exceeded"
+	ErrCodeTransactionCapExceeded = "transaction_cap_exceeded"
+	ErrCodeNotFound               = "not_found"
+	ErrCodeRangeNotSatisfiable    = "range_not_satisfiable"
 )
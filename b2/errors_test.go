@@ -0,0 +1,76 @@
+package b2
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestIsCapExceeded(t *testing.T) {
+	cases := []struct {
+		Err      error
+		Expected bool
+	}{
+		{&ErrorResponse{Status: 403, Code: ErrCodeDownloadCapExceeded}, true},
+		{&ErrorResponse{Status: 403, Code: ErrCodeStorageCapExceeded}, true},
+		{&ErrorResponse{Status: 403, Code: ErrCodeTransactionCapExceeded}, true},
+		{fmt.Errorf("wrapped: %w", &ErrorResponse{Status: 403, Code: ErrCodeDownloadCapExceeded}), true},
+		{&ErrorResponse{Status: 403, Code: "access_denied"}, false},
+		{fmt.Errorf("other"), false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if got := IsCapExceeded(c.Err); got != c.Expected {
+			t.Errorf("Expected IsCapExceeded(%v) = %v, got: %v", c.Err, c.Expected, got)
+		}
+	}
+
+	if !(&ErrorResponse{Code: ErrCodeDownloadCapExceeded}).IsDownloadCapExceeded() {
+		t.Errorf("Expected IsDownloadCapExceeded to be true")
+	}
+	if (&ErrorResponse{Code: ErrCodeStorageCapExceeded}).IsDownloadCapExceeded() {
+		t.Errorf("Expected IsDownloadCapExceeded to be false for storage caps")
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	cases := []struct {
+		Err      error
+		Expected bool
+	}{
+		{&ErrorResponse{Status: 404, Code: ErrCodeNotFound}, true},
+		{&ErrorResponse{Status: 404}, true},
+		{&ErrorResponse{Status: 400, Code: ErrCodeNotFound}, true},
+		{fmt.Errorf("Error while downloading: %w", &ErrorResponse{Status: 404, Code: ErrCodeNotFound}), true},
+		{fmt.Errorf("outer: %w", fmt.Errorf("inner: %w", &ErrorResponse{Status: 404})), true},
+		{&ErrorResponse{Status: 400, Code: ErrCodeBadRequest}, false},
+		{fmt.Errorf("not found"), false},
+		{nil, false},
+	}
+	for _, c := range cases {
+		if got := IsNotFound(c.Err); got != c.Expected {
+			t.Errorf("Expected IsNotFound(%v) = %v, got: %v", c.Err, c.Expected, got)
+		}
+	}
+}
+
+func TestErrorResponseIsSentinel(t *testing.T) {
+	for code, sentinel := range errCodeSentinels {
+		err := fmt.Errorf("wrapped: %w", &ErrorResponse{Status: 400, Code: code})
+		if !errors.Is(err, sentinel) {
+			t.Errorf("Expected errors.Is(%v, %v) to be true", err, sentinel)
+		}
+		for otherCode, other := range errCodeSentinels {
+			if otherCode != code && errors.Is(err, other) {
+				t.Errorf("Expected errors.Is(%v, %v) to be false", err, other)
+			}
+		}
+	}
+
+	if errors.Is(&ErrorResponse{Status: 400, Code: "unknown_code"}, ErrBadRequest) {
+		t.Errorf("Expected unknown codes to not match any sentinel")
+	}
+	if !errors.Is(&ErrorResponse{Status: 401, Code: ErrCodeExpiredAuthToken}, ErrExpiredAuthToken) {
+		t.Errorf("Expected expired auth token response to match ErrExpiredAuthToken")
+	}
+}
@@ -0,0 +1,214 @@
+package b2
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxFileInfoEntries is the most file info entries B2 allows on a file,
+	// including the ones with special meaning
+	MaxFileInfoEntries = 10
+	// MaxFileInfoHeaderBytes is the most bytes of X-Bz-Info-* header names
+	// and values B2 allows on an upload
+	MaxFileInfoHeaderBytes = 7000
+)
+
+// fileInfoHeaderPrefix is prepended to file info names when uploading
+const fileInfoHeaderPrefix = "X-Bz-Info-"
+
+// File info keys that B2 gives special meaning to
+// see https://www.backblaze.com/docs/cloud-storage-files
+const (
+	FileInfoSrcLastModifiedMillis = "src_last_modified_millis"
+	FileInfoLargeFileSha1         = "large_file_sha1"
+	FileInfoContentDisposition    = "b2-content-disposition"
+	FileInfoContentLanguage       = "b2-content-language"
+	FileInfoExpires               = "b2-expires"
+	FileInfoCacheControl          = "b2-cache-control"
+	FileInfoContentEncoding       = "b2-content-encoding"
+	FileInfoContentType           = "b2-content-type"
+)
+
+// SrcLastModified returns the src_last_modified_millis value, or false if it
+// isn't set or isn't a valid timestamp.
+func (fi FileInfo) SrcLastModified() (time.Time, bool) {
+	v, ok := fi[FileInfoSrcLastModifiedMillis].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	millis, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return millisToTime(millis), true
+}
+
+// SetSrcLastModified sets src_last_modified_millis to t, truncated to
+// milliseconds. Removes it if t is zero.
+func (fi *FileInfo) SetSrcLastModified(t time.Time) {
+	if t.IsZero() {
+		fi.set(FileInfoSrcLastModifiedMillis, "")
+		return
+	}
+	fi.set(FileInfoSrcLastModifiedMillis, strconv.FormatInt(timeToMillis(t), 10))
+}
+
+// LargeFileSha1 returns the sha1 of a large file's entire contents, if the
+// uploader recorded it
+func (fi FileInfo) LargeFileSha1() string { return fi.str(FileInfoLargeFileSha1) }
+
+// SetLargeFileSha1 records the sha1 of a large file's entire contents, which
+// B2 can't compute itself
+func (fi *FileInfo) SetLargeFileSha1(sha1 string) { fi.set(FileInfoLargeFileSha1, sha1) }
+
+// ContentDisposition returns the Content-Disposition header B2 serves downloads with
+func (fi FileInfo) ContentDisposition() string { return fi.str(FileInfoContentDisposition) }
+
+// SetContentDisposition sets the Content-Disposition header B2 serves downloads with
+func (fi *FileInfo) SetContentDisposition(v string) { fi.set(FileInfoContentDisposition, v) }
+
+// ContentLanguage returns the Content-Language header B2 serves downloads with
+func (fi FileInfo) ContentLanguage() string { return fi.str(FileInfoContentLanguage) }
+
+// SetContentLanguage sets the Content-Language header B2 serves downloads with
+func (fi *FileInfo) SetContentLanguage(v string) { fi.set(FileInfoContentLanguage, v) }
+
+// Expires returns the Expires header B2 serves downloads with
+func (fi FileInfo) Expires() string { return fi.str(FileInfoExpires) }
+
+// SetExpires sets the Expires header B2 serves downloads with
+func (fi *FileInfo) SetExpires(v string) { fi.set(FileInfoExpires, v) }
+
+// CacheControl returns the Cache-Control header B2 serves downloads with
+func (fi FileInfo) CacheControl() string { return fi.str(FileInfoCacheControl) }
+
+// SetCacheControl sets the Cache-Control header B2 serves downloads with
+func (fi *FileInfo) SetCacheControl(v string) { fi.set(FileInfoCacheControl, v) }
+
+// ContentEncoding returns the Content-Encoding header B2 serves downloads with
+func (fi FileInfo) ContentEncoding() string { return fi.str(FileInfoContentEncoding) }
+
+// SetContentEncoding sets the Content-Encoding header B2 serves downloads with
+func (fi *FileInfo) SetContentEncoding(v string) { fi.set(FileInfoContentEncoding, v) }
+
+// ContentType returns the Content-Type header B2 serves downloads with,
+// overriding the file's content type
+func (fi FileInfo) ContentType() string { return fi.str(FileInfoContentType) }
+
+// SetContentType sets the Content-Type header B2 serves downloads with,
+// overriding the file's content type
+func (fi *FileInfo) SetContentType(v string) { fi.set(FileInfoContentType, v) }
+
+func (fi FileInfo) str(key string) string {
+	v, _ := fi[key].(string)
+	return v
+}
+
+// set stores v under key, allocating the map if needed. An empty v removes
+// the key instead.
+func (fi *FileInfo) set(key, v string) {
+	if v == "" {
+		delete(*fi, key)
+		return
+	}
+	if *fi == nil {
+		*fi = FileInfo{}
+	}
+	(*fi)[key] = v
+}
+
+// fileInfoName converts name to one B2 accepts in an X-Bz-Info-* header by
+// replacing anything other than letters, numbers, '-' and '_' with '_'.
+// Returns an empty string if name has nothing B2 accepts.
+func fileInfoName(name string) string {
+	valid := false
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_':
+			valid = true
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	if !valid {
+		return ""
+	}
+	return sanitized
+}
+
+// infoKeyName returns the fileInfoName of an UploadFileOptions.Info key, or an
+// error if B2 wouldn't accept any of it.
+func infoKeyName(key string) (string, error) {
+	name := fileInfoName(key)
+	if name == "" {
+		return "", fmt.Errorf("Invalid Info key %#v: must contain a letter, number, '-' or '_'", key)
+	}
+	return name, nil
+}
+
+// sanitizeInfo returns UploadFileOptions.Info with its keys converted by
+// infoKeyName, or an error if two keys convert to the same name.
+func sanitizeInfo(info map[string]string) (map[string]string, error) {
+	sanitized := make(map[string]string, len(info))
+	keys := make(map[string]string, len(info))
+	for k, v := range info {
+		name, err := infoKeyName(k)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := keys[name]; ok {
+			if other > k {
+				other, k = k, other
+			}
+			return nil, fmt.Errorf("Invalid Info keys %#v and %#v: both are sent as %#v", other, k, name)
+		}
+		keys[name] = k
+		sanitized[name] = v
+	}
+	return sanitized, nil
+}
+
+// encodeFileInfoValue percent-encodes v for an X-Bz-Info-* header. B2 decodes
+// "+" as a space, so it is always encoded.
+func encodeFileInfoValue(v string) string {
+	return strings.ReplaceAll(url.PathEscape(v), "+", "%2B")
+}
+
+// checkFileInfo returns an ErrTooManyFileInfo if info would exceed B2's
+// limits when sent as X-Bz-Info-* headers, like checkFileInfoHeaders
+func checkFileInfo(info FileInfo) error {
+	size := 0
+	for k, v := range info {
+		size += len(fileInfoHeaderPrefix) + len(k) + len(encodeFileInfoValue(fmt.Sprint(v)))
+	}
+	if len(info) > MaxFileInfoEntries || size > MaxFileInfoHeaderBytes {
+		return &ErrTooManyFileInfo{Entries: len(info), Bytes: size}
+	}
+	return nil
+}
+
+// checkFileInfoHeaders returns an ErrTooManyFileInfo if the X-Bz-Info-*
+// headers in h exceed B2's limits
+func checkFileInfoHeaders(h http.Header) error {
+	entries, size := 0, 0
+	for k, values := range h {
+		if !strings.HasPrefix(strings.ToLower(k), "x-bz-info-") {
+			continue
+		}
+		entries++
+		size += len(k)
+		for _, v := range values {
+			size += len(v)
+		}
+	}
+	if entries > MaxFileInfoEntries || size > MaxFileInfoHeaderBytes {
+		return &ErrTooManyFileInfo{Entries: entries, Bytes: size}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package b2
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestFileInfoHelpersRoundTripJSON(t *testing.T) {
+	modified := time.Date(2014, 1, 9, 4, 53, 42, 123456789, time.UTC)
+
+	var info FileInfo
+	info.SetSrcLastModified(modified)
+	info.SetLargeFileSha1("2aae6c35c94fcfb415dbe95f408b9ce91ee846ed")
+	info.SetContentDisposition(`attachment; filename="a.txt"`)
+	info.SetContentLanguage("en")
+	info.SetExpires("Thu, 01 Dec 2044 16:00:00 GMT")
+	info.SetCacheControl("max-age=60")
+	info.SetContentEncoding("gzip")
+	info.SetContentType("text/plain")
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if raw["src_last_modified_millis"] != "1389243222123" || raw["b2-cache-control"] != "max-age=60" {
+		t.Fatalf("Unexpected JSON: %s", data)
+	}
+
+	var decoded FileInfo
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got, ok := decoded.SrcLastModified(); !ok || !got.Equal(modified.Truncate(time.Millisecond)) {
+		t.Errorf("Unexpected SrcLastModified: %s, %v", got, ok)
+	}
+	cases := []struct {
+		Name     string
+		Got      string
+		Expected string
+	}{
+		{"LargeFileSha1", decoded.LargeFileSha1(), "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed"},
+		{"ContentDisposition", decoded.ContentDisposition(), `attachment; filename="a.txt"`},
+		{"ContentLanguage", decoded.ContentLanguage(), "en"},
+		{"Expires", decoded.Expires(), "Thu, 01 Dec 2044 16:00:00 GMT"},
+		{"CacheControl", decoded.CacheControl(), "max-age=60"},
+		{"ContentEncoding", decoded.ContentEncoding(), "gzip"},
+		{"ContentType", decoded.ContentType(), "text/plain"},
+	}
+	for _, c := range cases {
+		if c.Got != c.Expected {
+			t.Errorf("Expected %s to be %q, got: %q", c.Name, c.Expected, c.Got)
+		}
+	}
+}
+
+func TestFileInfoSettersRemoveEmptyValues(t *testing.T) {
+	info := FileInfo{"b2-cache-control": "max-age=60", "src_last_modified_millis": "1"}
+	info.SetCacheControl("")
+	info.SetSrcLastModified(time.Time{})
+	if len(info) != 0 {
+		t.Fatalf("Expected keys to be removed, got: %#v", info)
+	}
+	if _, ok := info.SrcLastModified(); ok {
+		t.Fatalf("Expected no SrcLastModified")
+	}
+}
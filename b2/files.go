@@ -0,0 +1,259 @@
+package b2
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// GetFileInfoByName returns metadata about the latest version of a file,
+// using HeadFileByName. Returns an *ErrorResponse
+// where IsNotFound() is true if the file does not exist. Authorizes as
+// needed.
+//
+// HEAD responses don't include a bucket id, so BucketID and AccountID are not
+// set.
+func (c *RetryClient) GetFileInfoByName(ctx context.Context, bucketName, fileName string) (GetFileInfoResponse, error) {
+	res, err := c.HeadFileByName(ctx, bucketName, fileName)
+	return GetFileInfoResponse(res), err
+}
+
+// FileExists returns true if the latest version of a file exists and isn't
+// hidden, using HeadFileByName. Returns an error for failures other than the
+// file not being found. Authorizes as needed.
+func (c *RetryClient) FileExists(ctx context.Context, bucketName, fileName string) (bool, error) {
+	_, err := c.HeadFileByName(ctx, bucketName, fileName)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetFileVersionByName returns metadata about a version of a file by listing
+// the file versions in the bucket. If fileId is empty, the latest version is
+// returned, which may be a hide marker. Returns an *ErrorResponse where
+// IsNotFound() is true if no matching version exists. Authorizes as needed.
+func (c *RetryClient) GetFileVersionByName(ctx context.Context, bucketId, fileName, fileId string) (GetFileInfoResponse, error) {
+	var found *File
+	errFound := errors.New("found")
+	err := c.ListAllFileVersions(ctx, bucketId, &ListFileVersionsOptions{
+		StartFileName: fileName,
+		Prefix:        fileName,
+	}, func(f File) error {
+		if f.FileName != fileName {
+			// versions are sorted by name, so there are no more matches
+			return errFound
+		}
+		if fileId == "" || f.FileID == fileId {
+			found = &f
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && err != errFound {
+		return GetFileInfoResponse{}, err
+	}
+	if found == nil {
+		return GetFileInfoResponse{}, &ErrorResponse{Status: 404, Code: ErrCodeNotFound, Message: fmt.Sprintf("File not present: %s", fileName)}
+	}
+	return GetFileInfoResponse(*found), nil
+}
+
+// DeleteAllFileVersions deletes every version of a file, including hide
+// markers, returning the number of versions deleted. Unfinished large files
+// with the same name are cancelled and counted too. Deleting stops at the
+// first error, returning the count so far. Authorizes as needed.
+func (c *RetryClient) DeleteAllFileVersions(ctx context.Context, bucketId, fileName string) (int, error) {
+	var versions []File
+	errDone := errors.New("done")
+	err := c.ListAllFileVersions(ctx, bucketId, &ListFileVersionsOptions{
+		StartFileName: fileName,
+		Prefix:        fileName,
+	}, func(f File) error {
+		if f.FileName != fileName {
+			// versions are sorted by name, so there are no more matches
+			return errDone
+		}
+		versions = append(versions, f)
+		return nil
+	})
+	if err != nil && err != errDone {
+		return 0, err
+	}
+
+	for i, f := range versions {
+		if err := c.deleteVersion(ctx, f); err != nil {
+			return i, err
+		}
+	}
+	return len(versions), nil
+}
+
+// deleteVersion deletes a file version, cancelling it if it is an unfinished
+// large file.
+func (c *RetryClient) deleteVersion(ctx context.Context, f File) error {
+	var err error
+	if f.Action == ActionStart {
+		_, err = c.CancelLargeFile(ctx, f.FileID)
+	} else {
+		_, err = c.DeleteFileVersion(ctx, f.FileID, f.FileName)
+	}
+	if err != nil {
+		return fmt.Errorf("Error while deleting %s (%s): %w", f.FileName, f.FileID, err)
+	}
+	return nil
+}
+
+// UploadFileFromPath uploads the file at localPath. opt.Body and
+// opt.ContentLength are set from the file, opt.FileName defaults to the base
+// name of localPath, and opt.SrcLastModified defaults to the file's
+// modification time. Files larger than the account's RecommendedPartSize are
+// uploaded as large files with UploadLargeFile. Authorizes as needed.
+func (c *RetryClient) UploadFileFromPath(ctx context.Context, bucketId, localPath string, opt UploadFileOptions) (UploadFileResponse, error) {
+	auth, err := c.AuthorizeIfNeeded(ctx)
+	if err != nil {
+		return UploadFileResponse{}, err
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return UploadFileResponse{}, fmt.Errorf("Error while opening file to upload: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return UploadFileResponse{}, fmt.Errorf("Error while opening file to upload: %w", err)
+	}
+
+	opt.Body = f
+	opt.ContentLength = fi.Size()
+	if opt.FileName == "" {
+		opt.FileName = filepath.Base(localPath)
+	}
+	if opt.SrcLastModified == nil {
+		modTime := fi.ModTime()
+		opt.SrcLastModified = &modTime
+	}
+
+	if fi.Size() > int64(auth.RecommendedPartSize) {
+		res, err := c.UploadLargeFile(ctx, bucketId, opt, 0)
+		return UploadFileResponse(res), err
+	}
+	return c.UploadFile(ctx, bucketId, opt)
+}
+
+// WithFileInfoCache caches up to size GetFileInfo responses for ttl, evicting
+// the least recently used. Uploading or deleting a file through c invalidates
+// its cached versions, but changes made by other clients aren't seen until
+// ttl passes. Must be called before c is used. Returns c.
+func (c *RetryClient) WithFileInfoCache(size int, ttl time.Duration) *RetryClient {
+	c.fileInfos = &fileInfoCache{size: size, ttl: ttl, ids: make(map[string]*list.Element), lru: list.New()}
+	return c
+}
+
+// fileInfoCache is an LRU cache of GetFileInfo responses by file id. A nil
+// *fileInfoCache caches nothing.
+type fileInfoCache struct {
+	m    sync.Mutex
+	size int
+	ttl  time.Duration
+	ids  map[string]*list.Element
+	lru  *list.List // of *fileInfoEntry, most recently used first
+}
+
+type fileInfoEntry struct {
+	info    GetFileInfoResponse
+	expires time.Time
+}
+
+func (fc *fileInfoCache) get(fileId string, now time.Time) (GetFileInfoResponse, bool) {
+	if fc == nil {
+		return GetFileInfoResponse{}, false
+	}
+	fc.m.Lock()
+	defer fc.m.Unlock()
+	el, ok := fc.ids[fileId]
+	if !ok {
+		return GetFileInfoResponse{}, false
+	}
+	e := el.Value.(*fileInfoEntry)
+	if !now.Before(e.expires) {
+		fc.removeElement(el)
+		return GetFileInfoResponse{}, false
+	}
+	fc.lru.MoveToFront(el)
+	return copyFileInfoResponse(e.info), true
+}
+
+func (fc *fileInfoCache) put(info GetFileInfoResponse, now time.Time) {
+	if fc == nil || fc.size <= 0 {
+		return
+	}
+	fc.m.Lock()
+	defer fc.m.Unlock()
+	e := &fileInfoEntry{copyFileInfoResponse(info), now.Add(fc.ttl)}
+	if el, ok := fc.ids[info.FileID]; ok {
+		el.Value = e
+		fc.lru.MoveToFront(el)
+		return
+	}
+	fc.ids[info.FileID] = fc.lru.PushFront(e)
+	for fc.lru.Len() > fc.size {
+		fc.removeElement(fc.lru.Back())
+	}
+}
+
+func (fc *fileInfoCache) removeID(fileId string) {
+	if fc == nil {
+		return
+	}
+	fc.m.Lock()
+	defer fc.m.Unlock()
+	if el, ok := fc.ids[fileId]; ok {
+		fc.removeElement(el)
+	}
+}
+
+// removeName removes every cached version of a file. An empty bucketId
+// removes versions of fileName in any bucket.
+func (fc *fileInfoCache) removeName(bucketId, fileName string) {
+	if fc == nil {
+		return
+	}
+	fc.m.Lock()
+	defer fc.m.Unlock()
+	for el := fc.lru.Front(); el != nil; {
+		next := el.Next()
+		info := el.Value.(*fileInfoEntry).info
+		if (bucketId == "" || info.BucketID == bucketId) && info.FileName == fileName {
+			fc.removeElement(el)
+		}
+		el = next
+	}
+}
+
+func (fc *fileInfoCache) removeElement(el *list.Element) {
+	fc.lru.Remove(el)
+	delete(fc.ids, el.Value.(*fileInfoEntry).info.FileID)
+}
+
+// copyFileInfoResponse copies info's FileInfo so that callers can't modify
+// the cached map
+func copyFileInfoResponse(info GetFileInfoResponse) GetFileInfoResponse {
+	if info.FileInfo != nil {
+		fi := make(FileInfo, len(info.FileInfo))
+		for k, v := range info.FileInfo {
+			fi[k] = v
+		}
+		info.FileInfo = fi
+	}
+	return info
+}
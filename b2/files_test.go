@@ -0,0 +1,317 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetFileInfoByName(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("Expected HEAD request, got: %s", r.Method)
+		}
+		switch r.URL.EscapedPath() {
+		case "/file/bucket/dir/a%20file.txt":
+			w.Header().Set("Content-Type", ContentTypeText)
+			w.Header().Set("Content-Length", "11")
+			w.Header().Set("X-Bz-File-Id", "4_z1")
+			w.Header().Set("X-Bz-File-Name", "dir/a%20file.txt")
+			w.Header().Set("X-Bz-Content-Sha1", "2aae6c35c94fcfb415dbe95f408b9ce91ee846ed")
+			w.Header().Set("X-Bz-Upload-Timestamp", "1389243222000")
+		default:
+			w.WriteHeader(404)
+		}
+	})
+
+	ctx := context.Background()
+	f, err := c.GetFileInfoByName(ctx, "bucket", "dir/a file.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if f.FileID != "4_z1" || f.FileName != "dir/a file.txt" || f.ContentLength != 11 || f.UploadTimestampMillis != 1389243222000 {
+		t.Fatalf("Expected file info to be parsed from headers, got: %#v", f)
+	}
+
+	_, err = c.GetFileInfoByName(ctx, "bucket", "missing.txt")
+	if e, ok := err.(*ErrorResponse); !ok || !e.IsNotFound() || e.Code != ErrCodeNotFound {
+		t.Fatalf("Expected not found error, got: %#v", err)
+	}
+}
+
+func TestGetFileVersionByName(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body := decodeBody(t, r)
+		if body["startFileName"] != "a.txt" || body["prefix"] != "a.txt" {
+			t.Errorf("Expected listing to start at the file name, got: %#v", body)
+		}
+		writeJSON(w, 200, ListFileVersionsResponse{Files: []File{
+			{FileName: "a.txt", FileID: "a3", Action: ActionHide},
+			{FileName: "a.txt", FileID: "a2", Action: ActionUpload},
+			{FileName: "a.txt.bak", FileID: "b1", Action: ActionUpload},
+		}})
+	})
+
+	ctx := context.Background()
+	f, err := c.GetFileVersionByName(ctx, "bucket", "a.txt", "")
+	if err != nil || f.FileID != "a3" {
+		t.Fatalf("Expected latest version, got: %#v, %v", f, err)
+	}
+
+	f, err = c.GetFileVersionByName(ctx, "bucket", "a.txt", "a2")
+	if err != nil || f.FileID != "a2" {
+		t.Fatalf("Expected requested version, got: %#v, %v", f, err)
+	}
+
+	_, err = c.GetFileVersionByName(ctx, "bucket", "a.txt", "b1")
+	if e, ok := err.(*ErrorResponse); !ok || !e.IsNotFound() {
+		t.Fatalf("Expected not found error, got: %#v", err)
+	}
+}
+
+func TestDeleteAllFileVersions(t *testing.T) {
+	var deleted, cancelled []string
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body := decodeBody(t, r)
+		switch r.URL.Path {
+		case "/b2api/v2/b2_list_file_versions":
+			if body["startFileId"] == nil {
+				writeJSON(w, 200, ListFileVersionsResponse{
+					Files: []File{
+						{FileName: "a.txt", FileID: "a4", Action: ActionHide},
+						{FileName: "a.txt", FileID: "a3", Action: ActionUpload},
+					},
+					NextFileName: "a.txt",
+					NextFileID:   "a2",
+				})
+				return
+			}
+			writeJSON(w, 200, ListFileVersionsResponse{Files: []File{
+				{FileName: "a.txt", FileID: "a2", Action: ActionUpload},
+				{FileName: "a.txt", FileID: "a1", Action: ActionStart},
+				{FileName: "a.txt.bak", FileID: "b1", Action: ActionUpload},
+			}})
+		case "/b2api/v2/b2_delete_file_version":
+			if body["fileName"] != "a.txt" {
+				t.Errorf("Expected file name to be sent, got: %#v", body)
+			}
+			deleted = append(deleted, body["fileId"].(string))
+			writeJSON(w, 200, DeleteFileResponse{})
+		case "/b2api/v2/b2_cancel_large_file":
+			cancelled = append(cancelled, body["fileId"].(string))
+			writeJSON(w, 200, CancelLargeFileResponse{})
+		default:
+			t.Errorf("Unexpected request: %s", r.URL.Path)
+		}
+	})
+
+	n, err := c.DeleteAllFileVersions(context.Background(), "bucket", "a.txt")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n != 4 {
+		t.Fatalf("Expected 4 versions to be deleted, got: %d", n)
+	}
+	if fmt.Sprint(deleted) != "[a4 a3 a2]" || fmt.Sprint(cancelled) != "[a1]" {
+		t.Fatalf("Expected versions and hide marker to be deleted and large file cancelled, got: %v, %v", deleted, cancelled)
+	}
+}
+
+func TestFileExists(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("Expected HEAD request, got: %s", r.Method)
+		}
+		switch r.URL.Path {
+		case "/file/bucket/present.txt":
+			w.Header().Set("X-Bz-File-Id", "4_z1")
+			w.Header().Set("X-Bz-File-Name", "present.txt")
+		case "/file/bucket/forbidden.txt":
+			w.WriteHeader(401)
+		default:
+			w.WriteHeader(404)
+		}
+	})
+	ctx := context.Background()
+
+	cases := []struct {
+		FileName string
+		Exists   bool
+		Err      bool
+	}{
+		{"present.txt", true, false},
+		{"absent.txt", false, false},
+		{"forbidden.txt", false, true},
+	}
+	for _, tc := range cases {
+		exists, err := c.FileExists(ctx, "bucket", tc.FileName)
+		if exists != tc.Exists || (err != nil) != tc.Err {
+			t.Errorf("Expected FileExists(%q) = %v (err: %v), got: %v, %v", tc.FileName, tc.Exists, tc.Err, exists, err)
+		}
+	}
+}
+
+func TestRetryClientFileInfoCache(t *testing.T) {
+	requests := make(map[string]int)
+	var base string
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/b2api/v2/b2_get_upload_url":
+			writeJSON(w, 200, UploadURLResponse{UploadURL: base + "/upload", AuthorizationToken: "upload-token"})
+			return
+		case "/upload":
+			writeJSON(w, 200, UploadFileResponse{FileID: "a2", BucketID: "bucket", FileName: "name-a"})
+			return
+		}
+		body := decodeBody(t, r)
+		fileId, _ := body["fileId"].(string)
+		switch r.URL.Path {
+		case "/b2api/v2/b2_get_file_info":
+			requests[fileId]++
+			name := "name-" + fileId
+			if fileId == "a-old" {
+				name = "name-a"
+			}
+			writeJSON(w, 200, GetFileInfoResponse{FileID: fileId, BucketID: "bucket", FileName: name, FileInfo: FileInfo{"k": "v"}})
+		case "/b2api/v2/b2_delete_file_version":
+			writeJSON(w, 200, DeleteFileResponse{FileID: fileId, FileName: body["fileName"].(string)})
+		default:
+			t.Errorf("Unexpected request: %s", r.URL.Path)
+		}
+	})
+	base = c.C.LastAuth().APIURL
+	clock := newFakeClock()
+	c.RC.Clock = clock
+	c.WithFileInfoCache(2, time.Minute)
+	ctx := context.Background()
+
+	get := func(fileId string) {
+		t.Helper()
+		res, err := c.GetFileInfo(ctx, fileId)
+		if err != nil || res.FileID != fileId {
+			t.Fatalf("Unexpected response: %#v, %v", res, err)
+		}
+	}
+
+	get("a")
+	get("a")
+	if requests["a"] != 1 {
+		t.Fatalf("Expected cache hit, got %d requests", requests["a"])
+	}
+
+	clock.Advance(time.Minute)
+	get("a")
+	if requests["a"] != 2 {
+		t.Fatalf("Expected expired entry to be fetched again, got %d requests", requests["a"])
+	}
+
+	get("b")
+	get("a")
+	get("c") // evicts b, the least recently used
+	get("a")
+	get("b")
+	if requests["a"] != 2 || requests["b"] != 2 || requests["c"] != 1 {
+		t.Fatalf("Expected least recently used entry to be evicted, got: %v", requests)
+	}
+
+	res, _ := c.GetFileInfo(ctx, "a")
+	res.FileInfo["k"] = "modified"
+	if res, _ := c.GetFileInfo(ctx, "a"); res.FileInfo["k"] != "v" {
+		t.Fatalf("Expected cached file info to be copied, got: %#v", res.FileInfo)
+	}
+
+	get("a-old")
+	if _, err := c.DeleteFileVersion(ctx, "a", "name-a"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	get("a")
+	get("a-old")
+	if requests["a"] != 3 || requests["a-old"] != 2 {
+		t.Fatalf("Expected delete to invalidate the cache by id and name, got: %v", requests)
+	}
+
+	_, err := c.UploadFile(ctx, "bucket", UploadFileOptions{
+		FileName:      "name-a",
+		Body:          ioutil.NopCloser(strings.NewReader("new")),
+		ContentLength: 3,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	get("a")
+	if requests["a"] != 4 {
+		t.Fatalf("Expected uploads to invalidate the cache by name, got %d requests", requests["a"])
+	}
+}
+
+func TestUploadFileFromPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "b2-upload")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// mockAuth uses a RecommendedPartSize of 10
+	cases := []struct {
+		Name  string
+		Size  int
+		Large bool
+	}{
+		{"small", 8, false},
+		{"large", 25, true},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			data := bytes.Repeat([]byte("0123456789"), 3)[:c.Size]
+			path := filepath.Join(dir, c.Name+".bin")
+			if err := ioutil.WriteFile(path, data, 0600); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			srv := &fakeLargeFileServer{t: t}
+			var fileName, srcLastModified string
+			clt := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/upload" {
+					fileName = r.Header.Get("X-Bz-File-Name")
+					srcLastModified = r.Header.Get("X-Bz-Info-src_last_modified_millis")
+				}
+				if r.URL.Path == "/b2api/v2/b2_start_large_file" {
+					body := decodeBody(t, r)
+					fileName = body["fileName"].(string)
+					srcLastModified = body["fileInfo"].(map[string]interface{})["src_last_modified_millis"].(string)
+					r.Body = ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"fileName":%q}`, fileName)))
+				}
+				srv.ServeHTTP(w, r)
+			})
+
+			_, err := clt.UploadFileFromPath(context.Background(), "bucket", path, UploadFileOptions{})
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if fileName != c.Name+".bin" {
+				t.Errorf("Expected file name to default to the base name, got: %q", fileName)
+			}
+			if srcLastModified != "1577934245000" {
+				t.Errorf("Expected src_last_modified_millis from the file's mtime, got: %q", srcLastModified)
+			}
+			if c.Large {
+				if srv.started != 1 || srv.finished != 1 || !bytes.Equal(srv.assembled(), data) {
+					t.Fatalf("Expected a large file upload, got %d started, %d finished: %q", srv.started, srv.finished, srv.assembled())
+				}
+			} else if len(srv.uploads) != 1 || srv.started != 0 || !bytes.HasPrefix(srv.uploads[0], data) {
+				t.Fatalf("Expected a simple upload, got %d uploads and %d large files", len(srv.uploads), srv.started)
+			}
+		})
+	}
+}
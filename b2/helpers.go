@@ -1,9 +1,19 @@
 package b2
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -27,16 +37,305 @@ func CredentialsFromEnvPrefix(prefix string) Credentials {
 	}
 }
 
+// CredentialsFromFile reads credentials from a file. If path is empty, the
+// file named by $B2_CREDENTIALS_FILE is used.
+//
+// The file can either be a JSON object using the same keys as B2's authorize
+// response (applicationKeyId, applicationKey, accountId, keyName) or lines of
+// key=value pairs using the same names as CredentialsFromEnv (B2_KEY_ID,
+// B2_APP_KEY, etc.). Blank lines and lines starting with # are ignored.
+func CredentialsFromFile(path string) (Credentials, error) {
+	if path == "" {
+		path = os.Getenv("B2_CREDENTIALS_FILE")
+		if path == "" {
+			return Credentials{}, fmt.Errorf("Error while reading credentials: no path given and B2_CREDENTIALS_FILE is not set")
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("Error while reading credentials: %w", err)
+	}
+
+	var creds Credentials
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		creds, err = parseJSONCredentials(trimmed)
+	} else {
+		creds, err = parseKeyValueCredentials(data)
+	}
+	if err != nil {
+		return Credentials{}, fmt.Errorf("Error while parsing credentials file %s: %w", path, err)
+	}
+	if creds.KeyID == "" || creds.AppKey == "" {
+		return Credentials{}, fmt.Errorf("Error while parsing credentials file %s: missing key id or application key", path)
+	}
+	return creds, nil
+}
+
+func parseJSONCredentials(data []byte) (Credentials, error) {
+	var v struct {
+		ApplicationKeyID string `json:"applicationKeyId"`
+		ApplicationKey   string `json:"applicationKey"`
+		AccountID        string `json:"accountId"`
+		KeyName          string `json:"keyName"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return Credentials{}, err
+	}
+	creds := Credentials{KeyID: v.ApplicationKeyID, KeyName: v.KeyName, AppKey: v.ApplicationKey}
+	if creds.KeyID == "" {
+		// the master application key uses the account id as its key id
+		creds.KeyID = v.AccountID
+	}
+	return creds, nil
+}
+
+func parseKeyValueCredentials(data []byte) (Credentials, error) {
+	values := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return Credentials{}, fmt.Errorf("line %d: expected key=value", i+1)
+		}
+		values[strings.TrimSpace(parts[0])] = strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+	}
+	get := func(keys ...string) string {
+		for _, k := range keys {
+			if v := values[k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	return Credentials{
+		KeyID:   get("B2_KEY_ID", "B2_ACCOUNT_ID"),
+		KeyName: get("B2_KEY_NAME", "B2_ACCOUNT_NAME"),
+		AppKey:  get("B2_APP_KEY", "B2_ACCOUNT_KEY"),
+	}, nil
+}
+
 func logStrTime(t time.Time) string { return t.Format(time.RFC3339Nano) }
 
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP-date. Returns 0 if v is missing, invalid, or in the past.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0
+	}
+	if d := t.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// millisToTime converts B2's milliseconds since the unix epoch to a time.Time
+func millisToTime(millis int64) time.Time {
+	return time.Unix(millis/1000, (millis%1000)*int64(time.Millisecond))
+}
+
+// timeToMillis converts t to B2's milliseconds since the unix epoch
+func timeToMillis(t time.Time) int64 { return t.UnixNano() / int64(time.Millisecond) }
+
+var customerKeyPattern = regexp.MustCompile(`"customerKey":"[^"]*"`)
+
+// redactRequestBody masks secrets in JSON request bodies for logging
+func redactRequestBody(body string) string {
+	return customerKeyPattern.ReplaceAllString(body, `"customerKey":"<redacted>"`)
+}
+
+// headers whose values are secrets and must never be logged
+var sensitiveHeaders = []string{
+	"Authorization",
+	"X-Bz-Server-Side-Encryption-Customer-Key",
+}
+
+// redactHeaders returns a copy of h with secret values masked for logging
+func redactHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range sensitiveHeaders {
+		if _, ok := out[name]; ok {
+			out.Set(name, "<redacted>")
+		}
+	}
+	return out
+}
+
+// ByteRange is an HTTP byte range, in the "bytes=1000-2000" form that
+// DownloadFileOptions, CopyFileOptions, and CopyPartOptions expect. Use From,
+// FromTo, or Suffix to create one.
+type ByteRange string
+
+// From creates a range from start (inclusive) to the end of the file
+func From(start int64) ByteRange {
+	return ByteRange(fmt.Sprintf("bytes=%d-", start))
+}
+
+// FromTo creates a range for [start, end] (both sides are inclusive)
+func FromTo(start, end int64) ByteRange {
+	return ByteRange(fmt.Sprintf("bytes=%d-%d", start, end))
+}
+
+// Suffix creates a range for the last n bytes of the file
+func Suffix(n int64) ByteRange {
+	return ByteRange(fmt.Sprintf("bytes=-%d", n))
+}
+
+func (r ByteRange) String() string { return string(r) }
+
+// Validate returns an *ErrInvalidRange unless r is a single range in one of
+// the forms From, FromTo and Suffix create, with non-negative bounds and a
+// start no greater than its end. An empty range is valid.
+func (r ByteRange) Validate() error {
+	_, _, err := r.bounds()
+	return err
+}
+
+// validateBounded is Validate, but also requires both a start and an end, like
+// b2_copy_file and b2_copy_part do.
+func (r ByteRange) validateBounded() error {
+	start, end, err := r.bounds()
+	if err == nil && r != "" && (start < 0 || end < 0) {
+		return &ErrInvalidRange{r, `expected the form "bytes=start-end"`}
+	}
+	return err
+}
+
+// bounds parses r, returning -1 for a missing start or end
+func (r ByteRange) bounds() (start, end int64, err error) {
+	if r == "" {
+		return -1, -1, nil
+	}
+	invalid := func(reason string) (int64, int64, error) {
+		return 0, 0, &ErrInvalidRange{r, reason}
+	}
+	spec := string(r)
+	if !strings.HasPrefix(spec, "bytes=") {
+		return invalid(`expected the "bytes=" unit`)
+	}
+	spec = spec[len("bytes="):]
+	if strings.Contains(spec, ",") {
+		return invalid("multiple ranges aren't supported")
+	}
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return invalid(`expected "start-end"`)
+	}
+	parse := func(v string) (int64, error) {
+		if v == "" {
+			return -1, nil
+		}
+		if strings.HasPrefix(v, "-") {
+			return 0, &ErrInvalidRange{r, "bounds can't be negative"}
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, &ErrInvalidRange{r, fmt.Sprintf("invalid bound %#v", v)}
+		}
+		return n, nil
+	}
+	if start, err = parse(spec[:i]); err != nil {
+		return 0, 0, err
+	}
+	if end, err = parse(spec[i+1:]); err != nil {
+		return 0, 0, err
+	}
+	switch {
+	case start < 0 && end < 0:
+		return invalid("expected a start or end")
+	case start >= 0 && end >= 0 && start > end:
+		return invalid(fmt.Sprintf("start %d is after end %d", start, end))
+	}
+	return start, end, nil
+}
+
 // Creates a range for b2 api [start, end] form (both sides are inclusive)
-func InclusiveRange(startOffset, endOffset int) string {
-	return fmt.Sprintf("%d-%d", startOffset, endOffset)
+func InclusiveRange(startOffset, endOffset int) ByteRange {
+	return FromTo(int64(startOffset), int64(endOffset))
 }
 
 // Creates a range for b2 api [start, end) form (start is inclusive, end is exclusive)
-func Range(startOffset, endOffset int) string {
-	return fmt.Sprintf("%d-%d", startOffset, endOffset-1)
+func Range(startOffset, endOffset int) ByteRange {
+	return FromTo(int64(startOffset), int64(endOffset-1))
+}
+
+// seekable returns r as an io.ReadSeeker with its current offset if it can
+// seek. Files like pipes and stdin implement io.Seeker but fail to seek, so
+// implementing it isn't enough.
+func seekable(r io.Reader) (io.ReadSeeker, int64, bool) {
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		return nil, 0, false
+	}
+	offset, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, false
+	}
+	return rs, offset, true
+}
+
+// EncodeFileName percent-encodes a file name for use in a URL path. Each
+// virtual folder is encoded separately, keeping "/" as the separator.
+//
+// B2 decodes "+" as a space, so it is always encoded.
+func EncodeFileName(fileName string) string {
+	segments := strings.Split(fileName, "/")
+	for i, s := range segments {
+		segments[i] = strings.ReplaceAll(url.PathEscape(s), "+", "%2B")
+	}
+	return strings.Join(segments, "/")
+}
+
+// downloadPath returns the path to download a file by name, relative to the
+// account's download URL
+func downloadPath(bucketName, fileName string) string {
+	return "/file/" + url.PathEscape(bucketName) + "/" + EncodeFileName(fileName)
+}
+
+// sniffLen is how many bytes http.DetectContentType considers
+const sniffLen = 512
+
+// DetectContentType guesses a file's content type from its extension, falling
+// back to sniffing peek, the first bytes of the file (only the first 512 are
+// used). Returns "application/octet-stream" if neither is conclusive.
+func DetectContentType(fileName string, peek []byte) string {
+	if t := mime.TypeByExtension(path.Ext(fileName)); t != "" {
+		return t
+	}
+	if len(peek) > 0 {
+		return http.DetectContentType(peek)
+	}
+	return "application/octet-stream"
+}
+
+// detectContentType calls DetectContentType with the first bytes of rs and
+// then rewinds it.
+func detectContentType(fileName string, rs io.ReadSeeker) (string, error) {
+	// check before reading, since the peeked bytes can't be put back otherwise
+	if _, _, ok := seekable(rs); !ok {
+		return "", fmt.Errorf("Error while detecting content type of %s: body can't seek", fileName)
+	}
+	peek := make([]byte, sniffLen)
+	n, err := io.ReadFull(rs, peek)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := rs.Seek(int64(-n), io.SeekCurrent); err != nil {
+		return "", err
+	}
+	return DetectContentType(fileName, peek[:n]), nil
 }
 
 // Closer is a helper function to convert an io.Reader to an io.ReadCloser that has a no-op close method
@@ -2,10 +2,19 @@ package b2
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var integrationConfig = struct {
@@ -110,3 +119,323 @@ func liveTestRetryClient(t *testing.T, allowReuse bool) (clt *RetryClient, ok bo
 	cachedRetryClient = clt
 	return clt, true
 }
+
+// mockClient returns a Client that is already authorized against a local test
+// server. Authorize, API, and download requests are routed to handler.
+func mockClient(t *testing.T, handler http.HandlerFunc) *Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &Client{BaseURL: srv.URL, lastAuth: mockAuth(srv.URL)}
+}
+
+// mockRetryClient is like mockClient, but returns a RetryClient configured
+// with short backoffs.
+func mockRetryClient(t *testing.T, handler http.HandlerFunc) *RetryClient {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	c := &RetryClient{RC: RetryConfig{
+		Jitter: 1,
+		Min:    time.Millisecond,
+		Max:    10 * time.Millisecond,
+		Unit:   time.Millisecond,
+	}}
+	c.C.BaseURL = srv.URL
+	c.C.lastAuth = mockAuth(srv.URL)
+	return c
+}
+
+func mockAuth(url string) *AuthorizeAccountResponse {
+	return &AuthorizeAccountResponse{
+		AbsoluteMinimumPartSize: 5,
+		RecommendedPartSize:     10,
+		AccountID:               "test-account",
+		APIURL:                  url,
+		AuthorizationToken:      "test-token",
+		DownloadURL:             url,
+	}
+}
+
+// decodeBody decodes the JSON request body of r into a generic map for
+// asserting wire-level field names.
+func decodeBody(t *testing.T, r *http.Request) map[string]interface{} {
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode request body: %s", err)
+	}
+	return body
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestCredentialsFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "b2client-test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return path
+	}
+
+	cases := []struct {
+		Name     string
+		Contents string
+		Expected Credentials
+		Err      string
+	}{
+		{
+			"json",
+			`{"applicationKeyId": "key-id", "applicationKey": "app-key", "accountId": "account", "keyName": "name"}`,
+			Credentials{KeyID: "key-id", KeyName: "name", AppKey: "app-key"}, "",
+		},
+		{
+			"json master key",
+			`  {"accountId": "account", "applicationKey": "app-key"}`,
+			Credentials{KeyID: "account", AppKey: "app-key"}, "",
+		},
+		{
+			"key value",
+			"# b2 credentials\nB2_KEY_ID=key-id\n\nB2_KEY_NAME = name\nB2_APP_KEY=\"app-key\"\n",
+			Credentials{KeyID: "key-id", KeyName: "name", AppKey: "app-key"}, "",
+		},
+		{
+			"key value account aliases",
+			"B2_ACCOUNT_ID=account\nB2_ACCOUNT_KEY=app-key",
+			Credentials{KeyID: "account", AppKey: "app-key"}, "",
+		},
+		{"malformed json", `{"applicationKeyId": `, Credentials{}, "unexpected end of JSON input"},
+		{"malformed key value", "B2_KEY_ID=key-id\nnot a pair\n", Credentials{}, "line 2: expected key=value"},
+		{"missing app key", `{"applicationKeyId": "key-id"}`, Credentials{}, "missing key id or application key"},
+		{"empty", "", Credentials{}, "missing key id or application key"},
+	}
+
+	for i, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			path := write(fmt.Sprintf("creds-%d", i), c.Contents)
+			creds, err := CredentialsFromFile(path)
+			if c.Err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.Err) || !strings.Contains(err.Error(), path) {
+					t.Fatalf("Expected error containing %#v and the path, got: %v", c.Err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if creds != c.Expected {
+				t.Fatalf("Expected %#v, got: %#v", c.Expected, creds)
+			}
+		})
+	}
+
+	t.Run("from env", func(t *testing.T) {
+		path := write("env", "B2_KEY_ID=env-key\nB2_APP_KEY=env-app-key")
+		old, had := os.LookupEnv("B2_CREDENTIALS_FILE")
+		os.Setenv("B2_CREDENTIALS_FILE", path)
+		t.Cleanup(func() {
+			if had {
+				os.Setenv("B2_CREDENTIALS_FILE", old)
+			} else {
+				os.Unsetenv("B2_CREDENTIALS_FILE")
+			}
+		})
+
+		creds, err := CredentialsFromFile("")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if creds.KeyID != "env-key" || creds.AppKey != "env-app-key" {
+			t.Fatalf("Expected credentials from B2_CREDENTIALS_FILE, got: %#v", creds)
+		}
+
+		os.Unsetenv("B2_CREDENTIALS_FILE")
+		if _, err := CredentialsFromFile(""); err == nil {
+			t.Fatalf("Expected error without a path")
+		}
+	})
+
+	if _, err := CredentialsFromFile(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected not exist error, got: %v", err)
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	cases := []struct {
+		FileName string
+		Peek     []byte
+		Expected string
+	}{
+		{"index.html", nil, "text/html; charset=utf-8"},
+		{"photo.JPG", nil, "image/jpeg"},
+		{"data.json", []byte("<html>"), "application/json"},
+		{"styles.css", nil, "text/css; charset=utf-8"},
+		{"archive.zip", nil, "application/zip"},
+		{"no-extension", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), "image/png"},
+		{"no-extension", []byte("plain text"), "text/plain; charset=utf-8"},
+		{"no-extension", []byte{0x00, 0x01, 0x02, 0xff}, "application/octet-stream"},
+		{"no-extension", nil, "application/octet-stream"},
+	}
+	for _, c := range cases {
+		if got := DetectContentType(c.FileName, c.Peek); got != c.Expected {
+			t.Errorf("Expected DetectContentType(%q, %q) = %q, got: %q", c.FileName, c.Peek, c.Expected, got)
+		}
+	}
+}
+
+func TestByteRange(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Range    ByteRange
+		Expected string
+	}{
+		{"inclusive", FromTo(1000, 2000), "bytes=1000-2000"},
+		{"single byte", FromTo(0, 0), "bytes=0-0"},
+		{"open ended", From(500), "bytes=500-"},
+		{"suffix", Suffix(100), "bytes=-100"},
+		{"InclusiveRange", InclusiveRange(0, 99), "bytes=0-99"},
+		{"exclusive Range", Range(0, 100), "bytes=0-99"},
+	}
+	for _, c := range cases {
+		if c.Range.String() != c.Expected {
+			t.Errorf("%s: expected %q, got: %q", c.Name, c.Expected, c.Range.String())
+		}
+	}
+
+	body, err := json.Marshal(CopyPartOptions{Range: FromTo(0, 9)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(string(body), `"range":"bytes=0-9"`) {
+		t.Errorf("Expected range to be encoded as a string, got: %s", body)
+	}
+}
+
+func TestByteRangeValidate(t *testing.T) {
+	valid := []ByteRange{"", FromTo(0, 0), FromTo(1000, 2000), From(500), Suffix(100)}
+	for _, r := range valid {
+		if err := r.Validate(); err != nil {
+			t.Errorf("Expected %q to be valid, got: %s", r, err)
+		}
+	}
+
+	invalid := []ByteRange{
+		"1000-2000",
+		"bytes=2000-1000",
+		"bytes=-5-10",
+		"bytes=5--10",
+		"bytes=a-b",
+		"bytes=-",
+		"bytes=100",
+		"bytes=0-1,5-6",
+		"items=0-10",
+	}
+	for _, r := range invalid {
+		var rangeErr *ErrInvalidRange
+		if err := r.Validate(); !errors.As(err, &rangeErr) || rangeErr.Range != r {
+			t.Errorf("Expected %q to be invalid, got: %v", r, err)
+		}
+	}
+
+	if err := From(500).validateBounded(); err == nil {
+		t.Errorf("Expected open ended ranges to be invalid for copies")
+	}
+	if err := FromTo(0, 9).validateBounded(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestInvalidRangesAreNotSent(t *testing.T) {
+	requests := 0
+	clt := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		writeJSON(w, 200, File{})
+	})
+	ctx := context.Background()
+	var rangeErr *ErrInvalidRange
+
+	_, err := clt.CopyFile(ctx, CopyFileOptions{SourceFileId: "id", FileName: "copy", Range: "bytes=10-5"})
+	if !errors.As(err, &rangeErr) {
+		t.Errorf("Expected CopyFile to return ErrInvalidRange, got: %v", err)
+	}
+	_, err = clt.CopyPart(ctx, CopyPartOptions{SourceFileId: "id", LargeFileId: "large", PartNumber: 1, Range: From(5)})
+	if !errors.As(err, &rangeErr) {
+		t.Errorf("Expected CopyPart to return ErrInvalidRange, got: %v", err)
+	}
+	_, err = clt.DownloadFileByID(ctx, "id", &DownloadFileOptions{Range: "bytes=5--1"})
+	if !errors.As(err, &rangeErr) {
+		t.Errorf("Expected DownloadFileByID to return ErrInvalidRange, got: %v", err)
+	}
+	_, err = clt.DownloadFileByName(ctx, "bucket", "file", DownloadFileOptions{Range: "bytes=-"})
+	if !errors.As(err, &rangeErr) {
+		t.Errorf("Expected DownloadFileByName to return ErrInvalidRange, got: %v", err)
+	}
+	if requests != 0 {
+		t.Fatalf("Expected invalid ranges to not be sent, got: %d requests", requests)
+	}
+}
+
+// fakeClock is a Clock that only moves when advanced. After advances the
+// clock immediately instead of blocking, recording each sleep.
+type fakeClock struct {
+	m      sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) Sleeps() []time.Duration {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return append([]time.Duration(nil), c.sleeps...)
+}
+
+// pipeOf returns the read end of an os.Pipe that data is written to. Pipes are
+// files that implement io.Seeker and io.ReaderAt, but fail to seek or read at
+// an offset.
+func pipeOf(t *testing.T, data string) *os.File {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	t.Cleanup(func() { pr.Close() })
+	go func() {
+		pw.WriteString(data)
+		pw.Close()
+	}()
+	return pr
+}
@@ -0,0 +1,732 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxPartCount is the most parts B2 allows a large file to have
+const MaxPartCount = 10000
+
+// PlanParts picks the size of the parts to split totalSize bytes into,
+// returning it with the number of parts. recommendedPartSize is used unless
+// it's smaller than minPartSize, or the file would need more than
+// MaxPartCount parts, in which case parts are as small as possible while
+// fitting. Content that fits in a single part (including empty content) is
+// one part. If totalSize is negative (unknown), count is 0.
+func PlanParts(totalSize, minPartSize, recommendedPartSize int64) (partSize int64, count int) {
+	partSize = recommendedPartSize
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	if partSize <= 0 {
+		partSize = 1
+	}
+	if totalSize < 0 {
+		return partSize, 0
+	}
+	if totalSize > partSize*MaxPartCount {
+		partSize = (totalSize + MaxPartCount - 1) / MaxPartCount
+	}
+	n := (totalSize + partSize - 1) / partSize
+	if n == 0 {
+		n = 1
+	}
+	return partSize, int(n)
+}
+
+// LargeFileOptions configures how UploadLargeFileWithOptions splits and
+// uploads a large file.
+type LargeFileOptions struct {
+	PartSize           int64 // optional, size of each part, 0 = the account's RecommendedPartSize, raised to fit in MaxPartCount parts
+	MaxConcurrentParts int   // optional, number of parts to upload in parallel, 0 = 1
+}
+
+// UploadLargeFile uploads the contents of opt.Body as a large file, splitting
+// it into parts of partSize bytes. A partSize of 0 uses the account's
+// RecommendedPartSize. See UploadLargeFileWithOptions for details.
+func (c *RetryClient) UploadLargeFile(ctx context.Context, bucketId string, opt UploadFileOptions, partSize int64) (FinishLargeFileResponse, error) {
+	return c.UploadLargeFileWithOptions(ctx, bucketId, opt, LargeFileOptions{PartSize: partSize})
+}
+
+// UploadLargeFileWithOptions uploads the contents of opt.Body as a large file,
+// splitting it into parts and uploading up to lopt.MaxConcurrentParts of them
+// in parallel. ContentSha1 of opt is ignored, each part is hashed separately.
+// ContentMd5 is only used when the content is uploaded via UploadFile.
+//
+// Parts are buffered in memory unless:
+//
+//   - opt.Body implements io.ReaderAt and its size is known (via a positive
+//     ContentLength or by seeking), in which case parts are read directly
+//     from the body, starting at its current offset. Files that can't seek,
+//     like pipes and stdin, are read in order instead.
+//   - the Client has a TempStorage, in which case parts are buffered there.
+//
+// At most MaxConcurrentParts+1 parts are buffered at a time. This makes
+// UploadLargeFile suitable for streaming sources of unknown length, like
+// pipes or network connections: set opt.ContentLength to
+// ContentLengthDetermineUsingTempStorage and the body is read and uploaded a
+// part at a time, with PartSize bounding memory use, instead of being
+// buffered in full like UploadFile does. Each part's sha1 is computed from
+// its buffer before it's uploaded.
+//
+// B2 requires large files to have at least 2 parts, so content smaller than
+// AbsoluteMinimumPartSize (or that otherwise fits in a single part) is
+// uploaded via UploadFile instead.
+//
+// If any part fails to upload, the large file is cancelled. Authorizes as
+// needed.
+func (c *RetryClient) UploadLargeFileWithOptions(ctx context.Context, bucketId string, opt UploadFileOptions, lopt LargeFileOptions) (FinishLargeFileResponse, error) {
+	auth, err := c.AuthorizeIfNeeded(ctx)
+	if err != nil {
+		return FinishLargeFileResponse{}, err
+	}
+	partSize := lopt.PartSize
+	if partSize == 0 {
+		partSize = int64(auth.RecommendedPartSize)
+	}
+	concurrency := lopt.MaxConcurrentParts
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	defer opt.Body.Close()
+
+	parts, err := newPartReader(opt.Body, opt.ContentLength, partSize, c.C.TS)
+	if err != nil {
+		return FinishLargeFileResponse{}, err
+	}
+	// plan once the size is known, which may take seeking the body
+	size := opt.ContentLength
+	if parts.ra != nil {
+		size = parts.size
+	}
+	partSize, _ = PlanParts(size, int64(auth.AbsoluteMinimumPartSize), partSize)
+	parts.partSize = partSize
+	first, err := parts.next()
+	if err != nil {
+		return FinishLargeFileResponse{}, err
+	}
+	var second *largeFilePart
+	if first != nil && first.Size == partSize {
+		second, err = parts.next()
+		if err != nil {
+			first.Close()
+			return FinishLargeFileResponse{}, err
+		}
+	}
+	if second == nil {
+		opt.ContentLength = 0
+		opt.Body = Closer(bytes.NewReader(nil))
+		if first != nil {
+			defer first.Close()
+			opt.ContentLength = first.Size
+			opt.Body = &unclosableReadSeeker{first.content}
+		}
+		opt.ContentSha1 = ""
+		res, err := c.UploadFile(ctx, bucketId, opt)
+		return FinishLargeFileResponse(res), err
+	}
+
+	contentType := opt.ContentType
+	if contentType == "" && opt.AutoDetectContentType {
+		contentType, err = detectContentType(opt.FileName, first.content)
+		if err != nil {
+			first.Close()
+			second.Close()
+			return FinishLargeFileResponse{}, fmt.Errorf("Error while detecting content type: %w", err)
+		}
+	}
+	if contentType == "" {
+		contentType = ContentTypeAuto
+	}
+	info, err := opt.fileInfo()
+	if err != nil {
+		first.Close()
+		second.Close()
+		return FinishLargeFileResponse{}, err
+	}
+	start, err := c.StartLargeFileWithOptions(ctx, bucketId, StartLargeFileOptions{
+		FileName:             opt.FileName,
+		ContentType:          contentType,
+		FileInfo:             &info,
+		ServerSideEncryption: opt.ServerSideEncryption,
+	})
+	if err != nil {
+		first.Close()
+		second.Close()
+		return FinishLargeFileResponse{}, fmt.Errorf("Error while starting large file: %w", err)
+	}
+
+	var progress *largeFileProgress
+	if opt.Progress != nil {
+		total := int64(-1)
+		if parts.ra != nil {
+			total = parts.size
+		} else if opt.ContentLength > 0 {
+			total = opt.ContentLength
+		}
+		progress = &largeFileProgress{fn: opt.Progress, total: total, parts: make(map[int]int64)}
+	}
+
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		m        sync.Mutex
+		firstErr error
+		sums     = make(map[int]string)
+		wg       sync.WaitGroup
+		pool     uploadPartURLPool
+		work     = make(chan *largeFilePart)
+	)
+	fail := func(err error) {
+		m.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		m.Unlock()
+		cancel()
+	}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range work {
+				sum, err := c.uploadPart(uploadCtx, &pool, start.FileID, part, opt.ServerSideEncryption, progress)
+				part.Close()
+				if err != nil {
+					fail(err)
+					continue
+				}
+				m.Lock()
+				sums[part.Number] = sum
+				m.Unlock()
+			}
+		}()
+	}
+
+	count := 0
+	send := func(part *largeFilePart) bool {
+		count++
+		select {
+		case work <- part:
+			return true
+		case <-uploadCtx.Done():
+			part.Close()
+			return false
+		}
+	}
+	if send(first) && send(second) {
+		for {
+			part, err := parts.next()
+			if err != nil {
+				fail(err)
+				break
+			}
+			if part == nil || !send(part) {
+				break
+			}
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		c.CancelLargeFile(context.Background(), start.FileID)
+		return FinishLargeFileResponse{}, firstErr
+	}
+
+	partSha1s := make([]string, count)
+	for i := range partSha1s {
+		partSha1s[i] = sums[i+1]
+	}
+	return c.FinishLargeFile(ctx, start.FileID, partSha1s)
+}
+
+// ResumeLargeFile finishes an unfinished large file, like one left behind by
+// an interrupted UploadLargeFile, by uploading the parts B2 doesn't have yet
+// from source. source must have the same contents as the original upload,
+// split into parts of partSize bytes. A partSize of 0 uses the size of the
+// uploaded first part, or the account's RecommendedPartSize if there isn't
+// one.
+//
+// Parts B2 already has are checked against the sha1 of the same range of
+// source, returning an error without uploading anything more if they don't
+// match. An empty source is an error, since a large file needs at least one
+// part. Unlike UploadLargeFile, the large file isn't cancelled on error, so
+// it can be resumed again. Files encrypted with SSE-C aren't supported.
+// Authorizes as needed.
+func (c *RetryClient) ResumeLargeFile(ctx context.Context, fileId string, source io.ReaderAt, partSize int64) (FinishLargeFileResponse, error) {
+	uploaded := make(map[int]FilePart)
+	err := c.ListAllParts(ctx, fileId, ListPartsOptions{}, func(p FilePart) error {
+		uploaded[p.PartNumber] = p
+		return nil
+	})
+	if err != nil {
+		return FinishLargeFileResponse{}, fmt.Errorf("Error while listing parts of %s: %w", fileId, err)
+	}
+	if partSize == 0 {
+		if p, ok := uploaded[1]; ok {
+			partSize = p.ContentLength
+		} else {
+			auth, err := c.AuthorizeIfNeeded(ctx)
+			if err != nil {
+				return FinishLargeFileResponse{}, err
+			}
+			partSize = int64(auth.RecommendedPartSize)
+		}
+	}
+	if partSize <= 0 {
+		return FinishLargeFileResponse{}, fmt.Errorf("Invalid partSize: %d", partSize)
+	}
+
+	var (
+		pool      uploadPartURLPool
+		partSha1s []string
+		size      int64
+	)
+	for number, offset := 1, int64(0); ; number, offset = number+1, offset+partSize {
+		if err := ctx.Err(); err != nil {
+			return FinishLargeFileResponse{}, err
+		}
+		h := sha1.New()
+		n, err := io.Copy(h, io.NewSectionReader(source, offset, partSize))
+		if err != nil {
+			return FinishLargeFileResponse{}, fmt.Errorf("Error while reading part %d: %w", number, err)
+		}
+		if n == 0 {
+			if number == 1 {
+				return FinishLargeFileResponse{}, fmt.Errorf("Error while resuming %s: source is empty", fileId)
+			}
+			break
+		}
+		size += n
+		sum := fmt.Sprintf("%x", h.Sum(nil))
+
+		if p, ok := uploaded[number]; ok {
+			if p.ContentLength != n || !strings.EqualFold(p.ContentSha1, sum) {
+				return FinishLargeFileResponse{}, fmt.Errorf("Error while resuming %s: uploaded part %d (%d bytes, sha1 %s) doesn't match source (%d bytes, sha1 %s)", fileId, number, p.ContentLength, p.ContentSha1, n, sum)
+			}
+			delete(uploaded, number)
+		} else {
+			part := &largeFilePart{Number: number, Size: n, content: io.NewSectionReader(source, offset, n)}
+			if _, err := c.uploadPart(ctx, &pool, fileId, part, nil, nil); err != nil {
+				return FinishLargeFileResponse{}, err
+			}
+		}
+		partSha1s = append(partSha1s, sum)
+		if n < partSize {
+			break
+		}
+	}
+	if len(uploaded) > 0 {
+		first := 0
+		for number := range uploaded {
+			if first == 0 || number < first {
+				first = number
+			}
+		}
+		return FinishLargeFileResponse{}, fmt.Errorf("Error while resuming %s: uploaded part %d is past the end of source (%d bytes in %d parts of %d bytes)", fileId, first, size, len(partSha1s), partSize)
+	}
+	return c.FinishLargeFile(ctx, fileId, partSha1s)
+}
+
+// CleanupUnfinishedLargeFiles cancels unfinished large files in a bucket that
+// were started more than olderThan ago, returning the number cancelled.
+// Cancelling stops at the first error, returning the count so far. Authorizes
+// as needed.
+func (c *RetryClient) CleanupUnfinishedLargeFiles(ctx context.Context, bucketId string, olderThan time.Duration) (int, error) {
+	cutoff := c.clock().Now().Add(-olderThan).UnixNano() / int64(time.Millisecond)
+	var stale []File
+	err := c.ListAllUnfinishedLargeFiles(ctx, bucketId, ListUnfinishedLargeFilesOptions{}, func(f File) error {
+		if f.UploadTimestampMillis < cutoff {
+			stale = append(stale, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i, f := range stale {
+		if _, err := c.CancelLargeFile(ctx, f.FileID); err != nil {
+			return i, fmt.Errorf("Error while cancelling large file %s: %w", f.FileName, err)
+		}
+	}
+	return len(stale), nil
+}
+
+// maxCopyFileSize is the largest file b2_copy_file can copy in one request
+var maxCopyFileSize int64 = 5 * 1000 * 1000 * 1000
+
+// CopyLargeFile copies a file like CopyFile, but copies sources larger than
+// b2_copy_file's 5GB limit as a large file of partSize parts using CopyPart. A
+// partSize of 0 uses the account's RecommendedPartSize.
+//
+// Ranged copies (opt.Range) always use CopyFile. Without a
+// MetadataDirectiveReplace, the large file keeps the source's content type and
+// file info. If any part fails to copy, the large file is cancelled.
+// Authorizes as needed.
+func (c *RetryClient) CopyLargeFile(ctx context.Context, opt CopyFileOptions, partSize int64) (CopyFileResponse, error) {
+	auth, err := c.AuthorizeIfNeeded(ctx)
+	if err != nil {
+		return CopyFileResponse{}, err
+	}
+	src, err := c.GetFileInfo(ctx, opt.SourceFileId)
+	if err != nil {
+		return CopyFileResponse{}, fmt.Errorf("Error while getting source file info: %w", err)
+	}
+	if src.ContentLength <= maxCopyFileSize || opt.Range != "" {
+		return c.CopyFile(ctx, opt)
+	}
+
+	if partSize == 0 {
+		partSize = int64(auth.RecommendedPartSize)
+	}
+	partSize, _ = PlanParts(src.ContentLength, int64(auth.AbsoluteMinimumPartSize), partSize)
+	if partSize > maxCopyFileSize {
+		partSize = maxCopyFileSize
+	}
+
+	bucketId := opt.DestinationBucketId
+	if bucketId == "" {
+		bucketId = src.BucketID
+	}
+	contentType, info := src.ContentType, src.FileInfo
+	if opt.MetadataDirective == MetadataDirectiveReplace {
+		contentType, info = opt.ContentType, opt.FileInfo
+	}
+	if contentType == "" {
+		contentType = ContentTypeAuto
+	}
+	start, err := c.StartLargeFileWithOptions(ctx, bucketId, StartLargeFileOptions{
+		FileName:             opt.FileName,
+		ContentType:          contentType,
+		FileInfo:             &info,
+		ServerSideEncryption: opt.DestinationServerSideEncryption,
+	})
+	if err != nil {
+		return CopyFileResponse{}, fmt.Errorf("Error while starting large file: %w", err)
+	}
+
+	var parts []FilePart
+	for offset, number := int64(0), 1; offset < src.ContentLength; offset, number = offset+partSize, number+1 {
+		end := offset + partSize - 1
+		if end >= src.ContentLength {
+			end = src.ContentLength - 1
+		}
+		part, err := c.CopyPart(ctx, CopyPartOptions{
+			SourceFileId:                    opt.SourceFileId,
+			LargeFileId:                     start.FileID,
+			PartNumber:                      number,
+			Range:                           FromTo(offset, end),
+			SourceServerSideEncryption:      opt.SourceServerSideEncryption,
+			DestinationServerSideEncryption: opt.DestinationServerSideEncryption,
+		})
+		if err != nil {
+			c.CancelLargeFile(context.Background(), start.FileID)
+			return CopyFileResponse{}, fmt.Errorf("Error while copying part %d: %w", number, err)
+		}
+		if part.PartNumber != number || part.ContentSha1 == "" {
+			c.CancelLargeFile(context.Background(), start.FileID)
+			return CopyFileResponse{}, fmt.Errorf("Error while copying part %d: unexpected response for part %d with sha1 %#v", number, part.PartNumber, part.ContentSha1)
+		}
+		parts = append(parts, FilePart(part))
+	}
+
+	res, err := c.FinishLargeFile(ctx, start.FileID, CollectPartSha1s(parts))
+	return CopyFileResponse(res), err
+}
+
+// CollectPartSha1s returns the sha1s of parts ordered by PartNumber, as
+// FinishLargeFile expects them. Useful for parts from CopyPart or ListParts,
+// which may not be in order.
+func CollectPartSha1s(parts []FilePart) []string {
+	sorted := append([]FilePart(nil), parts...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].PartNumber < sorted[j].PartNumber })
+	sums := make([]string, len(sorted))
+	for i, p := range sorted {
+		sums[i] = p.ContentSha1
+	}
+	return sums
+}
+
+// uploadPartURLPool holds upload part URLs that can be reused for subsequent
+// parts of the same large file.
+type uploadPartURLPool struct {
+	m    sync.Mutex
+	urls []GetUploadPartURLResponse
+}
+
+func (p *uploadPartURLPool) get() (GetUploadPartURLResponse, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if len(p.urls) == 0 {
+		return GetUploadPartURLResponse{}, false
+	}
+	u := p.urls[len(p.urls)-1]
+	p.urls = p.urls[:len(p.urls)-1]
+	return u, true
+}
+
+func (p *uploadPartURLPool) put(u GetUploadPartURLResponse) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.urls = append(p.urls, u)
+}
+
+// uploadPart uploads a part of a large file and returns its sha1. Upload part
+// URLs are taken from pool and returned on success. On failure, the URL is
+// discarded and a new one is requested as per B2's integration guide.
+func (c *RetryClient) uploadPart(ctx context.Context, pool *uploadPartURLPool, fileId string, part *largeFilePart, sse *SSE, progress *largeFileProgress) (string, error) {
+	h := sha1.New()
+	if _, err := io.Copy(h, part.content); err != nil {
+		return "", err
+	}
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+
+	start := c.clock().Now()
+	retries := uint32(0)
+	for {
+		urlRes, ok := pool.get()
+		if !ok {
+			err := c.genericRetryHandler(ctx, CapabilityWriteFiles, func(ctx context.Context) error {
+				var err error
+				urlRes, err = c.C.GetUploadPartURL(ctx, fileId)
+				return err
+			})
+			if err != nil {
+				return "", fmt.Errorf("Error while requesting upload part url: %w", err)
+			}
+		}
+
+		if _, err := part.content.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		_, err := c.C.UploadPart(ctx, urlRes.UploadURL, urlRes.AuthorizationToken, UploadFilePartOptions{
+			PartNumber:    part.Number,
+			ContentLength: part.Size,
+			Body:          Closer(part.content),
+			ContentSha1:   sum,
+
+			ServerSideEncryption: sse,
+			Progress:             progress.forPart(part.Number),
+		})
+		if err != nil {
+			if isRetryableUploadErr(err) && retries < c.RC.getMaxAttempts() {
+				if err := c.checkElapsed(start, err); err != nil {
+					return "", fmt.Errorf("Error while uploading part %d: %w", part.Number, err)
+				}
+				retries++
+				if err := c.wait(ctx, err, retries); err != nil {
+					return "", fmt.Errorf("Error while uploading part %d (context error): %w", part.Number, err)
+				}
+				continue
+			}
+			return "", fmt.Errorf("Error while uploading part %d: %w", part.Number, err)
+		}
+		pool.put(urlRes)
+		return sum, nil
+	}
+}
+
+// largeFileProgress combines the progress of concurrently uploading parts. A
+// retried part restarts its count, so progress may go backwards.
+type largeFileProgress struct {
+	m        sync.Mutex
+	fn       ProgressFunc
+	total    int64
+	uploaded int64
+	parts    map[int]int64
+}
+
+func (p *largeFileProgress) forPart(number int) ProgressFunc {
+	if p == nil {
+		return nil
+	}
+	return func(n, _ int64) {
+		p.m.Lock()
+		defer p.m.Unlock()
+		p.uploaded += n - p.parts[number]
+		p.parts[number] = n
+		p.fn(p.uploaded, p.total)
+	}
+}
+
+// largeFilePart is a rewindable part of a large file
+type largeFilePart struct {
+	Number int
+	Size   int64
+
+	content io.ReadSeeker
+	closer  io.Closer
+}
+
+func (p *largeFilePart) Close() error {
+	if p.closer != nil {
+		return p.closer.Close()
+	}
+	return nil
+}
+
+// partReader splits a reader into largeFileParts
+type partReader struct {
+	r  io.Reader
+	ra io.ReaderAt // set if parts can be read directly from the source
+	ts TempStorage // nilable
+
+	start    int64 // offset in ra the content starts at
+	size     int64 // total size, only known if ra is set
+	offset   int64
+	partSize int64
+	number   int
+}
+
+// newPartReader reads parts directly from r if it's an io.ReaderAt whose size
+// is known, from a positive contentLength or by seeking, starting at r's
+// current offset. Otherwise parts are read from r in order.
+func newPartReader(r io.Reader, contentLength, partSize int64, ts TempStorage) (*partReader, error) {
+	p := &partReader{r: r, ts: ts, partSize: partSize}
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return p, nil
+	}
+	if _, ok := r.(io.Seeker); !ok {
+		// without seeking, the offset can't be known, so assume it's the start
+		if contentLength > 0 {
+			p.ra = ra
+			p.size = contentLength
+		}
+		return p, nil
+	}
+	// files like pipes implement io.ReaderAt and io.Seeker, but can't seek
+	s, cur, ok := seekable(r)
+	if !ok {
+		return p, nil
+	}
+	size := contentLength
+	if size <= 0 {
+		end, err := s.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := s.Seek(cur, io.SeekStart); err != nil {
+			return nil, err
+		}
+		size = end - cur
+	}
+	p.ra = ra
+	p.start = cur
+	p.size = size
+	return p, nil
+}
+
+// next returns the next part, or nil if there are no more parts.
+func (p *partReader) next() (*largeFilePart, error) {
+	if p.ra != nil {
+		if p.offset >= p.size {
+			return nil, nil
+		}
+		n := p.partSize
+		if rem := p.size - p.offset; rem < n {
+			n = rem
+		}
+		p.number++
+		part := &largeFilePart{
+			Number:  p.number,
+			Size:    n,
+			content: io.NewSectionReader(p.ra, p.start+p.offset, n),
+		}
+		p.offset += n
+		return part, nil
+	}
+
+	if p.ts != nil {
+		rc, n, err := p.ts.Store(io.LimitReader(p.r, p.partSize))
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, rc.Close()
+		}
+		p.number++
+		if rs, ok := rc.(io.ReadSeeker); ok {
+			return &largeFilePart{Number: p.number, Size: n, content: rs, closer: rc}, nil
+		}
+		buf, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		return &largeFilePart{Number: p.number, Size: n, content: bytes.NewReader(buf)}, nil
+	}
+
+	buf, err := readPart(p.r, p.partSize)
+	if err != nil || len(buf) == 0 {
+		return nil, err
+	}
+	p.number++
+	return &largeFilePart{Number: p.number, Size: int64(len(buf)), content: bytes.NewReader(buf)}, nil
+}
+
+// readPart reads up to size bytes from r. Returns fewer bytes only when r is
+// exhausted.
+func readPart(r io.Reader, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// fileInfo returns the file info B2 would record for the upload headers opt
+// sets, for use with StartLargeFile. Returns an error for the same Info keys
+// and limits that setOnRequest rejects. X-Bz-Info-* ExtraHeaders are
+// percent-decoded, since B2 decodes them for simple uploads.
+func (opt *UploadFileOptions) fileInfo() (FileInfo, error) {
+	info := FileInfo{}
+	if opt.SrcLastModified != nil {
+		info.SetSrcLastModified(*opt.SrcLastModified)
+	}
+	info.SetContentDisposition(opt.ContentDisposition)
+	info.SetContentLanguage(opt.ContentLanguage)
+	info.SetExpires(opt.Expires)
+	info.SetCacheControl(opt.CacheControl)
+	info.SetContentEncoding(opt.ContentEncoding)
+	info.SetContentType(opt.DownloadContentType)
+	sanitized, err := sanitizeInfo(opt.Info)
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range sanitized {
+		info[name] = v
+	}
+	const infoPrefix = "x-bz-info-"
+	for k, v := range opt.ExtraHeaders {
+		if strings.HasPrefix(strings.ToLower(k), infoPrefix) {
+			decoded, err := url.PathUnescape(v)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s header: %w", k, err)
+			}
+			info[k[len(infoPrefix):]] = decoded
+		}
+	}
+	if err := checkFileInfo(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
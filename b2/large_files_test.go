@@ -0,0 +1,745 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeLargeFileServer records simple and large file uploads.
+type fakeLargeFileServer struct {
+	t *testing.T
+
+	m          sync.Mutex
+	uploads    [][]byte
+	parts      map[int][]byte
+	partSha1s  []string
+	started    int
+	finished   int
+	cancelled  int
+	failPartAt int // fail the first attempt at uploading this part number
+	partURLs   int
+	uploaded   []int // part numbers in the order they were uploaded
+
+	startContentType string
+
+	partDelay func(partNumber int) time.Duration // nilable
+}
+
+func (s *fakeLargeFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.partDelay != nil && r.URL.Path == "/upload_part" {
+		n, _ := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+		time.Sleep(s.partDelay(n))
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	base := "http://" + r.Host
+	switch r.URL.Path {
+	case "/b2api/v2/b2_get_upload_url":
+		writeJSON(w, 200, UploadURLResponse{UploadURL: base + "/upload", AuthorizationToken: "upload-token"})
+	case "/upload":
+		b, _ := ioutil.ReadAll(r.Body)
+		s.uploads = append(s.uploads, b)
+		writeJSON(w, 200, File{FileID: "small", FileName: r.Header.Get("X-Bz-File-Name"), Action: ActionUpload})
+	case "/b2api/v2/b2_start_large_file":
+		s.started++
+		body := decodeBody(s.t, r)
+		s.startContentType, _ = body["contentType"].(string)
+		writeJSON(w, 200, File{FileID: "large", FileName: body["fileName"].(string), Action: ActionStart})
+	case "/b2api/v2/b2_get_upload_part_url":
+		s.partURLs++
+		writeJSON(w, 200, UploadURLResponse{FileID: "large", UploadURL: base + "/upload_part", AuthorizationToken: "part-token"})
+	case "/upload_part":
+		n, _ := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+		b, _ := ioutil.ReadAll(r.Body)
+		if n == s.failPartAt {
+			s.failPartAt = 0
+			writeJSON(w, 503, ErrorResponse{Status: 503, Code: "service_unavailable"})
+			return
+		}
+		if got := fmt.Sprintf("%x", sha1.Sum(b)); got != r.Header.Get("X-Bz-Content-Sha1") {
+			writeJSON(w, 400, ErrorResponse{Status: 400, Code: "bad_request", Message: "sha1 mismatch"})
+			return
+		}
+		if s.parts == nil {
+			s.parts = make(map[int][]byte)
+		}
+		s.parts[n] = b
+		s.uploaded = append(s.uploaded, n)
+		writeJSON(w, 200, FilePart{FileID: "large", PartNumber: n, ContentLength: int64(len(b)), ContentSha1: r.Header.Get("X-Bz-Content-Sha1")})
+	case "/b2api/v2/b2_list_parts":
+		// 2 parts per page to exercise pagination
+		body := decodeBody(s.t, r)
+		start := 1
+		if v, ok := body["startPartNumber"].(float64); ok {
+			start = int(v)
+		}
+		res := ListPartsResponse{}
+		for n := start; n <= MaxPartCount; n++ {
+			b, ok := s.parts[n]
+			if !ok {
+				continue
+			}
+			if len(res.Parts) == 2 {
+				res.NextPartNumber = n
+				break
+			}
+			res.Parts = append(res.Parts, FilePart{FileID: "large", PartNumber: n, ContentLength: int64(len(b)), ContentSha1: fmt.Sprintf("%x", sha1.Sum(b))})
+		}
+		writeJSON(w, 200, res)
+	case "/b2api/v2/b2_finish_large_file":
+		s.finished++
+		body := decodeBody(s.t, r)
+		for _, v := range body["partSha1Array"].([]interface{}) {
+			s.partSha1s = append(s.partSha1s, v.(string))
+		}
+		writeJSON(w, 200, File{FileID: "large", Action: ActionUpload})
+	case "/b2api/v2/b2_cancel_large_file":
+		s.cancelled++
+		writeJSON(w, 200, CancelLargeFileResponse{FileId: "large"})
+	default:
+		s.t.Errorf("Unexpected request: %s", r.URL.Path)
+		writeJSON(w, 404, ErrorResponse{Status: 404, Code: ErrCodeNotFound})
+	}
+}
+
+func (s *fakeLargeFileServer) assembled() []byte {
+	var buf bytes.Buffer
+	for i := 1; i <= len(s.parts); i++ {
+		buf.Write(s.parts[i])
+	}
+	return buf.Bytes()
+}
+
+func TestUploadLargeFile(t *testing.T) {
+	// mockAuth uses an AbsoluteMinimumPartSize of 5 and RecommendedPartSize of 10
+	cases := []struct {
+		Name     string
+		Size     int
+		PartSize int64
+		Parts    int
+	}{
+		{"smaller than min part size", 3, 0, 0},
+		{"fits in a single part", 8, 0, 0},
+		{"exactly one part", 10, 0, 0},
+		{"one byte over a part", 11, 0, 2},
+		{"many parts", 35, 0, 4},
+		{"explicit part size", 12, 6, 2},
+		{"part size below min is clamped", 12, 1, 3},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			srv := &fakeLargeFileServer{t: t}
+			clt := mockRetryClient(t, srv.ServeHTTP)
+
+			data := bytes.Repeat([]byte("0123456789"), 4)[:c.Size]
+			_, err := clt.UploadLargeFile(context.Background(), "bucket", UploadFileOptions{
+				FileName: "file.bin",
+				Body:     Closer(bytes.NewReader(data)),
+			}, c.PartSize)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if c.Parts == 0 {
+				if len(srv.uploads) != 1 || srv.started != 0 {
+					t.Fatalf("Expected a simple upload, got %d uploads and %d large files", len(srv.uploads), srv.started)
+				}
+				// simple uploads append the sha1 to the body
+				if !bytes.HasPrefix(srv.uploads[0], data) {
+					t.Fatalf("Expected uploaded content %#v, got: %#v", string(data), string(srv.uploads[0]))
+				}
+				return
+			}
+
+			if srv.started != 1 || srv.finished != 1 {
+				t.Fatalf("Expected large file to be started and finished, got: %d, %d", srv.started, srv.finished)
+			}
+			if len(srv.parts) != c.Parts {
+				t.Fatalf("Expected %d parts, got: %d", c.Parts, len(srv.parts))
+			}
+			if got := srv.assembled(); !bytes.Equal(got, data) {
+				t.Fatalf("Expected assembled content %#v, got: %#v", string(data), string(got))
+			}
+			for i, sum := range srv.partSha1s {
+				if expected := fmt.Sprintf("%x", sha1.Sum(srv.parts[i+1])); sum != expected {
+					t.Fatalf("Expected part %d sha1 %s, got: %s", i+1, expected, sum)
+				}
+			}
+		})
+	}
+}
+
+func TestUploadLargeFileFromFile(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 4)[:35]
+	f, err := ioutil.TempFile("", "b2client-test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// the upload starts at the file's current offset
+	if _, err := f.Seek(5, io.SeekStart); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	srv := &fakeLargeFileServer{t: t}
+	clt := mockRetryClient(t, srv.ServeHTTP)
+	// ContentLength is left unset, so the size is found by seeking
+	_, err = clt.UploadLargeFile(context.Background(), "bucket", UploadFileOptions{FileName: "file.bin", Body: f}, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if srv.finished != 1 || len(srv.parts) != 3 {
+		t.Fatalf("Expected a large file of 3 parts, got %d finished with %d parts", srv.finished, len(srv.parts))
+	}
+	if got := srv.assembled(); !bytes.Equal(got, data[5:]) {
+		t.Fatalf("Expected assembled content %#v, got: %#v", string(data[5:]), string(got))
+	}
+}
+
+func TestUploadLargeFilePlansPartsOnceSizeIsKnown(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), MaxPartCount/10+1)
+	srv := &fakeLargeFileServer{t: t}
+	clt := mockRetryClient(t, srv.ServeHTTP)
+	clt.C.lastAuth.AbsoluteMinimumPartSize = 1
+	clt.C.lastAuth.RecommendedPartSize = 1
+
+	// the size is only known by seeking the body
+	_, err := clt.UploadLargeFileWithOptions(context.Background(), "bucket", UploadFileOptions{
+		FileName:      "file.bin",
+		ContentLength: ContentLengthDetermineUsingTempStorage,
+		Body:          readerAtCloser{bytes.NewReader(data)},
+	}, LargeFileOptions{MaxConcurrentParts: 8})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(srv.parts) > MaxPartCount || !bytes.Equal(srv.assembled(), data) {
+		t.Fatalf("Expected at most %d parts, got: %d", MaxPartCount, len(srv.parts))
+	}
+}
+
+func TestUploadLargeFileStreamsUnknownLength(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	pr, pw := io.Pipe()
+	var written int64
+	go func() {
+		for i := 0; i < len(data); i += 5 {
+			if _, err := pw.Write(data[i : i+5]); err != nil {
+				return
+			}
+			atomic.AddInt64(&written, 5)
+		}
+		pw.Close()
+	}()
+
+	srv := &fakeLargeFileServer{t: t}
+	clt := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload_part" && r.Header.Get("X-Bz-Part-Number") == "1" {
+			// only the first two parts have been read from the pipe
+			if n := atomic.LoadInt64(&written); n > 25 {
+				t.Errorf("Expected the body to be streamed, but %d bytes were read before the first part was uploaded", n)
+			}
+		}
+		srv.ServeHTTP(w, r)
+	})
+
+	_, err := clt.UploadLargeFile(context.Background(), "bucket", UploadFileOptions{
+		FileName:      "stream.bin",
+		ContentLength: ContentLengthDetermineUsingTempStorage,
+		Body:          pr,
+	}, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(srv.parts) != 10 || !bytes.Equal(srv.assembled(), data) {
+		t.Fatalf("Expected 10 parts of the streamed content, got %d: %q", len(srv.parts), srv.assembled())
+	}
+	for i, sum := range srv.partSha1s {
+		if expected := fmt.Sprintf("%x", sha1.Sum(srv.parts[i+1])); sum != expected {
+			t.Fatalf("Expected part %d sha1 %s, got: %s", i+1, expected, sum)
+		}
+	}
+}
+
+func TestUploadLargeFileStreamsPipeFile(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	for _, ts := range []TempStorage{nil, &TempFileStorage{}} {
+		srv := &fakeLargeFileServer{t: t}
+		clt := mockRetryClient(t, srv.ServeHTTP)
+		clt.C.TS = ts
+
+		// an *os.File that implements io.ReaderAt and io.Seeker, but can't use them
+		_, err := clt.UploadLargeFile(context.Background(), "bucket", UploadFileOptions{
+			FileName:      "stream.bin",
+			ContentLength: ContentLengthDetermineUsingTempStorage,
+			Body:          pipeOf(t, string(data)),
+		}, 10)
+		if err != nil {
+			t.Fatalf("Unexpected error with temp storage %T: %s", ts, err)
+		}
+		if len(srv.parts) != 10 || !bytes.Equal(srv.assembled(), data) {
+			t.Fatalf("Expected 10 parts of the piped content with temp storage %T, got %d: %q", ts, len(srv.parts), srv.assembled())
+		}
+	}
+}
+
+func TestUploadLargeFileRetriesPart(t *testing.T) {
+	srv := &fakeLargeFileServer{t: t, failPartAt: 2}
+	clt := mockRetryClient(t, srv.ServeHTTP)
+
+	data := bytes.Repeat([]byte("a"), 25)
+	_, err := clt.UploadLargeFile(context.Background(), "bucket", UploadFileOptions{
+		FileName: "file.bin",
+		Body:     Closer(bytes.NewReader(data)),
+	}, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := srv.assembled(); !bytes.Equal(got, data) {
+		t.Fatalf("Expected assembled content %#v, got: %#v", string(data), string(got))
+	}
+}
+
+func TestUploadLargeFileCancelsOnError(t *testing.T) {
+	srv := &fakeLargeFileServer{t: t}
+	clt := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload_part" {
+			writeJSON(w, 400, ErrorResponse{Status: 400, Code: ErrCodeBadRequest})
+			return
+		}
+		srv.ServeHTTP(w, r)
+	})
+
+	_, err := clt.UploadLargeFile(context.Background(), "bucket", UploadFileOptions{
+		FileName: "file.bin",
+		Body:     Closer(bytes.NewReader(bytes.Repeat([]byte("a"), 25))),
+	}, 0)
+	if err == nil {
+		t.Fatalf("Expected error")
+	}
+	if srv.cancelled != 1 {
+		t.Fatalf("Expected large file to be cancelled, got: %d", srv.cancelled)
+	}
+	if srv.finished != 0 {
+		t.Fatalf("Expected large file to not be finished")
+	}
+}
+
+type readerAtCloser struct{ *bytes.Reader }
+
+func (readerAtCloser) Close() error { return nil }
+
+func TestUploadLargeFileConcurrently(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 10)
+	sources := []struct {
+		Name string
+		Body func() UploadFileOptions
+		TS   TempStorage
+	}{
+		{"memory", func() UploadFileOptions {
+			return UploadFileOptions{Body: Closer(bytes.NewReader(data))}
+		}, nil},
+		{"reader at with content length", func() UploadFileOptions {
+			return UploadFileOptions{Body: readerAtCloser{bytes.NewReader(data)}, ContentLength: int64(len(data))}
+		}, nil},
+		{"reader at with seeker", func() UploadFileOptions {
+			return UploadFileOptions{Body: readerAtCloser{bytes.NewReader(data)}, ContentLength: ContentLengthDetermineUsingTempStorage}
+		}, nil},
+		{"temp storage", func() UploadFileOptions {
+			return UploadFileOptions{Body: Closer(bytes.NewReader(data))}
+		}, &TempFileStorage{}},
+	}
+
+	for _, src := range sources {
+		t.Run(src.Name, func(t *testing.T) {
+			srv := &fakeLargeFileServer{t: t, partDelay: func(n int) time.Duration {
+				// complete earlier parts last
+				return time.Duration(40-n) * time.Millisecond / 4
+			}}
+			clt := mockRetryClient(t, srv.ServeHTTP)
+			clt.C.TS = src.TS
+
+			opt := src.Body()
+			opt.FileName = "file.bin"
+			_, err := clt.UploadLargeFileWithOptions(context.Background(), "bucket", opt, LargeFileOptions{
+				MaxConcurrentParts: 4,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if len(srv.parts) != 36 {
+				t.Fatalf("Expected 36 parts, got: %d", len(srv.parts))
+			}
+			if got := srv.assembled(); !bytes.Equal(got, data) {
+				t.Fatalf("Expected assembled content %#v, got: %#v", string(data), string(got))
+			}
+			if len(srv.partSha1s) != len(srv.parts) {
+				t.Fatalf("Expected %d part sha1s, got: %d", len(srv.parts), len(srv.partSha1s))
+			}
+			for i, sum := range srv.partSha1s {
+				if expected := fmt.Sprintf("%x", sha1.Sum(srv.parts[i+1])); sum != expected {
+					t.Fatalf("Expected part %d sha1 %s, got: %s", i+1, expected, sum)
+				}
+			}
+			if srv.partURLs > 4 {
+				t.Fatalf("Expected upload part urls to be reused, but requested %d", srv.partURLs)
+			}
+		})
+	}
+}
+
+func TestUploadLargeFileProgress(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 35)
+	cases := []struct {
+		Name string
+		Body io.ReadCloser
+	}{
+		{"reader at", readerAtCloser{bytes.NewReader(data)}},
+		{"streamed", ioutil.NopCloser(bytes.NewReader(data))},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			srv := &fakeLargeFileServer{t: t}
+			clt := mockRetryClient(t, srv.ServeHTTP)
+
+			var (
+				m        sync.Mutex
+				last     int64
+				lastSize int64
+			)
+			_, err := clt.UploadLargeFileWithOptions(context.Background(), "bucket", UploadFileOptions{
+				FileName:      "file.bin",
+				Body:          c.Body,
+				ContentLength: int64(len(data)),
+				Progress: func(n, total int64) {
+					m.Lock()
+					defer m.Unlock()
+					last, lastSize = n, total
+				},
+			}, LargeFileOptions{MaxConcurrentParts: 2})
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if last != int64(len(data)) || lastSize != int64(len(data)) {
+				t.Fatalf("Expected final progress %d/%d, got: %d/%d", len(data), len(data), last, lastSize)
+			}
+		})
+	}
+}
+
+func TestUploadPartMaxElapsed(t *testing.T) {
+	attempts := 0
+	var base string
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/b2api/v2/b2_get_upload_part_url":
+			writeJSON(w, 200, UploadURLResponse{FileID: "large", UploadURL: base + "/upload_part", AuthorizationToken: "part-token"})
+		case "/upload_part":
+			attempts++
+			writeJSON(w, 503, ErrorResponse{Status: 503, Code: "service_unavailable"})
+		default:
+			t.Errorf("Unexpected request: %s", r.URL.Path)
+		}
+	})
+	base = c.C.LastAuth().APIURL
+	clock := newFakeClock()
+	c.RC.Clock = clock
+	c.RC.MaxAttempts = 1000
+	c.RC.MaxElapsed = 5 * time.Second
+	c.RC.OnRetry = func(uint32, error, time.Duration) { clock.Advance(time.Second) }
+
+	var pool uploadPartURLPool
+	part := &largeFilePart{Number: 1, Size: 5, content: bytes.NewReader([]byte("hello"))}
+	_, err := c.uploadPart(context.Background(), &pool, "large", part, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "giving up after") {
+		t.Fatalf("Expected MaxElapsed to stop part retries, got: %v", err)
+	}
+	if attempts != 6 {
+		t.Fatalf("Expected 6 attempts within MaxElapsed, got: %d", attempts)
+	}
+}
+
+func TestCleanupUnfinishedLargeFiles(t *testing.T) {
+	clock := newFakeClock()
+	now := clock.Now().UnixNano() / int64(time.Millisecond)
+	hour := int64(time.Hour / time.Millisecond)
+	var cancelled []string
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body := decodeBody(t, r)
+		switch r.URL.Path {
+		case "/b2api/v2/b2_list_unfinished_large_files":
+			if body["startFileId"] == nil {
+				writeJSON(w, 200, ListUnfinishedLargeFilesResponse{
+					Files: []File{
+						{FileID: "old1", FileName: "a", UploadTimestampMillis: now - 48*hour},
+						{FileID: "new1", FileName: "b", UploadTimestampMillis: now - hour},
+					},
+					NextFileID: "next",
+				})
+				return
+			}
+			writeJSON(w, 200, ListUnfinishedLargeFilesResponse{Files: []File{
+				{FileID: "old2", FileName: "c", UploadTimestampMillis: now - 24*hour - 1},
+				{FileID: "new2", FileName: "d", UploadTimestampMillis: now - 24*hour},
+			}})
+		case "/b2api/v2/b2_cancel_large_file":
+			cancelled = append(cancelled, body["fileId"].(string))
+			writeJSON(w, 200, CancelLargeFileResponse{FileId: body["fileId"].(string)})
+		default:
+			t.Errorf("Unexpected request: %s", r.URL.Path)
+		}
+	})
+	c.C.Clock = clock
+
+	n, err := c.CleanupUnfinishedLargeFiles(context.Background(), "bucket", 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n != 2 || fmt.Sprint(cancelled) != "[old1 old2]" {
+		t.Fatalf("Expected only old files to be cancelled, got %d: %v", n, cancelled)
+	}
+}
+
+func TestUploadLargeFileAutoDetectContentType(t *testing.T) {
+	srv := &fakeLargeFileServer{t: t}
+	clt := mockRetryClient(t, srv.ServeHTTP)
+
+	data := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), bytes.Repeat([]byte("a"), 20)...)
+	_, err := clt.UploadLargeFile(context.Background(), "bucket", UploadFileOptions{
+		FileName:              "image",
+		Body:                  Closer(bytes.NewReader(data)),
+		AutoDetectContentType: true,
+	}, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if srv.startContentType != "image/png" {
+		t.Errorf("Expected detected content type, got: %#v", srv.startContentType)
+	}
+	if !bytes.Equal(srv.assembled(), data) {
+		t.Errorf("Expected uploaded parts to match, got: %q", srv.assembled())
+	}
+}
+
+func TestCopyLargeFile(t *testing.T) {
+	defer func(size int64) { maxCopyFileSize = size }(maxCopyFileSize)
+	maxCopyFileSize = 20
+
+	cases := []struct {
+		Name        string
+		Size        int64
+		PartSize    int64
+		Directive   MetadataDirective
+		CopyParts   int
+		ContentType string
+	}{
+		{"under the copy limit", 20, 0, MetadataDirectiveNone, 0, ""},
+		{"over the copy limit", 25, 0, MetadataDirectiveNone, 3, "text/plain"},
+		{"explicit part size", 25, 6, MetadataDirectiveNone, 5, "text/plain"},
+		{"replacing metadata", 21, 0, MetadataDirectiveReplace, 3, "image/png"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			var (
+				copyFiles   int
+				ranges      []string
+				startBody   map[string]interface{}
+				finishSha1s []interface{}
+			)
+			c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+				body := decodeBody(t, r)
+				switch r.URL.Path {
+				case "/b2api/v2/b2_get_file_info":
+					writeJSON(w, 200, File{FileID: "src", BucketID: "src-bucket", ContentLength: tc.Size, ContentType: "text/plain", FileInfo: FileInfo{"author": "src"}})
+				case "/b2api/v2/b2_copy_file":
+					copyFiles++
+					writeJSON(w, 200, File{FileID: "copy"})
+				case "/b2api/v2/b2_start_large_file":
+					startBody = body
+					writeJSON(w, 200, File{FileID: "large", Action: ActionStart})
+				case "/b2api/v2/b2_copy_part":
+					ranges = append(ranges, body["range"].(string))
+					n := int(body["partNumber"].(float64))
+					writeJSON(w, 200, FilePart{FileID: "large", PartNumber: n, ContentSha1: fmt.Sprintf("sha1-%d", n)})
+				case "/b2api/v2/b2_finish_large_file":
+					finishSha1s = body["partSha1Array"].([]interface{})
+					writeJSON(w, 200, File{FileID: "large", Action: ActionUpload})
+				default:
+					t.Errorf("Unexpected request: %s", r.URL.Path)
+				}
+			})
+
+			res, err := c.CopyLargeFile(context.Background(), CopyFileOptions{
+				SourceFileId:      "src",
+				FileName:          "dst",
+				MetadataDirective: tc.Directive,
+				ContentType:       "image/png",
+				FileInfo:          FileInfo{"author": "dst"},
+			}, tc.PartSize)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if tc.CopyParts == 0 {
+				if copyFiles != 1 || res.FileID != "copy" || len(ranges) != 0 {
+					t.Fatalf("Expected a single CopyFile, got %d copies and %d parts", copyFiles, len(ranges))
+				}
+				return
+			}
+			if copyFiles != 0 || len(ranges) != tc.CopyParts {
+				t.Fatalf("Expected %d CopyPart calls, got %d (and %d CopyFile)", tc.CopyParts, len(ranges), copyFiles)
+			}
+			var expectedSha1s []string
+			for i := 1; i <= tc.CopyParts; i++ {
+				expectedSha1s = append(expectedSha1s, fmt.Sprintf("sha1-%d", i))
+			}
+			if fmt.Sprint(finishSha1s) != fmt.Sprint(expectedSha1s) {
+				t.Errorf("Expected part sha1s %v, got: %v", expectedSha1s, finishSha1s)
+			}
+			if last := ranges[len(ranges)-1]; !strings.HasSuffix(last, fmt.Sprintf("-%d", tc.Size-1)) {
+				t.Errorf("Expected the last range to end at the last byte, got: %s", last)
+			}
+			if startBody["bucketId"] != "src-bucket" || startBody["contentType"] != tc.ContentType {
+				t.Errorf("Unexpected start large file request: %#v", startBody)
+			}
+		})
+	}
+}
+
+func TestCollectPartSha1s(t *testing.T) {
+	parts := []FilePart{
+		{PartNumber: 3, ContentSha1: "c"},
+		{PartNumber: 1, ContentSha1: "a"},
+		{PartNumber: 4, ContentSha1: "d"},
+		{PartNumber: 2, ContentSha1: "b"},
+	}
+	if got := CollectPartSha1s(parts); fmt.Sprint(got) != "[a b c d]" {
+		t.Fatalf("Expected sha1s ordered by part number, got: %v", got)
+	}
+	if parts[0].PartNumber != 3 {
+		t.Fatalf("Expected parts to not be modified")
+	}
+	if got := CollectPartSha1s(nil); len(got) != 0 {
+		t.Fatalf("Expected no sha1s, got: %v", got)
+	}
+}
+
+func TestPlanParts(t *testing.T) {
+	const mb = 1000 * 1000
+	cases := []struct {
+		Name            string
+		Total, Min, Rec int64
+		PartSize        int64
+		Count           int
+	}{
+		{"empty", 0, 5 * mb, 100 * mb, 100 * mb, 1},
+		{"tiny", 10, 5 * mb, 100 * mb, 100 * mb, 1},
+		{"unknown size", -1, 5 * mb, 100 * mb, 100 * mb, 0},
+		{"recommended below min", 12 * mb, 5 * mb, 1 * mb, 5 * mb, 3},
+		{"uneven last part", 250 * mb, 5 * mb, 100 * mb, 100 * mb, 3},
+		{"exactly max parts", MaxPartCount * 100 * mb, 5 * mb, 100 * mb, 100 * mb, MaxPartCount},
+		{"one byte over max parts", MaxPartCount*100*mb + 1, 5 * mb, 100 * mb, 100*mb + 1, MaxPartCount},
+		{"needs larger parts", 3 * MaxPartCount * 100 * mb, 5 * mb, 100 * mb, 300 * mb, MaxPartCount},
+	}
+	for _, c := range cases {
+		partSize, count := PlanParts(c.Total, c.Min, c.Rec)
+		if partSize != c.PartSize || count != c.Count {
+			t.Errorf("%s: Expected %d parts of %d, got %d parts of %d", c.Name, c.Count, c.PartSize, count, partSize)
+		}
+		if c.Total > 0 && (int64(count) > MaxPartCount || partSize*int64(count) < c.Total) {
+			t.Errorf("%s: %d parts of %d don't fit %d bytes", c.Name, count, partSize, c.Total)
+		}
+	}
+}
+
+func TestResumeLargeFile(t *testing.T) {
+	data := []byte("0123456789abcdefghijklm")
+	srv := &fakeLargeFileServer{t: t, parts: map[int][]byte{
+		1: data[0:5],
+		3: data[10:15],
+		4: data[15:20],
+	}}
+	c := mockRetryClient(t, srv.ServeHTTP)
+
+	_, err := c.ResumeLargeFile(context.Background(), "large", bytes.NewReader(data), 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if fmt.Sprint(srv.uploaded) != "[2 5]" {
+		t.Errorf("Expected only the missing parts to be uploaded, got: %v", srv.uploaded)
+	}
+	if got := srv.assembled(); !bytes.Equal(got, data) {
+		t.Errorf("Expected assembled file to match, got: %q", got)
+	}
+	if srv.finished != 1 || len(srv.partSha1s) != 5 || srv.partSha1s[4] != fmt.Sprintf("%x", sha1.Sum(data[20:])) {
+		t.Errorf("Expected file to be finished with 5 parts, got: %d, %v", srv.finished, srv.partSha1s)
+	}
+}
+
+func TestResumeLargeFilePartsPastEndOfSource(t *testing.T) {
+	data := []byte("0123456789")
+	srv := &fakeLargeFileServer{t: t, parts: map[int][]byte{
+		1: data[0:5],
+		2: data[5:10],
+		3: []byte("abcde"),
+		4: []byte("fghij"),
+		5: []byte("klm"),
+	}}
+	c := mockRetryClient(t, srv.ServeHTTP)
+
+	for i := 0; i < 5; i++ {
+		_, err := c.ResumeLargeFile(context.Background(), "large", bytes.NewReader(data), 5)
+		if err == nil || !strings.Contains(err.Error(), "part 3 is past the end of source (10 bytes in 2 parts of 5 bytes)") {
+			t.Fatalf("Expected the first part past the end to be reported, got: %v", err)
+		}
+	}
+	if srv.finished != 0 {
+		t.Fatalf("Expected the file to not be finished, got: %d", srv.finished)
+	}
+}
+
+func TestResumeLargeFileEmptySource(t *testing.T) {
+	srv := &fakeLargeFileServer{t: t}
+	c := mockRetryClient(t, srv.ServeHTTP)
+
+	_, err := c.ResumeLargeFile(context.Background(), "large", bytes.NewReader(nil), 5)
+	if err == nil || !strings.Contains(err.Error(), "source is empty") {
+		t.Fatalf("Expected empty source error, got: %v", err)
+	}
+	if len(srv.uploaded) != 0 || srv.finished != 0 {
+		t.Fatalf("Expected nothing to be uploaded or finished, got: %v, %d", srv.uploaded, srv.finished)
+	}
+}
+
+func TestResumeLargeFileMismatchedPart(t *testing.T) {
+	data := []byte("0123456789abcdefghijklm")
+	srv := &fakeLargeFileServer{t: t, parts: map[int][]byte{
+		1: data[0:5],
+		2: []byte("XXXXX"),
+	}}
+	c := mockRetryClient(t, srv.ServeHTTP)
+
+	_, err := c.ResumeLargeFile(context.Background(), "large", bytes.NewReader(data), 5)
+	if err == nil || !strings.Contains(err.Error(), "part 2") {
+		t.Fatalf("Expected mismatched part error, got: %v", err)
+	}
+	if len(srv.uploaded) != 0 || srv.finished != 0 || srv.cancelled != 0 {
+		t.Fatalf("Expected nothing to be uploaded, finished or cancelled, got: %v, %d, %d", srv.uploaded, srv.finished, srv.cancelled)
+	}
+}
@@ -0,0 +1,80 @@
+package b2
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics receives an observation for every HTTP request a Client makes.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// ObserveRequest is called once a request completes. endpoint is the B2
+	// API name (eg - "b2_list_buckets"), status is 0 if no response was
+	// received, and err is the error returned to the caller, if any.
+	ObserveRequest(endpoint string, status int, dur time.Duration, err error)
+}
+
+// MetricsObservation is a single call to Metrics.ObserveRequest
+type MetricsObservation struct {
+	Endpoint string
+	Status   int
+	Duration time.Duration
+	Err      error
+}
+
+// MemoryMetrics is a Metrics implementation that records every observation
+// in memory. Useful for tests.
+type MemoryMetrics struct {
+	m            sync.Mutex
+	observations []MetricsObservation
+}
+
+var _ Metrics = (*MemoryMetrics)(nil)
+
+func (mm *MemoryMetrics) ObserveRequest(endpoint string, status int, dur time.Duration, err error) {
+	mm.m.Lock()
+	defer mm.m.Unlock()
+	mm.observations = append(mm.observations, MetricsObservation{endpoint, status, dur, err})
+}
+
+// Observations returns a copy of all observations recorded so far
+func (mm *MemoryMetrics) Observations() []MetricsObservation {
+	mm.m.Lock()
+	defer mm.m.Unlock()
+	return append([]MetricsObservation(nil), mm.observations...)
+}
+
+// Counts returns the number of observations per endpoint
+func (mm *MemoryMetrics) Counts() map[string]int {
+	mm.m.Lock()
+	defer mm.m.Unlock()
+	counts := make(map[string]int)
+	for _, o := range mm.observations {
+		counts[o.Endpoint]++
+	}
+	return counts
+}
+
+// metricsEndpoint names the B2 API a request is for, without any ids or file
+// names that would make the name unique per request.
+func metricsEndpoint(req *http.Request) string {
+	path := req.URL.Path
+	if strings.HasPrefix(path, "/file/") {
+		return "b2_download_file_by_name"
+	}
+	if i := strings.Index(path, "/b2api/"); i >= 0 {
+		parts := strings.SplitN(path[i+len("/b2api/"):], "/", 3)
+		if len(parts) >= 2 {
+			return parts[1]
+		}
+	}
+	return path
+}
+
+func (c *Client) observe(req *http.Request, status int, start time.Time, err error) {
+	if c.Metrics != nil {
+		c.Metrics.ObserveRequest(metricsEndpoint(req), status, time.Since(start), err)
+	}
+}
@@ -0,0 +1,93 @@
+package b2
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestMetricsObservesEachRequest(t *testing.T) {
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/b2api/v2/b2_list_buckets":
+			writeJSON(w, 200, ListBucketsResponse{})
+		case "/file/bucket/hello.txt":
+			w.Write([]byte("hello"))
+		default:
+			writeJSON(w, 404, ErrorResponse{Status: 404, Code: ErrCodeNotFound, Message: "not found"})
+		}
+	})
+	m := &MemoryMetrics{}
+	c.Metrics = m
+
+	ctx := context.Background()
+	if _, err := c.ListBuckets(ctx, &ListBucketsOptions{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res, err := c.DownloadFileByName(ctx, "bucket", "hello.txt", DownloadFileOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res.Body.Close()
+	if _, err := c.GetFileInfo(ctx, "missing"); err == nil {
+		t.Fatalf("Expected error")
+	}
+
+	obs := m.Observations()
+	expected := []struct {
+		Endpoint string
+		Status   int
+		Err      bool
+	}{
+		{"b2_list_buckets", 200, false},
+		{"b2_download_file_by_name", 200, false},
+		{"b2_get_file_info", 404, true},
+	}
+	if len(obs) != len(expected) {
+		t.Fatalf("Expected %d observations, got: %#v", len(expected), obs)
+	}
+	for i, e := range expected {
+		o := obs[i]
+		if o.Endpoint != e.Endpoint || o.Status != e.Status || (o.Err != nil) != e.Err {
+			t.Errorf("Expected observation %d to be %+v, got: %+v", i, e, o)
+		}
+		if o.Duration <= 0 {
+			t.Errorf("Expected a non-zero duration, got: %+v", o)
+		}
+	}
+	if m.Counts()["b2_list_buckets"] != 1 {
+		t.Errorf("Expected 1 b2_list_buckets count, got: %#v", m.Counts())
+	}
+}
+
+func TestMetricsObservesNetworkErrors(t *testing.T) {
+	m := &MemoryMetrics{}
+	c := &Client{Metrics: m, lastAuth: mockAuth("http://127.0.0.1:1")}
+
+	if _, err := c.ListBuckets(context.Background(), &ListBucketsOptions{}); err == nil {
+		t.Fatalf("Expected error")
+	}
+	obs := m.Observations()
+	if len(obs) != 1 || obs[0].Status != 0 || obs[0].Err == nil {
+		t.Fatalf("Expected one failed observation, got: %#v", obs)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	cases := map[string]string{
+		"https://api.backblazeb2.com/b2api/v2/b2_list_buckets":            "b2_list_buckets",
+		"https://pod-000.backblaze.com/b2api/v2/b2_upload_file/bucket/c0": "b2_upload_file",
+		"https://f000.backblazeb2.com/file/bucket/path/to/file.txt":       "b2_download_file_by_name",
+		"http://127.0.0.1/upload":                                         "/upload",
+	}
+	for rawURL, expected := range cases {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if got := metricsEndpoint(&http.Request{URL: u}); got != expected {
+			t.Errorf("Expected metricsEndpoint(%s) = %q, got: %q", rawURL, expected, got)
+		}
+	}
+}
@@ -7,11 +7,55 @@ import (
 	"time"
 )
 
+// JitterStrategy determines how randomness is applied to exponential
+// backoff. See RetryConfig.Backoff.
+type JitterStrategy int
+
+const (
+	// JitterAdditive adds a random deviation of up to ± RetryConfig.Jitter,
+	// see ExpBackoff. This is the default.
+	JitterAdditive JitterStrategy = iota
+	// JitterNone uses the exponential backoff without randomness
+	JitterNone
+	// JitterFull picks a random backoff between 0 and the exponential backoff
+	JitterFull
+	// JitterEqual keeps half the exponential backoff and randomizes the other
+	// half
+	JitterEqual
+	// JitterDecorrelated picks a random backoff between Min and 3 times the
+	// previous attempt's exponential backoff
+	JitterDecorrelated
+)
+
 type RetryConfig struct {
-	MaxAttempts uint32
-	Jitter      time.Duration
-	Min, Max    time.Duration
-	Unit        time.Duration
+	MaxAttempts    uint32
+	Jitter         time.Duration
+	JitterStrategy JitterStrategy
+	Min, Max       time.Duration
+	Unit           time.Duration
+
+	// MaxElapsed stops retrying once this much time has passed since the
+	// first attempt, regardless of MaxAttempts. Optional, 0 = no limit.
+	MaxElapsed time.Duration
+
+	// OnRetry is called before sleeping to retry a request that failed with
+	// err. Optional, useful for metrics or reporting progress.
+	OnRetry func(attempt uint32, err error, sleep time.Duration)
+
+	// RetryCapExceeded retries requests that fail because an account cap was
+	// exceeded. By default they fail immediately since caps don't reset
+	// quickly.
+	RetryCapExceeded bool
+
+	// Clock is used for sleeping between attempts and MaxElapsed. Optional,
+	// defaults to the Client's Clock.
+	Clock Clock
+
+	// Rand is the source of randomness for jitter. Must be safe for
+	// concurrent use if the client is, see NewLockedSource. Optional,
+	// defaults to a source seeded from the current time that's owned by
+	// the RetryClient.
+	Rand rand.Source
 }
 
 func (rc *RetryConfig) getMaxAttempts() uint32 {
@@ -32,7 +76,7 @@ func (rc *RetryConfig) getMin() time.Duration {
 	if rc.Min == 0 {
 		return 1 * time.Second
 	}
-	return rc.Jitter
+	return rc.Min
 }
 
 func (rc *RetryConfig) getUnit() time.Duration {
@@ -42,9 +86,15 @@ func (rc *RetryConfig) getUnit() time.Duration {
 	return rc.Unit
 }
 
+// AttemptExpBackoff computes the backoff for the current value of attempt and
+// increments it. Returns false once attempt has reached maxAttempts, indicating
+// that no more attempts should be made.
+//
+// Example: with maxAttempts = 3, attempts 0, 1, 2 return a backoff and true,
+// then attempt 3 returns (0, false).
 func AttemptExpBackoff(attempt *uint32, maxAttempts uint32, maxDev, min, max, unit time.Duration) (time.Duration, bool) {
-	at := *attempt
-	if maxAttempts >= at {
+	at := atomic.LoadUint32(attempt)
+	if at >= maxAttempts {
 		return 0, false
 	}
 	d := ExpBackoff(at, maxDev, min, max, unit)
@@ -53,7 +103,7 @@ func AttemptExpBackoff(attempt *uint32, maxAttempts uint32, maxDev, min, max, un
 }
 
 // ExpBackoff computes the amount of time to sleep using the following formula:
-//        amt = (2^attempt + rand(-maxDev, maxDev)) * unit
+//        amt = 2^attempt * unit + rand(-maxDev, maxDev)
 //        return MIN(MAX(amt, min), max)
 //
 // Example: ExpBackoff(1, 100*time.Millisecond, 1 * time.Millisecond, 30 * time.Second, time.Millisecond)
@@ -63,9 +113,12 @@ func AttemptExpBackoff(attempt *uint32, maxAttempts uint32, maxDev, min, max, un
 //          with a max backoff of 30s
 //          multiplier factor of 1ms
 func ExpBackoff(attempt uint32, maxDev, min, max, unit time.Duration) time.Duration {
-	dev := time.Duration(rand.Int63n(int64(maxDev*2+1)) + int64(maxDev))
-	value := time.Duration(math.Pow(2, float64(attempt))) + dev
-	value *= unit
+	return expBackoff(rand.New(defaultSource), attempt, maxDev, min, max, unit)
+}
+
+func expBackoff(r *rand.Rand, attempt uint32, maxDev, min, max, unit time.Duration) time.Duration {
+	dev := time.Duration(r.Int63n(int64(maxDev*2+1)) - int64(maxDev))
+	value := expDuration(attempt, unit, max) + dev
 	if value < min {
 		return min
 	}
@@ -74,3 +127,71 @@ func ExpBackoff(attempt uint32, maxDev, min, max, unit time.Duration) time.Durat
 	}
 	return value
 }
+
+// Backoff computes the amount of time to sleep before retrying the given
+// attempt according to JitterStrategy. The result is always within
+// [Min, Max], ignoring Max if it is 0.
+//
+// The exponential backoff for an attempt is 2^attempt * Unit. With the
+// defaults, that's 1s, 2s, 4s, ... ± 1s of jitter.
+func (rc *RetryConfig) Backoff(attempt uint32) time.Duration {
+	src := rc.Rand
+	if src == nil {
+		src = defaultSource
+	}
+	return rc.backoff(attempt, src)
+}
+
+// backoff is Backoff using src for randomness
+func (rc *RetryConfig) backoff(attempt uint32, src rand.Source) time.Duration {
+	min, max, unit := rc.getMin(), rc.Max, rc.getUnit()
+	r := rand.New(src)
+	var value time.Duration
+	switch rc.JitterStrategy {
+	case JitterNone:
+		value = expDuration(attempt, unit, max)
+	case JitterFull:
+		value = randDuration(r, 0, expDuration(attempt, unit, max))
+	case JitterEqual:
+		half := expDuration(attempt, unit, max) / 2
+		value = half + randDuration(r, 0, half)
+	case JitterDecorrelated:
+		prev := expDuration(attempt, unit, max) / 2
+		hi := 3 * prev
+		if hi < min {
+			hi = min
+		}
+		value = randDuration(r, min, hi)
+	default:
+		return expBackoff(r, attempt, rc.getJitter(), min, max, unit)
+	}
+	if value < min {
+		return min
+	}
+	if max != 0 && value > max {
+		return max
+	}
+	return value
+}
+
+// expDuration returns 2^attempt * unit, limited to max (if non-zero) and to
+// avoid overflowing.
+func expDuration(attempt uint32, unit, max time.Duration) time.Duration {
+	limit := float64(math.MaxInt64 / 4)
+	if max != 0 {
+		limit = float64(max)
+	}
+	value := math.Pow(2, float64(attempt)) * float64(unit)
+	if value > limit {
+		value = limit
+	}
+	return time.Duration(value)
+}
+
+// randDuration returns a random duration in [lo, hi]
+func randDuration(r *rand.Rand, lo, hi time.Duration) time.Duration {
+	if hi <= lo {
+		return lo
+	}
+	return lo + time.Duration(r.Int63n(int64(hi-lo)+1))
+}
@@ -0,0 +1,164 @@
+package b2
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRetryConfigMin(t *testing.T) {
+	cases := []struct {
+		Name     string
+		RC       RetryConfig
+		Expected time.Duration
+	}{
+		{"zero uses default", RetryConfig{}, time.Second},
+		{"zero ignores jitter", RetryConfig{Jitter: 5 * time.Second}, time.Second},
+		{"explicit min", RetryConfig{Min: 5 * time.Millisecond}, 5 * time.Millisecond},
+		{"explicit min ignores jitter", RetryConfig{Min: 5 * time.Millisecond, Jitter: time.Minute}, 5 * time.Millisecond},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if got := c.RC.getMin(); got != c.Expected {
+				t.Fatalf("Expected getMin() = %s, got: %s", c.Expected, got)
+			}
+
+			// attempt 0 without jitter yields 1 unit, which is below every min above
+			got := ExpBackoff(0, 0, c.RC.getMin(), 0, time.Microsecond)
+			if got != c.Expected {
+				t.Fatalf("Expected ExpBackoff to clamp to min %s, got: %s", c.Expected, got)
+			}
+		})
+	}
+}
+
+func TestAttemptExpBackoff(t *testing.T) {
+	const maxAttempts = 3
+	attempt := uint32(0)
+	for i := uint32(0); i < maxAttempts; i++ {
+		d, ok := AttemptExpBackoff(&attempt, maxAttempts, 0, time.Millisecond, time.Second, time.Millisecond)
+		if !ok {
+			t.Fatalf("Expected attempt %d to be allowed", i)
+		}
+		if d < time.Millisecond || d > time.Second {
+			t.Fatalf("Expected backoff within [min, max], got: %s", d)
+		}
+		if attempt != i+1 {
+			t.Fatalf("Expected attempt counter to be incremented to %d, got: %d", i+1, attempt)
+		}
+	}
+
+	d, ok := AttemptExpBackoff(&attempt, maxAttempts, 0, time.Millisecond, time.Second, time.Millisecond)
+	if ok || d != 0 {
+		t.Fatalf("Expected (0, false) after %d attempts, got: (%s, %v)", maxAttempts, d, ok)
+	}
+	if attempt != maxAttempts {
+		t.Fatalf("Expected attempt counter to stop at %d, got: %d", maxAttempts, attempt)
+	}
+}
+
+func TestRetryConfigBackoff(t *testing.T) {
+	const (
+		min  = time.Millisecond
+		max  = time.Second
+		unit = 10 * time.Millisecond
+	)
+	cases := []struct {
+		Strategy JitterStrategy
+		Attempt  uint32
+		Lo, Hi   time.Duration
+	}{
+		{JitterNone, 0, unit, unit},
+		{JitterNone, 3, 8 * unit, 8 * unit},
+		{JitterNone, 20, max, max},
+		{JitterFull, 0, min, unit},
+		{JitterFull, 3, min, 8 * unit},
+		{JitterFull, 20, min, max},
+		{JitterEqual, 0, unit / 2, unit},
+		{JitterEqual, 3, 4 * unit, 8 * unit},
+		{JitterEqual, 20, max / 2, max},
+		{JitterDecorrelated, 0, min, 3 * unit / 2},
+		{JitterDecorrelated, 3, min, 12 * unit},
+		{JitterDecorrelated, 20, min, max},
+		// the default adds up to ± Jitter, see ExpBackoff
+		{JitterAdditive, 0, min, 2 * unit},
+		{JitterAdditive, 3, 7 * unit, 9 * unit},
+		{JitterAdditive, 20, max - unit, max},
+	}
+
+	for _, c := range cases {
+		rc := RetryConfig{JitterStrategy: c.Strategy, Jitter: unit, Min: min, Max: max, Unit: unit}
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 1000; i++ {
+			d := rc.Backoff(c.Attempt)
+			if d < c.Lo || d > c.Hi {
+				t.Fatalf("Expected strategy %d attempt %d backoff within [%s, %s], got: %s", c.Strategy, c.Attempt, c.Lo, c.Hi, d)
+			}
+			seen[d] = true
+		}
+		if c.Lo != c.Hi && len(seen) < 2 {
+			t.Errorf("Expected strategy %d attempt %d to be randomized, got: %v", c.Strategy, c.Attempt, seen)
+		}
+	}
+}
+
+func TestRetryConfigBackoffDefaults(t *testing.T) {
+	var rc RetryConfig
+	for attempt := uint32(0); attempt < rc.getMaxAttempts(); attempt++ {
+		lo := time.Duration(1<<attempt)*time.Second - time.Second
+		if lo < time.Second {
+			lo = time.Second
+		}
+		hi := time.Duration(1<<attempt)*time.Second + time.Second
+		for i := 0; i < 100; i++ {
+			if d := rc.Backoff(attempt); d < lo || d > hi {
+				t.Fatalf("Expected attempt %d backoff within [%s, %s], got: %s", attempt, lo, hi, d)
+			}
+		}
+	}
+}
+
+func TestRetryConfigBackoffDoesNotOverflow(t *testing.T) {
+	for _, s := range []JitterStrategy{JitterAdditive, JitterNone, JitterFull, JitterEqual, JitterDecorrelated} {
+		rc := RetryConfig{JitterStrategy: s}
+		if d := rc.Backoff(1000); d < rc.getMin() {
+			t.Fatalf("Expected strategy %d to not overflow, got: %s", s, d)
+		}
+	}
+}
+
+func TestRetryConfigBackoffWithSeededRand(t *testing.T) {
+	const unit = time.Millisecond
+	const jitter = unit / 4
+	rc := RetryConfig{Jitter: jitter, Min: unit / 2, Max: time.Second, Unit: unit, Rand: rand.NewSource(42)}
+	r := rand.New(rand.NewSource(42))
+	for attempt := uint32(0); attempt < 5; attempt++ {
+		dev := time.Duration(r.Int63n(int64(2*jitter+1)) - int64(jitter))
+		expected := time.Duration(1<<attempt)*unit + dev
+		if got := rc.Backoff(attempt); got != expected {
+			t.Fatalf("Expected attempt %d backoff to be %s, got: %s", attempt, expected, got)
+		}
+	}
+
+	def := RetryConfig{Rand: rand.NewSource(42)}
+	r = rand.New(rand.NewSource(42))
+	for attempt := uint32(0); attempt < 3; attempt++ {
+		dev := time.Duration(r.Int63n(int64(2*time.Second+1)) - int64(time.Second))
+		expected := time.Duration(1<<attempt)*time.Second + dev
+		if expected < time.Second {
+			expected = time.Second
+		}
+		if got := def.Backoff(attempt); got != expected {
+			t.Fatalf("Expected default attempt %d backoff to be %s, got: %s", attempt, expected, got)
+		}
+	}
+
+	a := RetryConfig{JitterStrategy: JitterFull, Unit: unit, Min: unit, Rand: NewLockedSource(7)}
+	b := RetryConfig{JitterStrategy: JitterFull, Unit: unit, Min: unit, Rand: NewLockedSource(7)}
+	for attempt := uint32(0); attempt < 10; attempt++ {
+		if da, db := a.Backoff(attempt), b.Backoff(attempt); da != db {
+			t.Fatalf("Expected identically seeded backoffs to match at attempt %d: %s != %s", attempt, da, db)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package b2
+
+import (
+	"context"
+)
+
+// ListAllFileNames calls fn for every file returned by ListFileNames,
+// following NextFileName until all pages have been listed. Listing stops
+// early if fn returns an error, which is returned. Authorizes as needed.
+func (c *RetryClient) ListAllFileNames(ctx context.Context, bucketId string, opt *ListFileNamesOptions, fn func(File) error) error {
+	var o ListFileNamesOptions
+	if opt != nil {
+		o = *opt
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		res, err := c.ListFileNames(ctx, bucketId, &o)
+		if err != nil {
+			return err
+		}
+		for _, f := range res.Files {
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+		if res.NextFileName == "" {
+			return nil
+		}
+		o.StartFileName = res.NextFileName
+	}
+}
+
+// ListFolder lists the latest version of files directly within prefix,
+// treating "/" as a folder separator like a filesystem. Files in nested
+// folders aren't listed, instead their folders are returned as subfolder
+// prefixes (eg - "photos/2020/"). prefix should be empty or end in "/".
+// Authorizes as needed.
+func (c *RetryClient) ListFolder(ctx context.Context, bucketId, prefix string) (files []File, folders []string, err error) {
+	err = c.ListAllFileNames(ctx, bucketId, &ListFileNamesOptions{Prefix: prefix, Delimiter: "/"}, func(f File) error {
+		if f.Action == ActionFolder {
+			folders = append(folders, f.FileName)
+		} else {
+			files = append(files, f)
+		}
+		return nil
+	})
+	return files, folders, err
+}
+
+// WalkFiles calls fn for the latest version of every file under prefix,
+// descending into virtual folders as they're listed, so files are visited in
+// lexical order like filepath.Walk. Walking stops at the first error from fn
+// or when ctx is done, returning that error. Authorizes as needed.
+func (c *RetryClient) WalkFiles(ctx context.Context, bucketId, prefix string, fn func(File) error) error {
+	return c.ListAllFileNames(ctx, bucketId, &ListFileNamesOptions{Prefix: prefix, Delimiter: "/"}, func(f File) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if f.Action == ActionFolder {
+			return c.WalkFiles(ctx, bucketId, f.FileName, fn)
+		}
+		return fn(f)
+	})
+}
+
+// ListAllFileVersions calls fn for every file version returned by
+// ListFileVersions, following NextFileName and NextFileID until all pages
+// have been listed. Listing stops early if fn returns an error, which is
+// returned. Authorizes as needed.
+func (c *RetryClient) ListAllFileVersions(ctx context.Context, bucketId string, opt *ListFileVersionsOptions, fn func(File) error) error {
+	var o ListFileVersionsOptions
+	if opt != nil {
+		o = *opt
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		res, err := c.ListFileVersions(ctx, bucketId, &o)
+		if err != nil {
+			return err
+		}
+		for _, f := range res.Files {
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+		if res.NextFileName == "" && res.NextFileID == "" {
+			return nil
+		}
+		o.StartFileName = res.NextFileName
+		o.StartFileId = res.NextFileID
+	}
+}
+
+// ListAllKeys calls fn for every key returned by ListKeys, following
+// NextAppKeyId until all pages have been listed. Listing stops early if fn
+// returns an error, which is returned. Authorizes as needed.
+func (c *RetryClient) ListAllKeys(ctx context.Context, opt ListKeysOptions, fn func(Key) error) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		res, err := c.ListKeys(ctx, opt)
+		if err != nil {
+			return err
+		}
+		for _, k := range res.Keys {
+			if err := fn(k); err != nil {
+				return err
+			}
+		}
+		if res.NextAppKeyId == "" {
+			return nil
+		}
+		opt.StartAppKeyId = res.NextAppKeyId
+	}
+}
+
+// ListAllUnfinishedLargeFiles calls fn for every large file returned by
+// ListUnfinishedLargeFiles, following NextFileID until all pages have been
+// listed. Listing stops early if fn returns an error, which is returned.
+// Authorizes as needed.
+func (c *RetryClient) ListAllUnfinishedLargeFiles(ctx context.Context, bucketId string, opt ListUnfinishedLargeFilesOptions, fn func(File) error) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		res, err := c.ListUnfinishedLargeFiles(ctx, bucketId, opt)
+		if err != nil {
+			return err
+		}
+		for _, f := range res.Files {
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+		if res.NextFileID == "" {
+			return nil
+		}
+		opt.StartFileId = res.NextFileID
+	}
+}
+
+// ListAllParts calls fn with every uploaded part of an unfinished large file,
+// in part number order, requesting pages until there are none left or fn
+// returns an error. Authorizes as needed.
+func (c *RetryClient) ListAllParts(ctx context.Context, fileId string, opt ListPartsOptions, fn func(FilePart) error) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		res, err := c.ListParts(ctx, fileId, opt)
+		if err != nil {
+			return err
+		}
+		for _, p := range res.Parts {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		if res.NextPartNumber == 0 {
+			return nil
+		}
+		next := res.NextPartNumber
+		opt.StartPartNumber = &next
+	}
+}
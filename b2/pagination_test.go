@@ -0,0 +1,360 @@
+package b2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestListAllFileNames(t *testing.T) {
+	var requests []map[string]interface{}
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body := decodeBody(t, r)
+		requests = append(requests, body)
+		switch body["startFileName"] {
+		case nil:
+			writeJSON(w, 200, ListFileNamesResponse{
+				Files:        []File{{FileName: "a/1"}, {FileName: "a/2"}},
+				NextFileName: "a/3",
+			})
+		case "a/3":
+			writeJSON(w, 200, ListFileNamesResponse{
+				Files: []File{{FileName: "a/3"}},
+			})
+		default:
+			t.Errorf("Unexpected startFileName: %#v", body["startFileName"])
+		}
+	})
+
+	var names []string
+	err := c.ListAllFileNames(context.Background(), "bucket", &ListFileNamesOptions{Prefix: "a/", Delimiter: "/"}, func(f File) error {
+		names = append(names, f.FileName)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []string{"a/1", "a/2", "a/3"}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected %#v, got: %#v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Fatalf("Expected %#v, got: %#v", expected, names)
+		}
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got: %d", len(requests))
+	}
+	for _, req := range requests {
+		if req["prefix"] != "a/" || req["delimiter"] != "/" {
+			t.Fatalf("Expected prefix and delimiter to be sent on every page, got: %#v", req)
+		}
+	}
+}
+
+func TestListAllFileNamesStopsEarly(t *testing.T) {
+	requests := 0
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		writeJSON(w, 200, ListFileNamesResponse{
+			Files:        []File{{FileName: "1"}, {FileName: "2"}},
+			NextFileName: "3",
+		})
+	})
+
+	stop := errors.New("stop")
+	err := c.ListAllFileNames(context.Background(), "bucket", nil, func(f File) error { return stop })
+	if err != stop {
+		t.Fatalf("Expected callback error, got: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = c.ListAllFileNames(ctx, "bucket", nil, func(f File) error {
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got: %v", err)
+	}
+	if requests != 2 {
+		t.Fatalf("Expected 2 requests, got: %d", requests)
+	}
+}
+
+func TestListFolder(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body := decodeBody(t, r)
+		if body["prefix"] != "photos/" || body["delimiter"] != "/" {
+			t.Errorf("Expected folder listing, got: %#v", body)
+		}
+		switch body["startFileName"] {
+		case nil:
+			writeJSON(w, 200, ListFileNamesResponse{
+				Files: []File{
+					{FileName: "photos/2019/", Action: ActionFolder},
+					{FileName: "photos/a.jpg", Action: ActionUpload},
+				},
+				NextFileName: "photos/b.jpg",
+			})
+		default:
+			writeJSON(w, 200, ListFileNamesResponse{
+				Files: []File{
+					{FileName: "photos/b.jpg", Action: ActionUpload},
+					{FileName: "photos/c/", Action: ActionFolder},
+				},
+			})
+		}
+	})
+
+	files, folders, err := c.ListFolder(context.Background(), "bucket", "photos/")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(files) != 2 || files[0].FileName != "photos/a.jpg" || files[1].FileName != "photos/b.jpg" {
+		t.Errorf("Unexpected files: %#v", files)
+	}
+	if len(folders) != 2 || folders[0] != "photos/2019/" || folders[1] != "photos/c/" {
+		t.Errorf("Unexpected folders: %#v", folders)
+	}
+}
+
+func TestWalkFiles(t *testing.T) {
+	tree := map[string][]File{
+		"": {
+			{FileName: "a.txt"},
+			{FileName: "b/", Action: ActionFolder},
+			{FileName: "c.txt"},
+		},
+		"b/": {
+			{FileName: "b/1.txt"},
+			{FileName: "b/d/", Action: ActionFolder},
+			{FileName: "b/e.txt"},
+		},
+		"b/d/": {
+			{FileName: "b/d/2.txt"},
+		},
+	}
+	var prefixes []string
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body := decodeBody(t, r)
+		prefix, _ := body["prefix"].(string)
+		if body["delimiter"] != "/" {
+			t.Errorf("Expected folder listing, got: %#v", body)
+		}
+		prefixes = append(prefixes, prefix)
+		writeJSON(w, 200, ListFileNamesResponse{Files: tree[prefix]})
+	})
+	ctx := context.Background()
+
+	var names []string
+	err := c.WalkFiles(ctx, "bucket", "", func(f File) error {
+		names = append(names, f.FileName)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if got := strings.Join(names, ","); got != "a.txt,b/1.txt,b/d/2.txt,b/e.txt,c.txt" {
+		t.Fatalf("Unexpected traversal order: %s", got)
+	}
+	if got := strings.Join(prefixes, ","); got != ",b/,b/d/" {
+		t.Fatalf("Unexpected prefixes listed: %s", got)
+	}
+
+	stop := errors.New("stop")
+	names, prefixes = nil, nil
+	err = c.WalkFiles(ctx, "bucket", "", func(f File) error {
+		names = append(names, f.FileName)
+		if f.FileName == "b/1.txt" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Fatalf("Expected fn's error, got: %v", err)
+	}
+	if got := strings.Join(names, ","); got != "a.txt,b/1.txt" || len(prefixes) != 2 {
+		t.Fatalf("Expected walking to stop early, got %s after listing %v", got, prefixes)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	names = nil
+	err = c.WalkFiles(cctx, "bucket", "", func(f File) error {
+		names = append(names, f.FileName)
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || len(names) != 1 {
+		t.Fatalf("Expected walking to stop when cancelled, got: %v after %v", err, names)
+	}
+}
+
+func TestListAllFileVersions(t *testing.T) {
+	var requests []map[string]interface{}
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body := decodeBody(t, r)
+		requests = append(requests, body)
+		switch body["startFileId"] {
+		case nil:
+			writeJSON(w, 200, ListFileVersionsResponse{
+				Files:        []File{{FileName: "a", FileID: "a3"}, {FileName: "a", FileID: "a2"}},
+				NextFileName: "a",
+				NextFileID:   "a1",
+			})
+		case "a1":
+			if body["startFileName"] != "a" {
+				t.Errorf("Expected startFileName to follow the cursor, got: %#v", body["startFileName"])
+			}
+			writeJSON(w, 200, ListFileVersionsResponse{
+				Files:        []File{{FileName: "a", FileID: "a1"}},
+				NextFileName: "b",
+				NextFileID:   "b1",
+			})
+		case "b1":
+			writeJSON(w, 200, ListFileVersionsResponse{
+				Files: []File{{FileName: "b", FileID: "b1"}},
+			})
+		default:
+			t.Errorf("Unexpected startFileId: %#v", body["startFileId"])
+		}
+	})
+
+	var ids []string
+	err := c.ListAllFileVersions(context.Background(), "bucket", &ListFileVersionsOptions{Prefix: "a"}, func(f File) error {
+		ids = append(ids, f.FileID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []string{"a3", "a2", "a1", "b1"}
+	if len(ids) != len(expected) {
+		t.Fatalf("Expected %#v, got: %#v", expected, ids)
+	}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Fatalf("Expected %#v, got: %#v", expected, ids)
+		}
+	}
+	for _, req := range requests {
+		if req["prefix"] != "a" {
+			t.Fatalf("Expected prefix to be sent on every page, got: %#v", req)
+		}
+	}
+}
+
+func TestListAllFileVersionsCancelled(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 200, ListFileVersionsResponse{
+			Files:        []File{{FileName: "a", FileID: "a1"}},
+			NextFileName: "a",
+			NextFileID:   "a0",
+		})
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	count := 0
+	err := c.ListAllFileVersions(ctx, "bucket", nil, func(f File) error {
+		count++
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got: %v", err)
+	}
+	if count != 1 {
+		t.Fatalf("Expected listing to stop after cancellation, got %d files", count)
+	}
+}
+
+func TestListAllKeys(t *testing.T) {
+	requests := 0
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body := decodeBody(t, r)
+		if body["accountId"] != "test-account" {
+			t.Errorf("Expected accountId to be sent, got: %#v", body["accountId"])
+		}
+		switch body["startApplicationKeyId"] {
+		case nil:
+			writeJSON(w, 200, ListKeysResponse{
+				Keys:         []Key{{ApplicationKeyID: "k1"}, {ApplicationKeyID: "k2"}},
+				NextAppKeyId: "k3",
+			})
+		case "k3":
+			writeJSON(w, 200, ListKeysResponse{
+				Keys: []Key{{ApplicationKeyID: "k3"}},
+			})
+		default:
+			t.Errorf("Unexpected startApplicationKeyId: %#v", body["startApplicationKeyId"])
+		}
+	})
+
+	var ids []string
+	err := c.ListAllKeys(context.Background(), ListKeysOptions{}, func(k Key) error {
+		ids = append(ids, k.ApplicationKeyID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if len(ids) != 3 || ids[0] != "k1" || ids[1] != "k2" || ids[2] != "k3" {
+		t.Fatalf("Expected all keys to be listed, got: %#v", ids)
+	}
+	if requests != 2 {
+		t.Fatalf("Expected an empty NextAppKeyId to stop listing after 2 requests, got: %d", requests)
+	}
+}
+
+func TestListAllUnfinishedLargeFiles(t *testing.T) {
+	var requests []map[string]interface{}
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body := decodeBody(t, r)
+		requests = append(requests, body)
+		switch body["startFileId"] {
+		case nil:
+			writeJSON(w, 200, ListUnfinishedLargeFilesResponse{
+				Files:      []File{{FileID: "1"}, {FileID: "2"}},
+				NextFileID: "3",
+			})
+		case "3":
+			writeJSON(w, 200, ListUnfinishedLargeFilesResponse{Files: []File{{FileID: "3"}}})
+		default:
+			t.Errorf("Unexpected startFileId: %#v", body["startFileId"])
+		}
+	})
+
+	var ids []string
+	err := c.ListAllUnfinishedLargeFiles(context.Background(), "bucket", ListUnfinishedLargeFilesOptions{MaxFileCount: 2}, func(f File) error {
+		ids = append(ids, f.FileID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(ids) != 3 || ids[0] != "1" || ids[2] != "3" {
+		t.Fatalf("Expected files 1, 2, 3, got: %#v", ids)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("Expected 2 requests, got: %d", len(requests))
+	}
+	for _, req := range requests {
+		if req["maxFileCount"] != 2.0 {
+			t.Fatalf("Expected maxFileCount to be sent, got: %#v", req)
+		}
+		if _, ok := req["maxPartCount"]; ok {
+			t.Fatalf("Expected maxPartCount to not be sent, got: %#v", req)
+		}
+		if _, ok := req["namePrefix"]; ok {
+			t.Fatalf("Expected empty namePrefix to be omitted, got: %#v", req)
+		}
+	}
+}
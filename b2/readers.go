@@ -6,14 +6,25 @@ import (
 	"io"
 )
 
+// HashedPostfixedReader reads R and appends the hex encoded hash of its
+// contents, as expected by B2 when using Sha1AtEnd.
 type HashedPostfixedReader struct {
 	R io.ReadCloser
 	H hash.Hash
 
 	finished bool
 	hexRem   []byte
+	n        int64
+	sum      []byte
 }
 
+// BytesRead returns the number of bytes read from R so far, excluding the
+// appended hash.
+func (r *HashedPostfixedReader) BytesRead() int64 { return r.n }
+
+// Sum returns the hash of R's contents, or nil if R hasn't been fully read yet.
+func (r *HashedPostfixedReader) Sum() []byte { return r.sum }
+
 func (r *HashedPostfixedReader) Read(p []byte) (int, error) {
 	if r.finished {
 		rem := copy(p, r.hexRem)
@@ -28,10 +39,12 @@ func (r *HashedPostfixedReader) Read(p []byte) (int, error) {
 	n, err := r.R.Read(p)
 	if n > 0 {
 		r.H.Write(p[:n])
+		r.n += int64(n)
 	}
 	if err == io.EOF {
 		r.finished = true
-		r.hexRem = []byte(fmt.Sprintf("%x", r.H.Sum(nil)))
+		r.sum = r.H.Sum(nil)
+		r.hexRem = []byte(fmt.Sprintf("%x", r.sum))
 		if n < len(p) {
 			rem := copy(p[n:], r.hexRem)
 			r.hexRem = r.hexRem[rem:]
@@ -49,3 +62,29 @@ func (r *HashedPostfixedReader) Read(p []byte) (int, error) {
 func (r *HashedPostfixedReader) Close() error {
 	return r.R.Close()
 }
+
+// ProgressFunc is called with the number of bytes transferred so far and the
+// total number of bytes expected, or -1 if the total is unknown.
+type ProgressFunc func(bytesTransferred, totalBytes int64)
+
+// progressReader reports the number of bytes read from R to Fn.
+type progressReader struct {
+	R     io.ReadCloser
+	Fn    ProgressFunc
+	Total int64 // -1 if unknown
+
+	n int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.R.Read(p)
+	if n > 0 {
+		r.n += int64(n)
+		r.Fn(r.n, r.Total)
+	}
+	return n, err
+}
+
+func (r *progressReader) Close() error {
+	return r.R.Close()
+}
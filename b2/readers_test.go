@@ -3,7 +3,9 @@ package b2
 import (
 	"bytes"
 	"crypto/sha1"
+	"io"
 	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -34,3 +36,88 @@ func TestPostfixingSha1_Empty(t *testing.T) {
 		t.Fatalf("Expected %#v != %#v", string(b), expected)
 	}
 }
+
+func TestPostfixingSha1_BytesReadAndSum(t *testing.T) {
+	content := bytes.Repeat([]byte("hello world"), 1000)
+	r := &HashedPostfixedReader{R: Closer(bytes.NewReader(content)), H: sha1.New()}
+	if r.Sum() != nil {
+		t.Fatalf("Expected nil Sum before EOF, got: %x", r.Sum())
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if r.BytesRead() != int64(len(content)) {
+		t.Fatalf("Expected BytesRead = %d, got: %d", len(content), r.BytesRead())
+	}
+	expected := sha1.Sum(content)
+	if !bytes.Equal(r.Sum(), expected[:]) {
+		t.Fatalf("Expected Sum = %x, got: %x", expected, r.Sum())
+	}
+}
+
+func TestReaderLengthSeekable(t *testing.T) {
+	f, err := ioutil.TempFile("", "b2client-test")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.WriteString("hello world"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, err := f.Seek(6, io.SeekStart); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	r, n, err := readerLength(nil, f)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if r != io.ReadCloser(f) {
+		t.Fatalf("Expected seekable reader to be used without buffering")
+	}
+	if n != 5 {
+		t.Fatalf("Expected remaining length of 5, got: %d", n)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "world" {
+		t.Fatalf("Expected reader position to be preserved, got: %#v", string(b))
+	}
+}
+
+func TestReaderLengthPipe(t *testing.T) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	go func() {
+		pw.WriteString("hello world")
+		pw.Close()
+	}()
+
+	r, n, err := readerLength(nil, pr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if n != 11 {
+		t.Fatalf("Expected length of 11, got: %d", n)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "hello world" {
+		t.Fatalf("Expected pipe contents to be buffered, got: %#v", string(b))
+	}
+}
+
+func TestProgressReaderUnknownTotal(t *testing.T) {
+	var reported, total int64
+	r := &progressReader{R: Closer(bytes.NewBufferString("hello")), Total: -1, Fn: func(n, t int64) {
+		reported, total = n, t
+	}}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if reported != 5 || total != -1 {
+		t.Fatalf("Expected progress 5/-1, got: %d/%d", reported, total)
+	}
+}
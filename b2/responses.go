@@ -7,7 +7,8 @@ type AuthorizeAccountResponse struct {
 	Allowed                 AuthorizeAcccountCapabilities `json:"allowed"`
 	APIURL                  string                        `json:"apiUrl"`
 	AuthorizationToken      string                        `json:"authorizationToken"`
-	DownloadURL             string                        `json:"downloadURL"`
+	DownloadURL             string                        `json:"downloadUrl"`
+	S3APIURL                string                        `json:"s3ApiUrl"` // regional endpoint for S3 compatible clients
 }
 
 type AuthorizeAcccountCapabilities struct {
@@ -17,11 +18,25 @@ type AuthorizeAcccountCapabilities struct {
 	NamePrefix   *string  `json:"namePrefix"`
 }
 
+// HasCapability returns true if the authorized key has the given capability
+func (a *AuthorizeAcccountCapabilities) HasCapability(capability string) bool {
+	for _, c := range a.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
 type CancelLargeFileResponse struct {
 	AccountID string `json:"accountId"`
 	BucketID  string `json:"bucketId"`
 	FileId    string `json:"fileId"`
 	FileName  string `json:"fileName"`
+
+	// DryRun is set if the large file wasn't actually cancelled because the
+	// RetryClient is in DryRun mode
+	DryRun bool `json:"-"`
 }
 
 type FileResponse File
@@ -30,13 +45,29 @@ type CopyFileResponse FileResponse
 
 type CopyPartResponse FilePart
 
-type BucketResponse Bucket
+type BucketResponse struct {
+	Bucket
+
+	// DryRun is set if the bucket wasn't actually deleted because the
+	// RetryClient is in DryRun mode
+	DryRun bool `json:"-"`
+}
+
+type KeyResponse struct {
+	Key
 
-type KeyResponse Key
+	// DryRun is set if the key wasn't actually deleted because the
+	// RetryClient is in DryRun mode
+	DryRun bool `json:"-"`
+}
 
 type DeleteFileResponse struct {
 	FileID   string `json:"fileId"`
 	FileName string `json:"fileName"`
+
+	// DryRun is set if the file version wasn't actually deleted because the
+	// RetryClient is in DryRun mode
+	DryRun bool `json:"-"`
 }
 
 type FinishLargeFileResponse FileResponse
@@ -49,6 +80,13 @@ type GetDownloadAuthorizationResponse struct {
 
 type GetFileInfoResponse FileResponse
 
+type BucketNotificationRulesResponse struct {
+	BucketID string             `json:"bucketId"`
+	Rules    []NotificationRule `json:"eventNotificationRules"`
+}
+
+type GetBucketNotificationRulesResponse BucketNotificationRulesResponse
+
 type UploadURLResponse struct {
 	FileID             string `json:"fileId"`
 	UploadURL          string `json:"uploadUrl"`
@@ -58,7 +96,15 @@ type UploadURLResponse struct {
 type GetUploadPartURLResponse UploadURLResponse
 type GetUploadURLResponse UploadURLResponse
 
-type HideFileResponse FileResponse
+type HeadFileResponse FileResponse
+
+type HideFileResponse struct {
+	File
+
+	// DryRun is set if the file wasn't actually hidden because the
+	// RetryClient is in DryRun mode
+	DryRun bool `json:"-"`
+}
 
 type ListBucketsResponse struct {
 	Buckets []Bucket `json:"buckets"`
@@ -90,9 +136,11 @@ type ListUnfinishedLargeFilesResponse struct {
 	NextFileID string `json:"nextFileId"`
 }
 
+type SetBucketNotificationRulesResponse BucketNotificationRulesResponse
+
 type StartLargeFileResponse FileResponse
 
-type UpdateBucketResponse BucketResponse
+type UpdateBucketResponse Bucket
 
 type UploadFileResponse FileResponse
 
@@ -0,0 +1,84 @@
+package b2
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const capturedAuthorizeAccountBody = `{
+  "absoluteMinimumPartSize": 5000000,
+  "accountId": "abc123def456",
+  "allowed": {
+    "bucketId": "4a48fe8875c6214145260818",
+    "bucketName": "example-bucket",
+    "capabilities": ["listBuckets", "listFiles", "readFiles", "shareFiles", "writeFiles", "deleteFiles"],
+    "namePrefix": null
+  },
+  "apiUrl": "https://api002.backblazeb2.com",
+  "authorizationToken": "4_0022623512fc8f80000000001_0186e431_d18d02_acct_tH7VW03boebOXayIc43-sxptpfA=",
+  "downloadUrl": "https://f002.backblazeb2.com",
+  "recommendedPartSize": 100000000,
+  "s3ApiUrl": "https://s3.us-west-002.backblazeb2.com"
+}`
+
+func TestDecodeAuthorizeAccountResponse(t *testing.T) {
+	var res AuthorizeAccountResponse
+	if err := json.Unmarshal([]byte(capturedAuthorizeAccountBody), &res); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if res.AbsoluteMinimumPartSize != 5000000 {
+		t.Errorf("Expected AbsoluteMinimumPartSize to be decoded, got: %#v", res.AbsoluteMinimumPartSize)
+	}
+	if res.RecommendedPartSize != 100000000 {
+		t.Errorf("Expected RecommendedPartSize to be decoded, got: %#v", res.RecommendedPartSize)
+	}
+	if res.AccountID != "abc123def456" {
+		t.Errorf("Expected AccountID to be decoded, got: %#v", res.AccountID)
+	}
+	if res.APIURL != "https://api002.backblazeb2.com" {
+		t.Errorf("Expected APIURL to be decoded, got: %#v", res.APIURL)
+	}
+	if res.DownloadURL != "https://f002.backblazeb2.com" {
+		t.Errorf("Expected DownloadURL to be decoded, got: %#v", res.DownloadURL)
+	}
+	if res.S3APIURL != "https://s3.us-west-002.backblazeb2.com" {
+		t.Errorf("Expected S3APIURL to be decoded, got: %#v", res.S3APIURL)
+	}
+	if res.AuthorizationToken == "" {
+		t.Errorf("Expected AuthorizationToken to be decoded")
+	}
+	if res.Allowed.BucketID != "4a48fe8875c6214145260818" || res.Allowed.BucketName != "example-bucket" {
+		t.Errorf("Expected Allowed bucket to be decoded, got: %#v", res.Allowed)
+	}
+	if len(res.Allowed.Capabilities) != 6 {
+		t.Errorf("Expected 6 capabilities, got: %#v", res.Allowed.Capabilities)
+	}
+	if res.Allowed.NamePrefix != nil {
+		t.Errorf("Expected nil NamePrefix, got: %#v", *res.Allowed.NamePrefix)
+	}
+}
+
+func TestHasCapability(t *testing.T) {
+	var res AuthorizeAccountResponse
+	if err := json.Unmarshal([]byte(capturedAuthorizeAccountBody), &res); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// namePrefix is null in the captured body
+	if !res.Allowed.HasCapability(CapabilityReadFiles) {
+		t.Errorf("Expected %s capability", CapabilityReadFiles)
+	}
+	if res.Allowed.HasCapability(CapabilityWriteKeys) {
+		t.Errorf("Expected no %s capability", CapabilityWriteKeys)
+	}
+
+	prefix := "photos/"
+	allowed := AuthorizeAcccountCapabilities{Capabilities: []string{CapabilityListFiles}, NamePrefix: &prefix}
+	if !allowed.HasCapability(CapabilityListFiles) || allowed.HasCapability(CapabilityReadFiles) {
+		t.Errorf("Expected only %s capability, got: %#v", CapabilityListFiles, allowed.Capabilities)
+	}
+	if (&AuthorizeAcccountCapabilities{}).HasCapability(CapabilityListFiles) {
+		t.Errorf("Expected no capabilities")
+	}
+}
@@ -1,19 +1,73 @@
 package b2
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// DefaultAuthTTL is the default RetryClient.AuthTTL, conservatively half of
+// the 24 hours B2 auth tokens are valid for.
+const DefaultAuthTTL = 12 * time.Hour
+
 type RetryClient struct {
 	KeyID, AppKey string
 
 	C  Client
 	RC RetryConfig
+
+	// StrictCapabilities checks that the authorized key has the capability
+	// each method requires before making requests, returning an
+	// ErrMissingCapability instead of waiting for B2 to reject the request.
+	StrictCapabilities bool
+
+	// AuthTTL is how long an authorization is used before AuthorizeIfNeeded
+	// proactively reauthorizes. B2 tokens are valid for up to 24 hours, but
+	// B2 doesn't report when they expire. Optional, defaults to
+	// DefaultAuthTTL, negative disables proactive reauthorization.
+	AuthTTL time.Duration
+
+	// DryRun skips requests that delete or hide buckets, files, and keys,
+	// logging them to C.L and reporting them to OnDryRun instead. The skipped
+	// methods return synthetic responses with only the target's ids and
+	// DryRun set. EmptyBucket, DeleteBucketRecursive and DeleteAllFileVersions
+	// still list files to report what they would delete.
+	DryRun   bool
+	OnDryRun func(DryRunAction) // nilable, called with each request DryRun skips
+
+	uploadURLs uploadURLPool
+	bucketIDs  bucketIDCache
+
+	fileInfos *fileInfoCache // nil unless WithFileInfoCache is called
+
+	randOnce sync.Once
+	rand     rand.Source // used for jitter if RC.Rand isn't set
+}
+
+// DryRunAction describes a request skipped by a RetryClient in DryRun mode
+type DryRunAction struct {
+	Operation string // the skipped API operation, like "b2_delete_bucket"
+	BucketID  string // set for b2_delete_bucket and b2_hide_file
+	FileID    string // set for b2_delete_file_version and b2_cancel_large_file
+	FileName  string // set for b2_delete_file_version and b2_hide_file
+	KeyID     string // set for b2_delete_key
+}
+
+// skipForDryRun logs and reports a request skipped in DryRun mode
+func (c *RetryClient) skipForDryRun(a DryRunAction, format string, values ...interface{}) {
+	c.C.logf("[dry-run] "+format, values...)
+	if c.OnDryRun != nil {
+		c.OnDryRun(a)
+	}
 }
 
 func (c *RetryClient) isTimeoutAndThenWait(ctx context.Context, err error, attempts uint32) (timedOut, tooManyAttempts bool) {
@@ -23,34 +77,97 @@ func (c *RetryClient) isTimeoutAndThenWait(ctx context.Context, err error, attem
 		return res, res
 	default:
 	}
-	if IsTimeoutErr(err) {
-		goto retry
+	if !shouldRetry(err) {
+		return false, false
 	}
-	if err, ok := err.(*ErrorResponse); ok && err.IsForbidden() {
-		goto retry
+	if err, ok := err.(*ErrorResponse); ok && c.skipCapExceeded(err) {
+		return false, false
 	}
-	return false, false
-retry:
 	if attempts < c.RC.getMaxAttempts() {
-		if err, ok := err.(*ErrorResponse); ok && err.RetryAfter > 0 {
-			time.Sleep(err.RetryAfter)
-		} else {
-			time.Sleep(ExpBackoff(attempts, c.RC.getJitter(), c.RC.getMin(), c.RC.Max, c.RC.getUnit()))
+		if c.wait(ctx, err, attempts) != nil {
+			return true, true
 		}
 		return true, false
 	}
 	return true, true
 }
 
+// shouldRetry returns true if err is likely transient and the request should
+// be tried again: timeouts, connection failures, and 403, 500, or 503
+// responses.
+func shouldRetry(err error) bool {
+	if err == nil {
+		return false
+	}
+	if IsTimeoutErr(err) {
+		return true
+	}
+	var resErr *ErrorResponse
+	if errors.As(err, &resErr) {
+		return resErr.Timeout() || (resErr.IsForbidden() && !resErr.IsAccessDenied()) || resErr.IsInternalError() || resErr.IsServiceUnavailable()
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && (netErr.Timeout() || netErr.Temporary()) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// checkElapsed returns err annotated with the elapsed time if more than
+// MaxElapsed has passed since start, indicating that no more attempts should
+// be made. Returns nil otherwise.
+func (c *RetryClient) checkElapsed(start time.Time, err error) error {
+	if c.RC.MaxElapsed <= 0 {
+		return nil
+	}
+	if elapsed := c.clock().Now().Sub(start); elapsed >= c.RC.MaxElapsed {
+		return fmt.Errorf("Error giving up after %s: %w", elapsed, err)
+	}
+	return nil
+}
+
+// skipCapExceeded returns true if err shouldn't be retried because an account
+// cap has been exceeded.
+func (c *RetryClient) skipCapExceeded(err *ErrorResponse) bool {
+	return err.IsCapExceeded() && !c.RC.RetryCapExceeded
+}
+
+// wait sleeps for the duration requested by err's Retry-After, falling back
+// to exponential backoff. Calls OnRetry before sleeping. Returns ctx's error if ctx is done before then.
+func (c *RetryClient) wait(ctx context.Context, err error, attempts uint32) error {
+	var d time.Duration
+	if err, ok := err.(*ErrorResponse); ok && err.RetryAfter > 0 {
+		d = err.RetryAfter
+	} else {
+		d = c.RC.backoff(attempts, c.randSource())
+	}
+	if c.RC.OnRetry != nil {
+		c.RC.OnRetry(attempts, err, d)
+	}
+	return sleepContext(ctx, c.clock(), d)
+}
+
 // InvalidateAuthorization clears authorization tokens stored internally,
 // requiring a reauth.
 func (c *RetryClient) InvalidateAuthorization() { c.C.InvalidateAuthorization() }
 
+// SetAuth uses an authorization obtained elsewhere instead of authorizing
+// with KeyID and AppKey, until it expires. See Client.SetAuth.
+func (c *RetryClient) SetAuth(auth *AuthorizeAccountResponse) { c.C.SetAuth(auth) }
+
+// SetAuthAt is like SetAuth for an authorization received at authorizedAt,
+// which is reauthorized once it's older than AuthTTL. See Client.SetAuthAt.
+func (c *RetryClient) SetAuthAt(auth *AuthorizeAccountResponse, authorizedAt time.Time) {
+	c.C.SetAuthAt(auth, authorizedAt)
+}
+
 // AuthorizeIfNeeded attempts to authorize using the RetryClient's KeyID and
-// AppKey if an authorization token is missing.
+// AppKey if an authorization token is missing or older than AuthTTL.
 func (c *RetryClient) AuthorizeIfNeeded(ctx context.Context) (*AuthorizeAccountResponse, error) {
 	auth := c.C.LastAuth()
-	if auth != nil {
+	if auth != nil && !c.authExpiring() {
 		return auth, nil
 	}
 
@@ -80,16 +197,134 @@ func (c *RetryClient) AuthorizeIfNeeded(ctx context.Context) (*AuthorizeAccountR
 	}
 }
 
-func (c *RetryClient) genericRetryHandler(ctx context.Context, f func(context.Context) error) error {
+// Ping checks that the client can authorize with B2, reusing the cached
+// authorization if there is one. Useful as a readiness check or to validate
+// credentials at startup.
+func (c *RetryClient) Ping(ctx context.Context) error {
+	_, err := c.AuthorizeIfNeeded(ctx)
+	if err == nil {
+		return nil
+	}
+	var resErr *ErrorResponse
+	if errors.As(err, &resErr) && (resErr.IsUnauthorized() || resErr.IsForbidden()) {
+		return fmt.Errorf("Error while pinging B2: invalid credentials for key %#v: %w", c.KeyID, err)
+	}
+	return fmt.Errorf("Error while pinging B2: %w", err)
+}
+
+// randSource returns RC.Rand, falling back to a source owned by this client
+// so that concurrent clients don't contend on a shared lock.
+func (c *RetryClient) randSource() rand.Source {
+	if c.RC.Rand != nil {
+		return c.RC.Rand
+	}
+	c.randOnce.Do(func() { c.rand = NewLockedSource(time.Now().UnixNano()) })
+	return c.rand
+}
+
+// clock returns RC.Clock, falling back to the Client's Clock
+func (c *RetryClient) clock() Clock {
+	if c.RC.Clock != nil {
+		return c.RC.Clock
+	}
+	return c.C.clock()
+}
+
+// authExpiring returns true if the current authorization is older than AuthTTL
+func (c *RetryClient) authExpiring() bool {
+	ttl := c.AuthTTL
+	if ttl == 0 {
+		ttl = DefaultAuthTTL
+	}
+	if ttl < 0 {
+		return false
+	}
+	at := c.C.AuthorizedAt()
+	return !at.IsZero() && c.C.clock().Now().Sub(at) >= ttl
+}
+
+// AccountInfo returns a copy of the account's authorization, including its
+// part sizes and the key's capabilities. Authorizes as needed.
+func (c *RetryClient) AccountInfo(ctx context.Context) (AuthorizeAccountResponse, error) {
+	auth, err := c.AuthorizeIfNeeded(ctx)
+	if err != nil {
+		return AuthorizeAccountResponse{}, err
+	}
+	info := *auth
+	info.Allowed.Capabilities = append([]string(nil), auth.Allowed.Capabilities...)
+	return info, nil
+}
+
+// APIURL returns the base URL for API calls. Authorizes as needed.
+func (c *RetryClient) APIURL(ctx context.Context) (string, error) {
+	auth, err := c.AuthorizeIfNeeded(ctx)
+	if err != nil {
+		return "", err
+	}
+	return auth.APIURL, nil
+}
+
+// DownloadURL returns the base URL for downloading files. Authorizes as
+// needed.
+func (c *RetryClient) DownloadURL(ctx context.Context) (string, error) {
+	auth, err := c.AuthorizeIfNeeded(ctx)
+	if err != nil {
+		return "", err
+	}
+	return auth.DownloadURL, nil
+}
+
+// AuthorizationToken returns the current auth token, for use in requests made
+// outside of the client. Authorizes as needed.
+func (c *RetryClient) AuthorizationToken(ctx context.Context) (string, error) {
+	auth, err := c.AuthorizeIfNeeded(ctx)
+	if err != nil {
+		return "", err
+	}
+	return auth.AuthorizationToken, nil
+}
+
+// RequireCapability returns an ErrMissingCapability if the authorized key
+// doesn't have the given capability, or ErrAuthTokenMissing if the client
+// hasn't authorized yet.
+func (c *RetryClient) RequireCapability(capability string) error {
+	auth := c.C.LastAuth()
+	if auth == nil {
+		return ErrAuthTokenMissing
+	}
+	if !auth.Allowed.HasCapability(capability) {
+		return &ErrMissingCapability{Capability: capability}
+	}
+	return nil
+}
+
+// checkCapability calls RequireCapability if StrictCapabilities is set
+func (c *RetryClient) checkCapability(capability string) error {
+	if !c.StrictCapabilities {
+		return nil
+	}
+	return c.RequireCapability(capability)
+}
+
+// genericRetryHandler calls f with retries, authorizing as needed. The
+// capability f requires is checked first if StrictCapabilities is set.
+func (c *RetryClient) genericRetryHandler(ctx context.Context, capability string, f func(context.Context) error) error {
+	start := c.clock().Now()
 	retries := uint32(0)
 	for {
 		_, err := c.AuthorizeIfNeeded(ctx)
 		if err != nil {
 			return err
 		}
+		if err := c.checkCapability(capability); err != nil {
+			return err
+		}
 
 		err = f(ctx)
 		if err != nil {
+			if err := c.checkElapsed(start, err); err != nil {
+				return err
+			}
 			timedOut, tooManyAttempts := c.isTimeoutAndThenWait(ctx, err, retries)
 			if timedOut {
 				if tooManyAttempts {
@@ -106,11 +341,9 @@ func (c *RetryClient) genericRetryHandler(ctx context.Context, f func(context.Co
 					continue
 				}
 			}
-			if err, ok := err.(*ErrorResponse); ok && (err.IsForbidden() || (err.IsUnauthorized() && err.Code == ErrCodeExpiredAuthToken)) {
-				if err.RetryAfter > 0 {
-					time.Sleep(err.RetryAfter)
-				} else {
-					time.Sleep(ExpBackoff(retries, c.RC.getJitter(), c.RC.getMin(), c.RC.Max, c.RC.getUnit()))
+			if err, ok := err.(*ErrorResponse); ok && ((err.IsForbidden() && !c.skipCapExceeded(err) && !err.IsAccessDenied()) || (err.IsUnauthorized() && err.Code == ErrCodeExpiredAuthToken)) {
+				if err := c.wait(ctx, err, retries); err != nil {
+					return fmt.Errorf("Context error: %w", err)
 				}
 				retries++
 				c.InvalidateAuthorization()
@@ -120,12 +353,15 @@ func (c *RetryClient) genericRetryHandler(ctx context.Context, f func(context.Co
 		}
 		return err
 	}
-	return nil
 }
 
 // CancelLargeFile cancels an inprogress file upload. Authorizes as needed.
 func (c *RetryClient) CancelLargeFile(ctx context.Context, fileId string) (res CancelLargeFileResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	if c.DryRun {
+		c.skipForDryRun(DryRunAction{Operation: "b2_cancel_large_file", FileID: fileId}, "cancel large file %s", fileId)
+		return CancelLargeFileResponse{FileId: fileId, DryRun: true}, nil
+	}
+	err = c.genericRetryHandler(ctx, CapabilityWriteFiles, func(ctx context.Context) error {
 		res, err = c.C.CancelLargeFile(ctx, fileId)
 		return err
 	})
@@ -135,7 +371,7 @@ func (c *RetryClient) CancelLargeFile(ctx context.Context, fileId string) (res C
 // CopyFile copies a file in the bucket to another location. Authorizes as
 // needed.
 func (c *RetryClient) CopyFile(ctx context.Context, opt CopyFileOptions) (res CopyFileResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityWriteFiles, func(ctx context.Context) error {
 		res, err = c.C.CopyFile(ctx, opt)
 		return err
 	})
@@ -145,7 +381,7 @@ func (c *RetryClient) CopyFile(ctx context.Context, opt CopyFileOptions) (res Co
 // CopyPart copies a part of a large file in the bucket to another location.
 // Authorizes as needed.
 func (c *RetryClient) CopyPart(ctx context.Context, opt CopyPartOptions) (res CopyPartResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityWriteFiles, func(ctx context.Context) error {
 		res, err = c.C.CopyPart(ctx, opt)
 		return err
 	})
@@ -155,16 +391,19 @@ func (c *RetryClient) CopyPart(ctx context.Context, opt CopyPartOptions) (res Co
 // CreateBucket creates a new bucket in the given account. Authorizes as
 // needed.
 func (c *RetryClient) CreateBucket(ctx context.Context, bucketName string, bt BucketType, opt *CreateBucketOptions) (res BucketResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityWriteBuckets, func(ctx context.Context) error {
 		res, err = c.C.CreateBucket(ctx, bucketName, bt, opt)
 		return err
 	})
+	if err == nil {
+		c.bucketIDs.put(res.BucketName, res.BucketID)
+	}
 	return res, err
 }
 
 // CreateKey creates a new API key with permissions. Authorizes as needed.
 func (c *RetryClient) CreateKey(ctx context.Context, opt CreateKeyOptions) (res KeyResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityWriteKeys, func(ctx context.Context) error {
 		res, err = c.C.CreateKey(ctx, opt)
 		return err
 	})
@@ -174,25 +413,58 @@ func (c *RetryClient) CreateKey(ctx context.Context, opt CreateKeyOptions) (res
 // DeleteBucket deletes an existing bucket within an account. Authorizes as
 // needed.
 func (c *RetryClient) DeleteBucket(ctx context.Context, bucketId string) (res BucketResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	if c.DryRun {
+		c.skipForDryRun(DryRunAction{Operation: "b2_delete_bucket", BucketID: bucketId}, "delete bucket %s", bucketId)
+		return BucketResponse{Bucket: Bucket{BucketID: bucketId}, DryRun: true}, nil
+	}
+	err = c.genericRetryHandler(ctx, CapabilityDeleteBuckets, func(ctx context.Context) error {
 		res, err = c.C.DeleteBucket(ctx, bucketId)
 		return err
 	})
+	if err == nil {
+		c.bucketIDs.removeID(bucketId)
+	}
 	return res, err
 }
 
 // DeleteFileVersion deletes a version of a file. Authorizes as needed.
-func (c *RetryClient) DeleteFileVersion(ctx context.Context, fileId, fileName string) (res DeleteFileResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
-		res, err = c.C.DeleteFileVersion(ctx, fileId, fileName)
+func (c *RetryClient) DeleteFileVersion(ctx context.Context, fileId, fileName string) (DeleteFileResponse, error) {
+	return c.DeleteFileVersionWithOptions(ctx, DeleteFileVersionOptions{FileID: fileId, FileName: fileName})
+}
+
+// DeleteFileVersionWithOptions deletes a version of a file. Authorizes as
+// needed. Access denied errors, like deleting a version under retention, are
+// not retried.
+func (c *RetryClient) DeleteFileVersionWithOptions(ctx context.Context, opt DeleteFileVersionOptions) (res DeleteFileResponse, err error) {
+	if c.DryRun {
+		c.skipForDryRun(DryRunAction{Operation: "b2_delete_file_version", FileID: opt.FileID, FileName: opt.FileName}, "delete file version %s (%s)", opt.FileName, opt.FileID)
+		return DeleteFileResponse{FileID: opt.FileID, FileName: opt.FileName, DryRun: true}, nil
+	}
+	err = c.genericRetryHandler(ctx, CapabilityDeleteFiles, func(ctx context.Context) error {
+		if opt.BypassGovernance {
+			if err := c.checkCapability(CapabilityBypassGovernance); err != nil {
+				return err
+			}
+		}
+		res, err = c.C.DeleteFileVersionWithOptions(ctx, opt)
 		return err
 	})
+	if err == nil {
+		// other versions of the file may be cached, like a version this
+		// delete revealed again
+		c.fileInfos.removeID(opt.FileID)
+		c.fileInfos.removeName("", opt.FileName)
+	}
 	return res, err
 }
 
 // DeleteKey deletes an API key. Authorizes as needed.
 func (c *RetryClient) DeleteKey(ctx context.Context, appKeyId string) (res KeyResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	if c.DryRun {
+		c.skipForDryRun(DryRunAction{Operation: "b2_delete_key", KeyID: appKeyId}, "delete key %s", appKeyId)
+		return KeyResponse{Key: Key{ApplicationKeyID: appKeyId}, DryRun: true}, nil
+	}
+	err = c.genericRetryHandler(ctx, CapabilityDeleteKeys, func(ctx context.Context) error {
 		res, err = c.C.DeleteKey(ctx, appKeyId)
 		return err
 	})
@@ -202,7 +474,7 @@ func (c *RetryClient) DeleteKey(ctx context.Context, appKeyId string) (res KeyRe
 // DownloadFileByID downloads a file using the authorization previously retrieved via Authorize.
 // Requires readFiles capabilities. Authorizes as needed.
 func (c *RetryClient) DownloadFileByID(ctx context.Context, fileId string, opt *DownloadFileOptions) (res *http.Response, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityReadFiles, func(ctx context.Context) error {
 		if res != nil && res.Body != nil {
 			res.Body.Close()
 		}
@@ -216,7 +488,7 @@ func (c *RetryClient) DownloadFileByID(ctx context.Context, fileId string, opt *
 // retrieved via Authorize. Requires readFiles capabilities. Authorizes as
 // needed.
 func (c *RetryClient) DownloadFileByName(ctx context.Context, bucketName, fileName string, opt DownloadFileOptions) (res *http.Response, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityReadFiles, func(ctx context.Context) error {
 		if res != nil && res.Body != nil {
 			res.Body.Close()
 		}
@@ -230,7 +502,7 @@ func (c *RetryClient) DownloadFileByName(ctx context.Context, bucketName, fileNa
 // file. Authorizes as needed. If this call times out, use GetFileInfo to
 // verify if the file has been merged.
 func (c *RetryClient) FinishLargeFile(ctx context.Context, fileId string, partSha1s []string) (res FinishLargeFileResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityWriteFiles, func(ctx context.Context) error {
 		res, err = c.C.FinishLargeFile(ctx, fileId, partSha1s)
 		return err
 	})
@@ -240,25 +512,66 @@ func (c *RetryClient) FinishLargeFile(ctx context.Context, fileId string, partSh
 // GetDownloadAuthorization Generates a temporary authorization token to
 // download a file via DownloadFileByName. Authorizes as needed.
 func (c *RetryClient) GetDownloadAuthorization(ctx context.Context, opt GetDownloadAuthorizationOptions) (res GetDownloadAuthorizationResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityShareFiles, func(ctx context.Context) error {
 		res, err = c.C.GetDownloadAuthorization(ctx, opt)
 		return err
 	})
 	return res, err
 }
 
+// GetBucketNotificationRules returns the event notification rules of a
+// bucket. Authorizes as needed.
+func (c *RetryClient) GetBucketNotificationRules(ctx context.Context, bucketId string) (res GetBucketNotificationRulesResponse, err error) {
+	err = c.genericRetryHandler(ctx, CapabilityReadBucketNotifications, func(ctx context.Context) error {
+		res, err = c.C.GetBucketNotificationRules(ctx, bucketId)
+		return err
+	})
+	return res, err
+}
+
 // GetFileInfo returns metadata about a file stored in B2. Authorizes as
 // needed.
 func (c *RetryClient) GetFileInfo(ctx context.Context, fileId string) (res GetFileInfoResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	if res, ok := c.fileInfos.get(fileId, c.clock().Now()); ok {
+		return res, nil
+	}
+	err = c.genericRetryHandler(ctx, CapabilityReadFiles, func(ctx context.Context) error {
 		res, err = c.C.GetFileInfo(ctx, fileId)
 		return err
 	})
+	if err == nil {
+		c.fileInfos.put(res, c.clock().Now())
+	}
+	return res, err
+}
+
+// HeadFileByID returns the metadata of a file without downloading its
+// contents. Requires readFiles capabilities. Authorizes as needed.
+func (c *RetryClient) HeadFileByID(ctx context.Context, fileId string) (res HeadFileResponse, err error) {
+	err = c.genericRetryHandler(ctx, CapabilityReadFiles, func(ctx context.Context) error {
+		res, err = c.C.HeadFileByID(ctx, fileId)
+		return err
+	})
+	return res, err
+}
+
+// HeadFileByName returns the metadata of the latest version of a file
+// without downloading its contents. Requires readFiles capabilities.
+// Authorizes as needed.
+func (c *RetryClient) HeadFileByName(ctx context.Context, bucketName, fileName string) (res HeadFileResponse, err error) {
+	err = c.genericRetryHandler(ctx, CapabilityReadFiles, func(ctx context.Context) error {
+		res, err = c.C.HeadFileByName(ctx, bucketName, fileName)
+		return err
+	})
 	return res, err
 }
 
 func (c *RetryClient) HideFile(ctx context.Context, bucketId, fileName string) (res HideFileResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	if c.DryRun {
+		c.skipForDryRun(DryRunAction{Operation: "b2_hide_file", BucketID: bucketId, FileName: fileName}, "hide file %s in bucket %s", fileName, bucketId)
+		return HideFileResponse{File: File{BucketID: bucketId, FileName: fileName, Action: ActionHide}, DryRun: true}, nil
+	}
+	err = c.genericRetryHandler(ctx, CapabilityWriteFiles, func(ctx context.Context) error {
 		res, err = c.C.HideFile(ctx, bucketId, fileName)
 		return err
 	})
@@ -266,7 +579,7 @@ func (c *RetryClient) HideFile(ctx context.Context, bucketId, fileName string) (
 }
 
 func (c *RetryClient) ListBuckets(ctx context.Context, opt *ListBucketsOptions) (res ListBucketsResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityListBuckets, func(ctx context.Context) error {
 		res, err = c.C.ListBuckets(ctx, opt)
 		return err
 	})
@@ -274,7 +587,7 @@ func (c *RetryClient) ListBuckets(ctx context.Context, opt *ListBucketsOptions)
 }
 
 func (c *RetryClient) ListFileNames(ctx context.Context, bucketId string, opt *ListFileNamesOptions) (res ListFileNamesResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityListFiles, func(ctx context.Context) error {
 		res, err = c.C.ListFileNames(ctx, bucketId, opt)
 		return err
 	})
@@ -282,7 +595,7 @@ func (c *RetryClient) ListFileNames(ctx context.Context, bucketId string, opt *L
 }
 
 func (c *RetryClient) ListFileVersions(ctx context.Context, bucketId string, opt *ListFileVersionsOptions) (res ListFileVersionsResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityListFiles, func(ctx context.Context) error {
 		res, err = c.C.ListFileVersions(ctx, bucketId, opt)
 		return err
 	})
@@ -290,7 +603,7 @@ func (c *RetryClient) ListFileVersions(ctx context.Context, bucketId string, opt
 }
 
 func (c *RetryClient) ListKeys(ctx context.Context, opt ListKeysOptions) (res ListKeysResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityListKeys, func(ctx context.Context) error {
 		res, err = c.C.ListKeys(ctx, opt)
 		return err
 	})
@@ -298,30 +611,48 @@ func (c *RetryClient) ListKeys(ctx context.Context, opt ListKeysOptions) (res Li
 }
 
 func (c *RetryClient) ListParts(ctx context.Context, fileId string, opt ListPartsOptions) (res ListPartsResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityWriteFiles, func(ctx context.Context) error {
 		res, err = c.C.ListParts(ctx, fileId, opt)
 		return err
 	})
 	return res, err
 }
 func (c *RetryClient) ListUnfinishedLargeFiles(ctx context.Context, bucketId string, opt ListUnfinishedLargeFilesOptions) (res ListUnfinishedLargeFilesResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityListFiles, func(ctx context.Context) error {
 		res, err = c.C.ListUnfinishedLargeFiles(ctx, bucketId, opt)
 		return err
 	})
 	return res, err
 }
 
+// SetBucketNotificationRules replaces all the event notification rules of a
+// bucket. Authorizes as needed.
+func (c *RetryClient) SetBucketNotificationRules(ctx context.Context, bucketId string, rules []NotificationRule) (res SetBucketNotificationRulesResponse, err error) {
+	err = c.genericRetryHandler(ctx, CapabilityWriteBucketNotifications, func(ctx context.Context) error {
+		res, err = c.C.SetBucketNotificationRules(ctx, bucketId, rules)
+		return err
+	})
+	return res, err
+}
+
 func (c *RetryClient) StartLargeFile(ctx context.Context, bucketId, fileName, contentType string, fileInfo *FileInfo) (res StartLargeFileResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityWriteFiles, func(ctx context.Context) error {
 		res, err = c.C.StartLargeFile(ctx, bucketId, fileName, contentType, fileInfo)
 		return err
 	})
 	return res, err
 }
 
+func (c *RetryClient) StartLargeFileWithOptions(ctx context.Context, bucketId string, opt StartLargeFileOptions) (res StartLargeFileResponse, err error) {
+	err = c.genericRetryHandler(ctx, CapabilityWriteFiles, func(ctx context.Context) error {
+		res, err = c.C.StartLargeFileWithOptions(ctx, bucketId, opt)
+		return err
+	})
+	return res, err
+}
+
 func (c *RetryClient) UpdateBucket(ctx context.Context, bucketId string, opt UpdateBucketOptions) (res UpdateBucketResponse, err error) {
-	err = c.genericRetryHandler(ctx, func(ctx context.Context) error {
+	err = c.genericRetryHandler(ctx, CapabilityWriteBuckets, func(ctx context.Context) error {
 		res, err = c.C.UpdateBucket(ctx, bucketId, opt)
 		return err
 	})
@@ -330,19 +661,47 @@ func (c *RetryClient) UpdateBucket(ctx context.Context, bucketId string, opt Upd
 
 // UploadFile uploads a file to a given bucket at a location.
 // Will automatically Authorize, GetUploadURL, and start UploadFile -- with retries as per B2's integration guide.
+//
+// Upload URLs are reused across calls for the same bucket until an upload
+// using them fails.
+//
+// A failed attempt may have consumed some of opt.Body, so retries need to send
+// it again from the start. If opt.Body implements io.Seeker, it is seeked back
+// to its initial offset. Otherwise it is first copied to the Client's
+// TempStorage (or memory, without one) and replayed from there, so prefer
+// seekable bodies like *os.File for large uploads, or UploadLargeFile for
+// streams of unknown length. opt.Body is closed when UploadFile returns.
 func (c *RetryClient) UploadFile(ctx context.Context, bucketId string, opt UploadFileOptions) (UploadFileResponse, error) {
+	start := c.clock().Now()
 	retries := uint32(0)
-	var uploadUrlRes GetUploadURLResponse
+
+	if opt.Body != nil {
+		defer opt.Body.Close()
+	}
+	rewind, closer, err := c.rewindableBody(&opt)
+	if err != nil {
+		return UploadFileResponse{}, fmt.Errorf("Error while buffering file to upload: %w", err)
+	}
+	if closer != nil {
+		defer closer.Close()
+	}
 	for {
 		_, err := c.AuthorizeIfNeeded(ctx)
 		if err != nil {
 			return UploadFileResponse{}, err
 		}
+		if err := c.checkCapability(CapabilityWriteFiles); err != nil {
+			return UploadFileResponse{}, err
+		}
 
-		for {
+		uploadUrlRes, ok := c.uploadURLs.get(bucketId)
+		for !ok {
 			var err error
 			uploadUrlRes, err = c.C.GetUploadURL(ctx, bucketId)
 			if err != nil {
+				if err := c.checkElapsed(start, err); err != nil {
+					return UploadFileResponse{}, fmt.Errorf("Error while requesting upload url: %w", err)
+				}
 				timedOut, tooManyAttempts := c.isTimeoutAndThenWait(ctx, err, retries)
 				if timedOut {
 					if tooManyAttempts {
@@ -361,45 +720,143 @@ func (c *RetryClient) UploadFile(ctx context.Context, bucketId string, opt Uploa
 				}
 				return UploadFileResponse{}, fmt.Errorf("Error while requesting upload url: %w", err)
 			}
-			break
+			ok = true
 		}
 
 		res, err := c.C.UploadFile(ctx, uploadUrlRes.UploadURL, uploadUrlRes.AuthorizationToken, opt)
 		if err != nil {
-			if IsTimeoutErr(err) {
-				goto prepRetry
+			if !isRetryableUploadErr(err) {
+				return UploadFileResponse{}, fmt.Errorf("Error while uploading file: %w", err)
 			}
-			/*
-				These indicate that you should get a new upload URL and try again:
-
-				- Unable to make an HTTP connection, including connection timeout.
-				- Status of 401 Unauthorized, and an error code of expired_auth_token
-				- Status of 408 Request Timeout (jeff: covered by above)
-				- Any HTTP status in the 5xx range, including 503 Service Unavailable
-				- "Broken pipe" sending the contents of the file.
-				- A timeout waiting for a response (socket timeout). (jeff: covered from above)
-			*/
-			if err, ok := err.(*ErrorResponse); ok {
-				if err.IsUnauthorized() && err.Code == ErrCodeExpiredAuthToken {
-					goto prepRetry
-				}
-				if err.Status >= 500 && err.Status <= 599 {
-					goto prepRetry
-				}
+			if err := c.checkElapsed(start, err); err != nil {
+				return UploadFileResponse{}, fmt.Errorf("Error while uploading file: %w", err)
 			}
-			if errors.Is(err, io.ErrUnexpectedEOF) {
-				goto prepRetry
-			}
-			return UploadFileResponse{}, fmt.Errorf("Error while uploading file: %w", err)
-		prepRetry:
 			retries++
-			if err, ok := err.(*ErrorResponse); ok && err.RetryAfter > 0 {
-				time.Sleep(err.RetryAfter)
-			} else {
-				time.Sleep(ExpBackoff(retries, c.RC.getJitter(), c.RC.getMin(), c.RC.Max, c.RC.getUnit()))
+			if err := c.wait(ctx, err, retries); err != nil {
+				return UploadFileResponse{}, fmt.Errorf("Error while uploading file (context error): %w", err)
+			}
+			if err := rewind(); err != nil {
+				return UploadFileResponse{}, fmt.Errorf("Error while rewinding body to retry upload: %w", err)
 			}
 			continue
 		}
+		c.uploadURLs.put(bucketId, uploadUrlRes)
+		c.fileInfos.removeName(bucketId, opt.FileName)
 		return res, err
 	}
 }
+
+// rewindableBody replaces opt.Body with one that survives being closed by the
+// http.Client, returning a func to seek it back to where it started for
+// another attempt. Bodies that aren't seekable are buffered, the returned
+// closer (if not nil) releases that buffer.
+func (c *RetryClient) rewindableBody(opt *UploadFileOptions) (rewind func() error, closer io.Closer, err error) {
+	if opt.Body == nil {
+		return func() error { return nil }, nil, nil
+	}
+	rs, offset, ok := seekable(opt.Body)
+	if !ok {
+		var n int64
+		rs, closer, n, err = bufferBody(c.C.TS, opt.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		if opt.ContentLength < 0 {
+			opt.ContentLength = n
+		}
+		offset = 0
+	}
+	opt.Body = &unclosableReadSeeker{rs}
+	return func() error {
+		_, err := rs.Seek(offset, io.SeekStart)
+		return err
+	}, closer, nil
+}
+
+// bufferBody copies r to ts, or memory if ts is nil, so it can be read again
+func bufferBody(ts TempStorage, r io.Reader) (io.ReadSeeker, io.Closer, int64, error) {
+	if ts != nil {
+		rc, n, err := ts.Store(r)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if rs, ok := rc.(io.ReadSeeker); ok {
+			return rs, rc, n, nil
+		}
+		defer rc.Close()
+		r = rc
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return bytes.NewReader(data), nil, int64(len(data)), nil
+}
+
+// unclosableReadSeeker ignores Close so the body can be reused for retries
+type unclosableReadSeeker struct {
+	io.ReadSeeker
+}
+
+func (unclosableReadSeeker) Close() error { return nil }
+
+// uploadURLPool holds upload URLs by bucket id that can be reused for
+// subsequent uploads. Each URL is only handed out to one upload at a time.
+type uploadURLPool struct {
+	m    sync.Mutex
+	urls map[string][]GetUploadURLResponse
+}
+
+func (p *uploadURLPool) get(bucketId string) (GetUploadURLResponse, bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	urls := p.urls[bucketId]
+	if len(urls) == 0 {
+		return GetUploadURLResponse{}, false
+	}
+	u := urls[len(urls)-1]
+	p.urls[bucketId] = urls[:len(urls)-1]
+	return u, true
+}
+
+func (p *uploadURLPool) put(bucketId string, u GetUploadURLResponse) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.urls == nil {
+		p.urls = make(map[string][]GetUploadURLResponse)
+	}
+	p.urls[bucketId] = append(p.urls[bucketId], u)
+}
+
+// isRetryableUploadErr returns true if the upload error indicates that a new
+// upload URL should be requested and the upload tried again.
+func isRetryableUploadErr(err error) bool {
+	if IsTimeoutErr(err) {
+		return true
+	}
+	/*
+		These indicate that you should get a new upload URL and try again:
+
+		- Unable to make an HTTP connection, including connection timeout.
+		- Status of 401 Unauthorized, and an error code of expired_auth_token
+		- Status of 408 Request Timeout (jeff: covered by above)
+		- Any HTTP status in the 5xx range, including 503 Service Unavailable
+		- "Broken pipe" sending the contents of the file.
+		- A timeout waiting for a response (socket timeout). (jeff: covered from above)
+	*/
+	if err, ok := err.(*ErrorResponse); ok {
+		if err.IsUnauthorized() && err.Code == ErrCodeExpiredAuthToken {
+			return true
+		}
+		if err.Status >= 500 && err.Status <= 599 {
+			return true
+		}
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || isBrokenPipe(err)
+}
+
+// isBrokenPipe returns true if err is from the connection closing while
+// writing the request, like B2 closing it partway through an upload.
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
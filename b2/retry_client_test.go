@@ -0,0 +1,912 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryClientDoesNotRetryCapExceeded(t *testing.T) {
+	for _, retry := range []bool{false, true} {
+		requests := 0
+		c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			writeJSON(w, 403, ErrorResponse{Status: 403, Code: ErrCodeTransactionCapExceeded})
+		})
+		c.RC.RetryCapExceeded = retry
+
+		_, err := c.ListBuckets(context.Background(), nil)
+		if !IsCapExceeded(err) {
+			t.Fatalf("Expected cap exceeded error, got: %v", err)
+		}
+		if !retry && requests != 1 {
+			t.Fatalf("Expected a single request, got: %d", requests)
+		}
+		if retry && requests <= 1 {
+			t.Fatalf("Expected request to be retried when RetryCapExceeded is set, got: %d", requests)
+		}
+	}
+}
+
+func TestRetryClientDeleteFileVersionBypassGovernance(t *testing.T) {
+	requests := 0
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body := decodeBody(t, r)
+		if body["fileId"] != "4_z1" || body["fileName"] != "locked.txt" || body["bypassGovernance"] != true {
+			t.Errorf("Unexpected request body: %#v", body)
+		}
+		writeJSON(w, 403, ErrorResponse{Status: 403, Code: ErrCodeAccessDenied, Message: "file is under compliance retention"})
+	})
+
+	_, err := c.DeleteFileVersionWithOptions(context.Background(), DeleteFileVersionOptions{
+		FileID:           "4_z1",
+		FileName:         "locked.txt",
+		BypassGovernance: true,
+	})
+	if !errors.Is(err, ErrAccessDenied) {
+		t.Fatalf("Expected access denied error, got: %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("Expected a single request, got: %d", requests)
+	}
+}
+
+func TestRetryClientDeleteFileVersionOmitsBypassGovernance(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body := decodeBody(t, r)
+		if _, ok := body["bypassGovernance"]; ok {
+			t.Errorf("Expected bypassGovernance to be omitted, got: %#v", body)
+		}
+		writeJSON(w, 200, DeleteFileResponse{FileID: "4_z1", FileName: "a.txt"})
+	})
+
+	res, err := c.DeleteFileVersion(context.Background(), "4_z1", "a.txt")
+	if err != nil || res.FileID != "4_z1" {
+		t.Fatalf("Unexpected response: %#v, %v", res, err)
+	}
+}
+
+func TestRetryClientPing(t *testing.T) {
+	requests := 0
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/b2api/v2/b2_authorize_account" {
+			t.Errorf("Unexpected request: %s", r.URL.Path)
+		}
+		user, pass, _ := r.BasicAuth()
+		if user != "key-id" || pass != "app-key" {
+			writeJSON(w, 401, ErrorResponse{Status: 401, Code: ErrCodeUnauthorized, Message: "invalid key"})
+			return
+		}
+		writeJSON(w, 200, mockAuth("http://127.0.0.1"))
+	})
+	ctx := context.Background()
+
+	if err := c.Ping(ctx); err != nil || requests != 0 {
+		t.Fatalf("Expected cached authorization to be reused, got: %v after %d requests", err, requests)
+	}
+
+	c.KeyID, c.AppKey = "key-id", "app-key"
+	c.InvalidateAuthorization()
+	if err := c.Ping(ctx); err != nil || requests != 1 {
+		t.Fatalf("Expected ping to authorize, got: %v after %d requests", err, requests)
+	}
+
+	c.AppKey = "wrong"
+	c.InvalidateAuthorization()
+	err := c.Ping(ctx)
+	if !errors.Is(err, ErrUnauthorized) || !strings.Contains(err.Error(), "invalid credentials") {
+		t.Fatalf("Expected invalid credentials error, got: %v", err)
+	}
+}
+
+func TestRetryClientReauthorizesBeforeExpiry(t *testing.T) {
+	authorizations := 0
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/b2api/v2/b2_authorize_account":
+			authorizations++
+			auth := mockAuth("http://" + r.Host)
+			auth.AuthorizationToken = fmt.Sprintf("token-%d", authorizations)
+			writeJSON(w, 200, auth)
+		default:
+			writeJSON(w, 200, ListBucketsResponse{})
+		}
+	})
+	clock := newFakeClock()
+	c.C.Clock = clock
+	c.InvalidateAuthorization()
+	ctx := context.Background()
+
+	if _, err := c.ListBuckets(ctx, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !c.C.AuthorizedAt().Equal(clock.Now()) {
+		t.Fatalf("Expected authorization time to be recorded, got: %s", c.C.AuthorizedAt())
+	}
+
+	clock.Advance(DefaultAuthTTL - time.Minute)
+	if _, err := c.ListBuckets(ctx, nil); err != nil || authorizations != 1 {
+		t.Fatalf("Expected authorization to be reused, got %d authorizations: %v", authorizations, err)
+	}
+
+	clock.Advance(time.Minute)
+	if _, err := c.ListBuckets(ctx, nil); err != nil || authorizations != 2 {
+		t.Fatalf("Expected proactive reauthorization, got %d authorizations: %v", authorizations, err)
+	}
+	if auth := c.C.LastAuth(); auth.AuthorizationToken != "token-2" {
+		t.Fatalf("Expected new auth token, got: %s", auth.AuthorizationToken)
+	}
+
+	c.AuthTTL = -1
+	clock.Advance(48 * time.Hour)
+	if _, err := c.AuthorizeIfNeeded(ctx); err != nil || authorizations != 2 {
+		t.Fatalf("Expected no reauthorization when AuthTTL is negative, got %d authorizations: %v", authorizations, err)
+	}
+}
+
+func TestRetryClientSetAuthAtReauthorizesOldAuthorization(t *testing.T) {
+	authorizations := 0
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/b2api/v2/b2_authorize_account":
+			authorizations++
+			writeJSON(w, 200, mockAuth("http://"+r.Host))
+		default:
+			writeJSON(w, 200, ListBucketsResponse{})
+		}
+	})
+	clock := newFakeClock()
+	c.C.Clock = clock
+	ctx := context.Background()
+
+	auth := *c.C.LastAuth()
+	authorizedAt := clock.Now().Add(-DefaultAuthTTL)
+	c.SetAuthAt(&auth, authorizedAt)
+	if !c.C.AuthorizedAt().Equal(authorizedAt) {
+		t.Fatalf("Expected authorization time %s, got: %s", authorizedAt, c.C.AuthorizedAt())
+	}
+	if _, err := c.ListBuckets(ctx, nil); err != nil || authorizations != 1 {
+		t.Fatalf("Expected an old authorization to be replaced, got %d authorizations: %v", authorizations, err)
+	}
+
+	c.SetAuthAt(&auth, clock.Now().Add(-time.Hour))
+	if _, err := c.ListBuckets(ctx, nil); err != nil || authorizations != 1 {
+		t.Fatalf("Expected a recent authorization to be reused, got %d authorizations: %v", authorizations, err)
+	}
+}
+
+func TestSleepContextWithSystemClock(t *testing.T) {
+	if err := sleepContext(context.Background(), SystemClock, time.Millisecond); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sleepContext(ctx, SystemClock, time.Hour); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestRetryClientSleepsUsingClock(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 503, ErrorResponse{Status: 503, Code: "service_unavailable"})
+	})
+	clock := newFakeClock()
+	c.RC = RetryConfig{
+		MaxAttempts: 4,
+		Jitter:      1,
+		Min:         time.Second,
+		Unit:        time.Second,
+		Clock:       clock,
+		Rand:        rand.NewSource(1),
+	}
+
+	start := clock.Now()
+	if _, err := c.ListBuckets(context.Background(), nil); err == nil {
+		t.Fatalf("Expected error")
+	}
+
+	expected := RetryConfig{Jitter: 1, Min: time.Second, Unit: time.Second, Rand: rand.NewSource(1)}
+	sleeps := clock.Sleeps()
+	if len(sleeps) != 4 {
+		t.Fatalf("Expected 4 sleeps, got: %v", sleeps)
+	}
+	var total time.Duration
+	for i, d := range sleeps {
+		if e := expected.Backoff(uint32(i)); d != e {
+			t.Errorf("Expected sleep %d to be %s, got: %s", i, e, d)
+		}
+		total += d
+	}
+	if elapsed := clock.Now().Sub(start); elapsed != total {
+		t.Errorf("Expected clock to advance by %s, got: %s", total, elapsed)
+	}
+
+	clock = newFakeClock()
+	c.RC.Clock = clock
+	c.RC.MaxElapsed = 5 * time.Second
+	_, err := c.ListBuckets(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "giving up") {
+		t.Fatalf("Expected MaxElapsed to be measured with the clock, got: %v", err)
+	}
+}
+
+func TestRetryClientConcurrentBackoff(t *testing.T) {
+	clients := make([]*RetryClient, 4)
+	for i := range clients {
+		clients[i] = &RetryClient{RC: RetryConfig{Min: time.Millisecond, Max: time.Second, Unit: time.Millisecond}}
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func(c *RetryClient) {
+			defer wg.Done()
+			for i := uint32(0); i < 1000; i++ {
+				if d := c.RC.backoff(i%10, c.randSource()); d < time.Millisecond || d > time.Second {
+					t.Errorf("Unexpected backoff: %s", d)
+					return
+				}
+			}
+		}(clients[g%len(clients)])
+	}
+	wg.Wait()
+
+	if clients[0].randSource() == clients[1].randSource() {
+		t.Fatalf("Expected each client to own its rand source")
+	}
+	src := rand.NewSource(1)
+	c := &RetryClient{RC: RetryConfig{Rand: src}}
+	if c.randSource() != src {
+		t.Fatalf("Expected RC.Rand to be used when set")
+	}
+}
+
+func BenchmarkRetryClientBackoff(b *testing.B) {
+	c := &RetryClient{RC: RetryConfig{Min: time.Millisecond, Max: time.Second, Unit: time.Millisecond}}
+	b.RunParallel(func(pb *testing.PB) {
+		for i := uint32(0); pb.Next(); i++ {
+			c.RC.backoff(i%10, c.randSource())
+		}
+	})
+}
+
+func TestRetryClientCancelsDuringBackoff(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		writeJSON(w, 429, ErrorResponse{Status: 429, Code: "too_many_requests"})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.ListBuckets(ctx, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context error, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected cancellation to interrupt backoff, took: %s", elapsed)
+	}
+}
+
+func TestRetryClientOnRetry(t *testing.T) {
+	var failures = map[string]int{
+		"/b2api/v2/b2_authorize_account": 1,
+		"/b2api/v2/b2_list_buckets":      2,
+		"/b2api/v2/b2_get_upload_url":    1,
+	}
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if failures[r.URL.Path] > 0 {
+			failures[r.URL.Path]--
+			writeJSON(w, 429, ErrorResponse{Status: 429, Code: "too_many_requests"})
+			return
+		}
+		base := "http://" + r.Host
+		switch r.URL.Path {
+		case "/b2api/v2/b2_authorize_account":
+			writeJSON(w, 200, mockAuth(base))
+		case "/b2api/v2/b2_list_buckets":
+			writeJSON(w, 200, ListBucketsResponse{})
+		case "/b2api/v2/b2_get_upload_url":
+			writeJSON(w, 200, UploadURLResponse{UploadURL: base + "/upload", AuthorizationToken: "upload-token"})
+		case "/upload":
+			writeJSON(w, 200, UploadFileResponse{FileID: "id"})
+		}
+	})
+	c.RC.MaxAttempts = 5
+
+	var calls []error
+	c.RC.OnRetry = func(attempt uint32, err error, sleep time.Duration) {
+		if sleep <= 0 {
+			t.Errorf("Expected a positive sleep, got: %s", sleep)
+		}
+		calls = append(calls, err)
+	}
+
+	c.InvalidateAuthorization()
+	if _, err := c.ListBuckets(context.Background(), nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(calls) != 3 {
+		t.Fatalf("Expected 3 retries for authorize and list buckets, got: %d", len(calls))
+	}
+
+	_, err := c.UploadFile(context.Background(), "bucket", UploadFileOptions{
+		FileName:      "file.txt",
+		ContentLength: 5,
+		Body:          Closer(bytes.NewBufferString("hello")),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(calls) != 4 {
+		t.Fatalf("Expected another retry for the upload url, got: %d", len(calls)-3)
+	}
+	for _, err := range calls {
+		if e, ok := err.(*ErrorResponse); !ok || e.Status != 429 {
+			t.Fatalf("Expected retried errors to be reported, got: %v", err)
+		}
+	}
+}
+
+func TestRetryClientMaxElapsed(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, 429, ErrorResponse{Status: 429, Code: "too_many_requests"})
+	})
+	c.RC.MaxAttempts = 1000000
+	c.RC.MaxElapsed = 100 * time.Millisecond
+
+	for name, call := range map[string]func() error{
+		"generic": func() error {
+			_, err := c.ListBuckets(context.Background(), nil)
+			return err
+		},
+		"upload": func() error {
+			_, err := c.UploadFile(context.Background(), "bucket", UploadFileOptions{
+				FileName:      "file.txt",
+				ContentLength: 5,
+				Body:          Closer(bytes.NewBufferString("hello")),
+			})
+			return err
+		},
+	} {
+		start := time.Now()
+		err := call()
+		elapsed := time.Since(start)
+		var e *ErrorResponse
+		if !errors.As(err, &e) || !e.IsTooManyRequests() {
+			t.Fatalf("%s: Expected last error to be wrapped, got: %v", name, err)
+		}
+		if !strings.Contains(err.Error(), "giving up after") {
+			t.Fatalf("%s: Expected error to include elapsed time, got: %v", name, err)
+		}
+		if elapsed < c.RC.MaxElapsed || elapsed > time.Second {
+			t.Fatalf("%s: Expected to give up near %s, took: %s", name, c.RC.MaxElapsed, elapsed)
+		}
+	}
+}
+
+type testNetErr struct{ timeout, temporary bool }
+
+func (e testNetErr) Error() string   { return "net error" }
+func (e testNetErr) Timeout() bool   { return e.timeout }
+func (e testNetErr) Temporary() bool { return e.temporary }
+
+func TestShouldRetry(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Err      error
+		Expected bool
+	}{
+		{"nil", nil, false},
+		{"generic error", errors.New("oops"), false},
+		{"context cancelled", context.Canceled, false},
+
+		{"net timeout", testNetErr{timeout: true}, true},
+		{"net temporary", fmt.Errorf("wrapped: %w", testNetErr{temporary: true}), true},
+		{"net permanent", testNetErr{}, false},
+		{"dns hiccup", &net.DNSError{Err: "server misbehaving", IsTemporary: true}, true},
+		{"dns not found", &net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{"connection refused", &url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, true},
+		{"connection reset", &url.Error{Op: "Post", Err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}, true},
+		{"unexpected eof", fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), true},
+
+		{"bad request", &ErrorResponse{Status: 400}, false},
+		{"not found", &ErrorResponse{Status: 404}, false},
+		{"forbidden", &ErrorResponse{Status: 403}, true},
+		{"access denied", &ErrorResponse{Status: 403, Code: ErrCodeAccessDenied}, false},
+		{"request timeout", &ErrorResponse{Status: 408}, true},
+		{"too many requests", &ErrorResponse{Status: 429}, true},
+		{"internal error", &ErrorResponse{Status: 500}, true},
+		{"service unavailable", fmt.Errorf("wrapped: %w", &ErrorResponse{Status: 503}), true},
+	}
+
+	for _, c := range cases {
+		if got := shouldRetry(c.Err); got != c.Expected {
+			t.Errorf("%s: Expected shouldRetry(%v) = %v, got: %v", c.Name, c.Err, c.Expected, got)
+		}
+	}
+}
+
+func TestRetryClientRetriesServerErrors(t *testing.T) {
+	requests := 0
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			writeJSON(w, 500, ErrorResponse{Status: 500, Code: "internal_error"})
+			return
+		}
+		writeJSON(w, 200, ListBucketsResponse{})
+	})
+
+	if _, err := c.ListBuckets(context.Background(), nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if requests != 3 {
+		t.Fatalf("Expected 3 requests, got: %d", requests)
+	}
+}
+
+func TestRetryClientReusesUploadURLs(t *testing.T) {
+	var (
+		urlRequests int
+		uploads     []string
+		failNext    bool
+	)
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/b2api/v2/b2_get_upload_url":
+			urlRequests++
+			writeJSON(w, 200, UploadURLResponse{
+				UploadURL:          fmt.Sprintf("http://%s/upload/%d", r.Host, urlRequests),
+				AuthorizationToken: "upload-token",
+			})
+		default:
+			uploads = append(uploads, r.URL.Path)
+			if failNext {
+				failNext = false
+				writeJSON(w, 400, ErrorResponse{Status: 400, Code: ErrCodeBadRequest})
+				return
+			}
+			writeJSON(w, 200, UploadFileResponse{FileID: "id"})
+		}
+	})
+
+	upload := func(bucketId string) error {
+		_, err := c.UploadFile(context.Background(), bucketId, UploadFileOptions{
+			FileName:      "file.txt",
+			ContentLength: 5,
+			Body:          Closer(bytes.NewBufferString("hello")),
+		})
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := upload("bucket"); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+	}
+	if urlRequests != 1 {
+		t.Fatalf("Expected upload url to be reused, got %d requests", urlRequests)
+	}
+
+	if err := upload("other-bucket"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if urlRequests != 2 {
+		t.Fatalf("Expected a new upload url for another bucket, got %d requests", urlRequests)
+	}
+
+	failNext = true
+	if err := upload("bucket"); err == nil {
+		t.Fatalf("Expected error")
+	}
+	if err := upload("bucket"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if urlRequests != 3 {
+		t.Fatalf("Expected a failed upload url to be discarded, got %d requests", urlRequests)
+	}
+	expected := []string{"/upload/1", "/upload/1", "/upload/1", "/upload/2", "/upload/1", "/upload/3"}
+	if fmt.Sprint(uploads) != fmt.Sprint(expected) {
+		t.Fatalf("Expected uploads to %v, got: %v", expected, uploads)
+	}
+}
+
+func TestRetryClientAccountInfo(t *testing.T) {
+	authorizations := 0
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		authorizations++
+		auth := mockAuth("http://" + r.Host)
+		auth.Allowed.Capabilities = []string{CapabilityListBuckets}
+		writeJSON(w, 200, auth)
+	})
+	c.InvalidateAuthorization()
+
+	info, err := c.AccountInfo(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if info.RecommendedPartSize != 10 || !info.Allowed.HasCapability(CapabilityListBuckets) {
+		t.Fatalf("Expected authorization to be returned, got: %#v", info)
+	}
+
+	info.Allowed.Capabilities[0] = CapabilityWriteKeys
+	info.RecommendedPartSize = 0
+	if again, err := c.AccountInfo(context.Background()); err != nil || again.RecommendedPartSize != 10 || !again.Allowed.HasCapability(CapabilityListBuckets) {
+		t.Fatalf("Expected a copy to be returned, got: %#v, %v", again, err)
+	}
+	if authorizations != 1 {
+		t.Fatalf("Expected a single authorization, got: %d", authorizations)
+	}
+}
+
+func TestRetryClientAuthAccessors(t *testing.T) {
+	authorizations := 0
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		authorizations++
+		auth := mockAuth("http://" + r.Host)
+		auth.DownloadURL = "https://f000.example.com"
+		writeJSON(w, 200, auth)
+	})
+	c.InvalidateAuthorization()
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		token, err := c.AuthorizationToken(ctx)
+		if err != nil || token != "test-token" {
+			t.Fatalf("Unexpected token: %q, %v", token, err)
+		}
+		downloadURL, err := c.DownloadURL(ctx)
+		if err != nil || downloadURL != "https://f000.example.com" {
+			t.Fatalf("Unexpected download url: %q, %v", downloadURL, err)
+		}
+		apiURL, err := c.APIURL(ctx)
+		if err != nil || apiURL != c.C.LastAuth().APIURL || !strings.HasPrefix(apiURL, "http://127.0.0.1") {
+			t.Fatalf("Unexpected api url: %q, %v", apiURL, err)
+		}
+	}
+	if authorizations != 1 {
+		t.Fatalf("Expected a single authorization, got: %d", authorizations)
+	}
+}
+
+func TestRetryClientRequireCapability(t *testing.T) {
+	requests := 0
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		writeJSON(w, 200, ListBucketsResponse{})
+	})
+	c.C.lastAuth.Allowed.Capabilities = []string{CapabilityListBuckets}
+
+	if err := c.RequireCapability(CapabilityListBuckets); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	err := c.RequireCapability(CapabilityWriteFiles)
+	var missing *ErrMissingCapability
+	if !errors.As(err, &missing) || missing.Capability != CapabilityWriteFiles {
+		t.Fatalf("Expected missing %s capability, got: %v", CapabilityWriteFiles, err)
+	}
+
+	// not strict: requests are sent regardless
+	if _, err := c.ListKeys(context.Background(), ListKeysOptions{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if requests != 1 {
+		t.Fatalf("Expected request to be sent, got: %d", requests)
+	}
+
+	c.StrictCapabilities = true
+	if _, err := c.ListBuckets(context.Background(), nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	_, err = c.ListKeys(context.Background(), ListKeysOptions{})
+	if !errors.As(err, &missing) || missing.Capability != CapabilityListKeys {
+		t.Fatalf("Expected missing %s capability, got: %v", CapabilityListKeys, err)
+	}
+	_, err = c.UploadFile(context.Background(), "bucket", UploadFileOptions{Body: Closer(bytes.NewReader(nil))})
+	if !errors.As(err, &missing) || missing.Capability != CapabilityWriteFiles {
+		t.Fatalf("Expected missing %s capability, got: %v", CapabilityWriteFiles, err)
+	}
+	if requests != 2 {
+		t.Fatalf("Expected requests missing capabilities to not be sent, got: %d", requests)
+	}
+
+	c.InvalidateAuthorization()
+	if err := c.RequireCapability(CapabilityListBuckets); err != ErrAuthTokenMissing {
+		t.Fatalf("Expected ErrAuthTokenMissing when not authorized, got: %v", err)
+	}
+}
+
+// brokenPipeTransport fails the first upload after reading part of its body
+type brokenPipeTransport struct {
+	failed bool
+}
+
+func (t *brokenPipeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !t.failed && strings.HasPrefix(r.URL.Path, "/upload") {
+		t.failed = true
+		io.ReadFull(r.Body, make([]byte, 3))
+		r.Body.Close()
+		return nil, &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestRetryClientUploadFileRetriesBrokenPipe(t *testing.T) {
+	var uploads [][]byte
+	var sha1s []string
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/b2api/v2/b2_get_upload_url":
+			writeJSON(w, 200, UploadURLResponse{UploadURL: "http://" + r.Host + "/upload", AuthorizationToken: "upload-token"})
+		default:
+			body, _ := ioutil.ReadAll(r.Body)
+			uploads = append(uploads, body)
+			sha1s = append(sha1s, r.Header.Get("X-Bz-Content-Sha1"))
+			writeJSON(w, 200, UploadFileResponse{FileID: "id"})
+		}
+	})
+	transport := &brokenPipeTransport{}
+	c.C.C.Transport = transport
+
+	data := []byte("hello world")
+	_, err := c.UploadFile(context.Background(), "bucket", UploadFileOptions{
+		FileName:      "file.txt",
+		ContentLength: int64(len(data)),
+		Body:          readerAtCloser{bytes.NewReader(data)},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !transport.failed {
+		t.Fatalf("Expected the first upload to fail")
+	}
+	expected := fmt.Sprintf("%s%x", data, sha1.Sum(data))
+	if len(uploads) != 1 || string(uploads[0]) != expected || sha1s[0] != Sha1AtEnd {
+		t.Fatalf("Expected the full body to be uploaded on retry, got: %q", uploads)
+	}
+}
+
+func TestRetryClientUploadFileReplaysUnseekableBody(t *testing.T) {
+	data := bytes.Repeat([]byte("hello world "), 100)
+	cases := []struct {
+		Name          string
+		TS            TempStorage
+		ContentLength int64
+		SeekFails     bool
+	}{
+		{"memory", nil, int64(len(data)), false},
+		{"memory with unknown length", nil, ContentLengthDetermineUsingTempStorage, false},
+		{"temp storage", &MemoryTempStorage{}, int64(len(data)), false},
+		{"temp file storage with unknown length", &TempFileStorage{}, ContentLengthDetermineUsingTempStorage, false},
+		{"seeker that can't seek", nil, int64(len(data)), true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			attempts := 0
+			var uploaded []byte
+			c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/b2api/v2/b2_get_upload_url" {
+					writeJSON(w, 200, UploadURLResponse{UploadURL: "http://" + r.Host + "/upload", AuthorizationToken: "upload-token"})
+					return
+				}
+				attempts++
+				body, _ := ioutil.ReadAll(r.Body)
+				if attempts == 1 {
+					// fails after consuming the body
+					writeJSON(w, 503, ErrorResponse{Status: 503, Code: "service_unavailable"})
+					return
+				}
+				content, sum := body[:len(body)-40], string(body[len(body)-40:])
+				if fmt.Sprintf("%x", sha1.Sum(content)) != sum {
+					writeJSON(w, 400, ErrorResponse{Status: 400, Code: ErrCodeBadRequest, Message: "sha1 mismatch"})
+					return
+				}
+				uploaded = content
+				writeJSON(w, 200, UploadFileResponse{FileID: "id"})
+			})
+			c.C.TS = tc.TS
+
+			body := Closer(bytes.NewReader(data))
+			if tc.SeekFails {
+				body = unseekableSeeker{bytes.NewReader(data)}
+			}
+			_, err := c.UploadFile(context.Background(), "bucket", UploadFileOptions{
+				FileName:      "file.txt",
+				ContentLength: tc.ContentLength,
+				Body:          body,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if attempts != 2 || !bytes.Equal(uploaded, data) {
+				t.Fatalf("Expected the full body to be uploaded on retry, got %d attempts and %d bytes", attempts, len(uploaded))
+			}
+		})
+	}
+}
+
+// unseekableSeeker implements io.Seeker but fails to seek, like a pipe
+type unseekableSeeker struct{ io.Reader }
+
+func (unseekableSeeker) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.New("illegal seek")
+}
+
+func (unseekableSeeker) Close() error { return nil }
+
+func TestRetryClientUploadFileFromPipe(t *testing.T) {
+	data := bytes.Repeat([]byte("hello world "), 100)
+	attempts := 0
+	var uploaded []byte
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/b2api/v2/b2_get_upload_url" {
+			writeJSON(w, 200, UploadURLResponse{UploadURL: "http://" + r.Host + "/upload", AuthorizationToken: "upload-token"})
+			return
+		}
+		attempts++
+		body, _ := ioutil.ReadAll(r.Body)
+		if attempts == 1 {
+			writeJSON(w, 503, ErrorResponse{Status: 503, Code: "service_unavailable"})
+			return
+		}
+		uploaded = body[:len(body)-40]
+		writeJSON(w, 200, UploadFileResponse{FileID: "id"})
+	})
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	go func() {
+		pw.Write(data)
+		pw.Close()
+	}()
+
+	// pipes are ReadSeekers that can't seek
+	_, err = c.UploadFile(context.Background(), "bucket", UploadFileOptions{
+		FileName:      "file.txt",
+		ContentLength: int64(len(data)),
+		Body:          pr,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if attempts != 2 || !bytes.Equal(uploaded, data) {
+		t.Fatalf("Expected the full body to be uploaded on retry, got %d attempts and %d bytes", attempts, len(uploaded))
+	}
+}
+
+func TestIsRetryableUploadErr(t *testing.T) {
+	cases := []struct {
+		Err      error
+		Expected bool
+	}{
+		{&url.Error{Op: "Post", URL: "http://b2/upload", Err: &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}}, true},
+		{&url.Error{Op: "Post", URL: "http://b2/upload", Err: os.NewSyscallError("write", syscall.ECONNRESET)}, true},
+		{&net.OpError{Op: "write", Err: errors.New("use of closed network connection")}, false},
+		{&net.OpError{Op: "dial", Err: errors.New("no such host")}, false},
+		{&ErrorResponse{Status: 503}, true},
+		{&ErrorResponse{Status: 400, Code: ErrCodeBadRequest}, false},
+		{errors.New("other"), false},
+	}
+	for _, c := range cases {
+		if got := isRetryableUploadErr(c.Err); got != c.Expected {
+			t.Errorf("Expected isRetryableUploadErr(%v) = %v, got: %v", c.Err, c.Expected, got)
+		}
+	}
+}
+
+func TestDryRunSkipsMutatingRequests(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request in dry run: %s", r.URL.Path)
+		w.WriteHeader(500)
+	})
+	l := &testLogger{}
+	c.C.L = l
+	c.DryRun = true
+	var actions []DryRunAction
+	c.OnDryRun = func(a DryRunAction) { actions = append(actions, a) }
+	ctx := context.Background()
+
+	bucket, err := c.DeleteBucket(ctx, "bucket-id")
+	if err != nil || !bucket.DryRun || bucket.BucketID != "bucket-id" {
+		t.Errorf("Unexpected DeleteBucket result: %#v, %v", bucket, err)
+	}
+	file, err := c.DeleteFileVersion(ctx, "file-id", "a.txt")
+	if err != nil || !file.DryRun || file.FileID != "file-id" || file.FileName != "a.txt" {
+		t.Errorf("Unexpected DeleteFileVersion result: %#v, %v", file, err)
+	}
+	key, err := c.DeleteKey(ctx, "key-id")
+	if err != nil || !key.DryRun || key.ApplicationKeyID != "key-id" {
+		t.Errorf("Unexpected DeleteKey result: %#v, %v", key, err)
+	}
+	hidden, err := c.HideFile(ctx, "bucket-id", "b.txt")
+	if err != nil || !hidden.DryRun || hidden.BucketID != "bucket-id" || hidden.FileName != "b.txt" || hidden.Action != ActionHide {
+		t.Errorf("Unexpected HideFile result: %#v, %v", hidden, err)
+	}
+	cancelled, err := c.CancelLargeFile(ctx, "large-id")
+	if err != nil || !cancelled.DryRun || cancelled.FileId != "large-id" {
+		t.Errorf("Unexpected CancelLargeFile result: %#v, %v", cancelled, err)
+	}
+
+	expected := []string{
+		"[dry-run] delete bucket bucket-id",
+		"[dry-run] delete file version a.txt (file-id)",
+		"[dry-run] delete key key-id",
+		"[dry-run] hide file b.txt in bucket bucket-id",
+		"[dry-run] cancel large file large-id",
+	}
+	if strings.Join(l.lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected log lines: %#v", l.lines)
+	}
+	expectedActions := []DryRunAction{
+		{Operation: "b2_delete_bucket", BucketID: "bucket-id"},
+		{Operation: "b2_delete_file_version", FileID: "file-id", FileName: "a.txt"},
+		{Operation: "b2_delete_key", KeyID: "key-id"},
+		{Operation: "b2_hide_file", BucketID: "bucket-id", FileName: "b.txt"},
+		{Operation: "b2_cancel_large_file", FileID: "large-id"},
+	}
+	if fmt.Sprint(actions) != fmt.Sprint(expectedActions) {
+		t.Errorf("Expected actions %#v, got: %#v", expectedActions, actions)
+	}
+}
+
+func TestRetryClientTimeoutPerAttempt(t *testing.T) {
+	var attempts int32
+	release := make(chan struct{})
+	defer close(release)
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			<-release
+			return
+		}
+		writeJSON(w, 200, ListBucketsResponse{Buckets: []Bucket{{BucketID: "b1"}}})
+	})
+	c.C.Timeout = 50 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	res, err := c.ListBuckets(ctx, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(res.Buckets) != 1 || atomic.LoadInt32(&attempts) != 2 {
+		t.Fatalf("Expected the second attempt to succeed, got: %#v after %d attempts", res, attempts)
+	}
+}
+
+func TestClientTimeoutLastsUntilBodyIsClosed(t *testing.T) {
+	c := mockRetryClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(" world"))
+	})
+	c.C.Timeout = time.Second
+
+	var buf bytes.Buffer
+	if _, err := c.DownloadFileToWriter(context.Background(), "id", &buf, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if buf.String() != "hello world" {
+		t.Fatalf("Expected the whole body, got: %q", buf.String())
+	}
+}
@@ -1,13 +1,21 @@
 package b2
 
 import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"runtime"
+	"time"
 )
 
 const ClientVersion = "0.1.0"
 const ContentLengthDetermineUsingTempStorage = -1
 
+// DefaultBaseURL is the URL clients authorize against
+const DefaultBaseURL = "https://api.backblazeb2.com"
+
 func DefaultUserAgent() string {
 	return fmt.Sprintf("net.jeffhui.b2client/%s+%s", ClientVersion, runtime.Version())
 }
@@ -41,6 +49,7 @@ const (
 	BucketTypeAll                 = "all" // special type only for ListBuckets
 )
 
+// see https://www.backblaze.com/docs/cloud-storage-application-key-capabilities
 const (
 	CapabilityListKeys      = "listKeys"
 	CapabilityWriteKeys     = "writeKeys"
@@ -53,27 +62,342 @@ const (
 	CapabilityShareFiles    = "shareFiles"
 	CapabilityWriteFiles    = "writeFiles"
 	CapabilityDeleteFiles   = "deleteFiles"
+
+	CapabilityListAllBucketNames = "listAllBucketNames"
+	CapabilityReadBuckets        = "readBuckets"
+
+	CapabilityReadBucketEncryption     = "readBucketEncryption"
+	CapabilityWriteBucketEncryption    = "writeBucketEncryption"
+	CapabilityReadBucketRetentions     = "readBucketRetentions"
+	CapabilityWriteBucketRetentions    = "writeBucketRetentions"
+	CapabilityReadFileRetentions       = "readFileRetentions"
+	CapabilityWriteFileRetentions      = "writeFileRetentions"
+	CapabilityReadFileLegalHolds       = "readFileLegalHolds"
+	CapabilityWriteFileLegalHolds      = "writeFileLegalHolds"
+	CapabilityBypassGovernance         = "bypassGovernance"
+	CapabilityReadBucketReplications   = "readBucketReplications"
+	CapabilityWriteBucketReplications  = "writeBucketReplications"
+	CapabilityReadBucketNotifications  = "readBucketNotifications"
+	CapabilityWriteBucketNotifications = "writeBucketNotifications"
+)
+
+// AllCapabilities lists every capability a key can be created with
+var AllCapabilities = []string{
+	CapabilityListKeys,
+	CapabilityWriteKeys,
+	CapabilityDeleteKeys,
+	CapabilityListBuckets,
+	CapabilityWriteBuckets,
+	CapabilityDeleteBuckets,
+	CapabilityListFiles,
+	CapabilityReadFiles,
+	CapabilityShareFiles,
+	CapabilityWriteFiles,
+	CapabilityDeleteFiles,
+	CapabilityListAllBucketNames,
+	CapabilityReadBuckets,
+	CapabilityReadBucketEncryption,
+	CapabilityWriteBucketEncryption,
+	CapabilityReadBucketRetentions,
+	CapabilityWriteBucketRetentions,
+	CapabilityReadFileRetentions,
+	CapabilityWriteFileRetentions,
+	CapabilityReadFileLegalHolds,
+	CapabilityWriteFileLegalHolds,
+	CapabilityBypassGovernance,
+	CapabilityReadBucketReplications,
+	CapabilityWriteBucketReplications,
+	CapabilityReadBucketNotifications,
+	CapabilityWriteBucketNotifications,
+}
+
+// ReadOnlyCapabilities allows listing and downloading files
+var ReadOnlyCapabilities = []string{
+	CapabilityListBuckets,
+	CapabilityListFiles,
+	CapabilityReadFiles,
+}
+
+// ReadWriteCapabilities allows listing, downloading, uploading, and deleting
+// files
+var ReadWriteCapabilities = []string{
+	CapabilityListBuckets,
+	CapabilityListFiles,
+	CapabilityReadFiles,
+	CapabilityWriteFiles,
+	CapabilityDeleteFiles,
+}
+
+// ValidateCapabilities returns an error naming the first capability that
+// isn't one of AllCapabilities.
+func ValidateCapabilities(capabilities []string) error {
+	for _, c := range capabilities {
+		if !isKnownCapability(c) {
+			return fmt.Errorf("Unknown capability: %#v", c)
+		}
+	}
+	return nil
+}
+
+func isKnownCapability(capability string) bool {
+	for _, c := range AllCapabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// see https://www.backblaze.com/docs/cloud-storage-server-side-encryption
+const (
+	SSEModeB2          = "SSE-B2" // keys managed by B2
+	SSEModeC           = "SSE-C"  // keys provided by the customer
+	SSEAlgorithmAES256 = "AES256"
+)
+
+// SSE configures server-side encryption of a file
+type SSE struct {
+	Mode      string `json:"mode"`      // required, SSEModeB2 or SSEModeC
+	Algorithm string `json:"algorithm"` // optional, empty defaults to SSEAlgorithmAES256
+
+	// required for SSEModeC, the raw 256-bit key. Never sent to B2 for
+	// SSEModeB2 and never logged.
+	Key []byte `json:"-"`
+}
+
+func (s *SSE) getAlgorithm() string {
+	if s.Algorithm == "" {
+		return SSEAlgorithmAES256
+	}
+	return s.Algorithm
+}
+
+func (s *SSE) customerKey() string {
+	return base64.StdEncoding.EncodeToString(s.Key)
+}
+
+func (s *SSE) customerKeyMd5() string {
+	sum := md5.Sum(s.Key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// MarshalJSON fills in the default algorithm and the customer key for
+// SSEModeC.
+func (s SSE) MarshalJSON() ([]byte, error) {
+	type sse struct {
+		Mode           string `json:"mode"`
+		Algorithm      string `json:"algorithm"`
+		CustomerKey    string `json:"customerKey,omitempty"`
+		CustomerKeyMd5 string `json:"customerKeyMd5,omitempty"`
+	}
+	v := sse{Mode: s.Mode, Algorithm: s.getAlgorithm()}
+	if s.Mode == SSEModeC {
+		v.CustomerKey = s.customerKey()
+		v.CustomerKeyMd5 = s.customerKeyMd5()
+	}
+	return json.Marshal(v)
+}
+
+// String omits Key so that it isn't accidentally logged
+func (s SSE) String() string { return s.GoString() }
+
+// GoString omits Key so that it isn't accidentally logged
+func (s SSE) GoString() string {
+	return fmt.Sprintf("b2.SSE{Mode:%q, Algorithm:%q}", s.Mode, s.Algorithm)
+}
+
+// setOnRequest sets the encryption headers for uploads
+func (s *SSE) setOnRequest(r *http.Request) {
+	if s == nil {
+		return
+	}
+	if s.Mode == SSEModeC {
+		s.setCustomerKeyOnRequest(r)
+		return
+	}
+	r.Header.Set("X-Bz-Server-Side-Encryption", s.getAlgorithm())
+}
+
+// setCustomerKeyOnRequest sets the headers needed to read or write files
+// encrypted with SSEModeC. Does nothing for other modes.
+func (s *SSE) setCustomerKeyOnRequest(r *http.Request) {
+	if s == nil || s.Mode != SSEModeC {
+		return
+	}
+	r.Header.Set("X-Bz-Server-Side-Encryption-Customer-Algorithm", s.getAlgorithm())
+	r.Header.Set("X-Bz-Server-Side-Encryption-Customer-Key", s.customerKey())
+	r.Header.Set("X-Bz-Server-Side-Encryption-Customer-Key-Md5", s.customerKeyMd5())
+}
+
+// see https://www.backblaze.com/docs/cloud-storage-object-lock
+const (
+	RetentionModeGovernance = "governance" // can be removed by keys with bypassGovernance capabilities
+	RetentionModeCompliance = "compliance" // cannot be removed until the retention period ends
+
+	RetentionUnitDays  = "days"
+	RetentionUnitYears = "years"
 )
 
+type FileRetention struct {
+	Mode   string           `json:"mode"` // RetentionModeGovernance or RetentionModeCompliance
+	Period *RetentionPeriod `json:"period,omitempty"`
+}
+
+type RetentionPeriod struct {
+	Duration int    `json:"duration"`
+	Unit     string `json:"unit"` // RetentionUnitDays or RetentionUnitYears
+}
+
+type BucketFileLockConfiguration struct {
+	IsClientAuthorizedToRead bool      `json:"isClientAuthorizedToRead"`
+	Value                    *FileLock `json:"value"` // nil if IsClientAuthorizedToRead is false
+}
+
+type FileLock struct {
+	DefaultRetention  FileRetention `json:"defaultRetention"`
+	IsFileLockEnabled bool          `json:"isFileLockEnabled"`
+}
+
 type CorsRule struct {
 	CorsRuleName   string   `json:"corsRuleName"`   // required
 	AllowedOrigins []string `json:"allowedOrigins"` // required
 
-	// Allowed operations:
+	// Allowed operations, see CorsOperations:
 	//  - b2_download_file_by_name
 	//  - b2_download_file_by_id
 	//  - b2_upload_file
 	//  - b2_upload_part
+	//  - s3_delete, s3_get, s3_head, s3_post, s3_put
 	AllowedOperations []string `json:"allowedOperations"` // required
 	AllowedHeaders    []string `json:"allowedHeaders,omitempty"`
 	ExposeHeaders     []string `json:"exposeHeaders,omitempty"`
-	MaxAgeSeconds     int      `json:"maxAgeSeconds"` // required
+	MaxAgeSeconds     int      `json:"maxAgeSeconds"` // required, 0 to MaxCorsMaxAgeSeconds
+}
+
+// MaxCorsMaxAgeSeconds is the largest CorsRule.MaxAgeSeconds B2 accepts
+const MaxCorsMaxAgeSeconds = 86400
+
+// see https://www.backblaze.com/docs/cloud-storage-cross-origin-resource-sharing-rules
+var CorsOperations = []string{
+	"b2_download_file_by_name",
+	"b2_download_file_by_id",
+	"b2_upload_file",
+	"b2_upload_part",
+	"s3_delete",
+	"s3_get",
+	"s3_head",
+	"s3_post",
+	"s3_put",
+}
+
+// Validate returns an error describing the first problem with the rule that
+// B2 would reject it for.
+func (r *CorsRule) Validate() error {
+	if r.CorsRuleName == "" {
+		return fmt.Errorf("Invalid CORS rule: CorsRuleName is required")
+	}
+	if len(r.AllowedOrigins) == 0 {
+		return fmt.Errorf("Invalid CORS rule %#v: AllowedOrigins is required", r.CorsRuleName)
+	}
+	if len(r.AllowedOperations) == 0 {
+		return fmt.Errorf("Invalid CORS rule %#v: AllowedOperations is required", r.CorsRuleName)
+	}
+	for _, op := range r.AllowedOperations {
+		if !isCorsOperation(op) {
+			return fmt.Errorf("Invalid CORS rule %#v: unknown operation %#v", r.CorsRuleName, op)
+		}
+	}
+	if r.MaxAgeSeconds < 0 || r.MaxAgeSeconds > MaxCorsMaxAgeSeconds {
+		return fmt.Errorf("Invalid CORS rule %#v: MaxAgeSeconds must be between 0 and %d, got %d", r.CorsRuleName, MaxCorsMaxAgeSeconds, r.MaxAgeSeconds)
+	}
+	return nil
+}
+
+func isCorsOperation(op string) bool {
+	for _, o := range CorsOperations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBucketRules validates the rules of a bucket before creating or
+// updating it
+func validateBucketRules(corsRules []CorsRule, lifecycleRules []LifecycleRule) error {
+	for i := range corsRules {
+		if err := corsRules[i].Validate(); err != nil {
+			return err
+		}
+	}
+	for i := range lifecycleRules {
+		if err := lifecycleRules[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type LifecycleRule struct {
 	FileNamePrefix            string `json:"fileNamePrefix"`
-	DaysFromHidingToDeleting  *int   `json:"daysFromHidingToDeleting"`
-	DaysFromUploadingToHiding *int   `json:"daysFromUploadingToHiding"`
+	DaysFromHidingToDeleting  *int   `json:"daysFromHidingToDeleting"`  // optional, at least 1 if set
+	DaysFromUploadingToHiding *int   `json:"daysFromUploadingToHiding"` // optional, at least 1 if set
+}
+
+// Validate returns an error describing the first problem with the rule that
+// B2 would reject it for. At least one of the day counts must be set.
+func (r *LifecycleRule) Validate() error {
+	if r.DaysFromHidingToDeleting == nil && r.DaysFromUploadingToHiding == nil {
+		return fmt.Errorf("Invalid lifecycle rule for prefix %#v: DaysFromHidingToDeleting or DaysFromUploadingToHiding is required", r.FileNamePrefix)
+	}
+	if d := r.DaysFromHidingToDeleting; d != nil && *d < 1 {
+		return fmt.Errorf("Invalid lifecycle rule for prefix %#v: DaysFromHidingToDeleting must be at least 1, got %d", r.FileNamePrefix, *d)
+	}
+	if d := r.DaysFromUploadingToHiding; d != nil && *d < 1 {
+		return fmt.Errorf("Invalid lifecycle rule for prefix %#v: DaysFromUploadingToHiding must be at least 1, got %d", r.FileNamePrefix, *d)
+	}
+	return nil
+}
+
+// see https://www.backblaze.com/docs/cloud-storage-event-notifications
+const (
+	EventObjectCreatedAll               = "b2:ObjectCreated:*"
+	EventObjectCreatedUpload            = "b2:ObjectCreated:Upload"
+	EventObjectCreatedMultipartUpload   = "b2:ObjectCreated:MultipartUpload"
+	EventObjectCreatedCopy              = "b2:ObjectCreated:Copy"
+	EventObjectCreatedReplica           = "b2:ObjectCreated:Replica"
+	EventObjectDeletedAll               = "b2:ObjectDeleted:*"
+	EventObjectDeletedDelete            = "b2:ObjectDeleted:Delete"
+	EventObjectDeletedLifecycleRule     = "b2:ObjectDeleted:LifecycleRule"
+	EventHideMarkerCreatedAll           = "b2:HideMarkerCreated:*"
+	EventHideMarkerCreatedHide          = "b2:HideMarkerCreated:Hide"
+	EventHideMarkerCreatedLifecycleRule = "b2:HideMarkerCreated:LifecycleRule"
+)
+
+const NotificationTargetTypeWebhook = "webhook"
+
+type NotificationRule struct {
+	Name                string                          `json:"name"`       // required
+	EventTypes          []string                        `json:"eventTypes"` // required
+	ObjectNamePrefix    string                          `json:"objectNamePrefix"`
+	TargetConfiguration NotificationTargetConfiguration `json:"targetConfiguration"` // required
+	IsEnabled           bool                            `json:"isEnabled"`
+
+	// read-only, set by B2 when the webhook repeatedly fails
+	IsSuspended      bool   `json:"isSuspended,omitempty"`
+	SuspensionReason string `json:"suspensionReason,omitempty"`
+}
+
+type NotificationTargetConfiguration struct {
+	TargetType              string               `json:"targetType"` // required, only NotificationTargetTypeWebhook is supported
+	URL                     string               `json:"url"`        // required, must be https
+	CustomHeaders           []NotificationHeader `json:"customHeaders,omitempty"`
+	HmacSha256SigningSecret string               `json:"hmacSha256SigningSecret,omitempty"` // optional, 32 alphanumeric characters
+}
+
+type NotificationHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
 }
 
 type Action string
@@ -103,6 +427,14 @@ type Bucket struct {
 	CorsRules      []CorsRule      `json:"corsRules,omitempty"`
 	LifecycleRules []LifecycleRule `json:"lifecycleRules,omitempty"`
 	Revision       int             `json:"revision"`
+
+	DefaultServerSideEncryption *BucketServerSideEncryption  `json:"defaultServerSideEncryption,omitempty"`
+	FileLockConfiguration       *BucketFileLockConfiguration `json:"fileLockConfiguration,omitempty"`
+}
+
+type BucketServerSideEncryption struct {
+	IsClientAuthorizedToRead bool `json:"isClientAuthorizedToRead"`
+	Value                    *SSE `json:"value"` // nil if IsClientAuthorizedToRead is false
 }
 
 type File struct {
@@ -117,12 +449,22 @@ type File struct {
 	ContentType           string   `json:"contentType"`
 	FileInfo              FileInfo `json:"fileInfo"`
 	UploadTimestampMillis int64    `json:"uploadTimestamp"`
+
+	ServerSideEncryption *SSE `json:"serverSideEncryption,omitempty"`
 }
 
+// UploadedAt returns the time B2 received the file
+func (f *File) UploadedAt() time.Time { return millisToTime(f.UploadTimestampMillis) }
+
+// SrcLastModified returns the original modification time of the file, as
+// recorded in the src_last_modified_millis file info when it was uploaded.
+// Returns false if it wasn't recorded.
+func (f *File) SrcLastModified() (time.Time, bool) { return f.FileInfo.SrcLastModified() }
+
 type FilePart struct {
 	FileID                string `json:"fileId"`
 	PartNumber            int    `json:"partNumber"`
-	ContentLength         string `json:"contentLength"`
+	ContentLength         int64  `json:"contentLength"`
 	ContentSha1           string `json:"contentSha1"`
 	ContentMd5            string `json:"contentMd5,omitempty"`
 	UploadTimestampMillis int64  `json:"uploadTimestamp"`
@@ -0,0 +1,177 @@
+package b2
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateCapabilities(t *testing.T) {
+	valid := [][]string{
+		nil,
+		{CapabilityReadFiles},
+		AllCapabilities,
+		ReadOnlyCapabilities,
+		ReadWriteCapabilities,
+	}
+	for _, caps := range valid {
+		if err := ValidateCapabilities(caps); err != nil {
+			t.Errorf("Expected %#v to be valid, got: %s", caps, err)
+		}
+	}
+
+	err := ValidateCapabilities([]string{CapabilityListFiles, "readFile"})
+	if err == nil || !strings.Contains(err.Error(), `"readFile"`) {
+		t.Fatalf("Expected error naming the unknown capability, got: %v", err)
+	}
+}
+
+func TestCreateKeyValidatesCapabilities(t *testing.T) {
+	requests := 0
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		writeJSON(w, 200, KeyResponse{})
+	})
+
+	_, err := c.CreateKey(context.Background(), CreateKeyOptions{KeyName: "key", Capabilities: []string{"readFile"}})
+	if err == nil {
+		t.Fatalf("Expected error for unknown capability")
+	}
+	if requests != 0 {
+		t.Fatalf("Expected invalid key to not be sent, got: %d requests", requests)
+	}
+
+	_, err = c.CreateKey(context.Background(), CreateKeyOptions{KeyName: "key", Capabilities: ReadOnlyCapabilities})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if requests != 1 {
+		t.Fatalf("Expected valid key to be sent, got: %d requests", requests)
+	}
+}
+
+func TestFileUploadedAt(t *testing.T) {
+	f := File{UploadTimestampMillis: 1389243222123}
+	expected := time.Date(2014, 1, 9, 4, 53, 42, 123e6, time.UTC)
+	if got := f.UploadedAt(); !got.Equal(expected) {
+		t.Fatalf("Expected %s, got: %s", expected, got)
+	}
+}
+
+func TestFileSrcLastModified(t *testing.T) {
+	f := File{FileInfo: FileInfo{"src_last_modified_millis": "1389243222123"}}
+	got, ok := f.SrcLastModified()
+	expected := time.Date(2014, 1, 9, 4, 53, 42, 123e6, time.UTC)
+	if !ok || !got.Equal(expected) {
+		t.Fatalf("Expected %s, got: %s, %v", expected, got, ok)
+	}
+
+	for _, info := range []FileInfo{nil, {}, {"src_last_modified_millis": "yesterday"}} {
+		f := File{FileInfo: info}
+		if got, ok := f.SrcLastModified(); ok || !got.IsZero() {
+			t.Errorf("Expected no time for %#v, got: %s, %v", info, got, ok)
+		}
+	}
+}
+
+func TestCorsRuleValidate(t *testing.T) {
+	valid := func() CorsRule {
+		return CorsRule{
+			CorsRuleName:      "downloadFromAnyOrigin",
+			AllowedOrigins:    []string{"https"},
+			AllowedOperations: []string{"b2_download_file_by_name", "s3_get"},
+			MaxAgeSeconds:     3600,
+		}
+	}
+	if r := valid(); r.Validate() != nil {
+		t.Fatalf("Expected rule to be valid, got: %s", r.Validate())
+	}
+
+	cases := []struct {
+		Name   string
+		Modify func(r *CorsRule)
+		Error  string
+	}{
+		{"missing name", func(r *CorsRule) { r.CorsRuleName = "" }, "CorsRuleName"},
+		{"missing origins", func(r *CorsRule) { r.AllowedOrigins = nil }, "AllowedOrigins"},
+		{"missing operations", func(r *CorsRule) { r.AllowedOperations = nil }, "AllowedOperations"},
+		{"unknown operation", func(r *CorsRule) { r.AllowedOperations = []string{"b2_delete_file_version"} }, `"b2_delete_file_version"`},
+		{"negative max age", func(r *CorsRule) { r.MaxAgeSeconds = -1 }, "MaxAgeSeconds"},
+		{"max age too large", func(r *CorsRule) { r.MaxAgeSeconds = MaxCorsMaxAgeSeconds + 1 }, "MaxAgeSeconds"},
+	}
+	for _, c := range cases {
+		r := valid()
+		c.Modify(&r)
+		if err := r.Validate(); err == nil || !strings.Contains(err.Error(), c.Error) {
+			t.Errorf("%s: Expected error mentioning %s, got: %v", c.Name, c.Error, err)
+		}
+	}
+}
+
+func TestBucketRulesValidatedBeforeSending(t *testing.T) {
+	requests := 0
+	c := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		writeJSON(w, 200, BucketResponse{})
+	})
+	invalid := []CorsRule{{CorsRuleName: "rule", AllowedOrigins: []string{"*"}, AllowedOperations: []string{"s3_list"}}}
+	ctx := context.Background()
+
+	if _, err := c.CreateBucket(ctx, "bucket", BucketTypePrivate, &CreateBucketOptions{CorsRules: invalid}); err == nil {
+		t.Errorf("Expected CreateBucket to reject invalid rules")
+	}
+	if _, err := c.UpdateBucket(ctx, "b1", UpdateBucketOptions{CorsRules: invalid}); err == nil {
+		t.Errorf("Expected UpdateBucket to reject invalid rules")
+	}
+	if requests != 0 {
+		t.Fatalf("Expected invalid rules to not be sent, got: %d requests", requests)
+	}
+}
+
+func TestLifecycleRuleValidate(t *testing.T) {
+	days := func(n int) *int { return &n }
+	valid := []LifecycleRule{
+		{FileNamePrefix: "logs/", DaysFromHidingToDeleting: days(1)},
+		{DaysFromUploadingToHiding: days(30)},
+		{FileNamePrefix: "tmp/", DaysFromHidingToDeleting: days(1), DaysFromUploadingToHiding: days(7)},
+	}
+	for _, r := range valid {
+		if err := r.Validate(); err != nil {
+			t.Errorf("Expected %#v to be valid, got: %s", r, err)
+		}
+	}
+
+	cases := []struct {
+		Name  string
+		Rule  LifecycleRule
+		Error string
+	}{
+		{"neither set", LifecycleRule{FileNamePrefix: "logs/"}, "is required"},
+		{"zero days to delete", LifecycleRule{DaysFromHidingToDeleting: days(0)}, "DaysFromHidingToDeleting"},
+		{"negative days to delete", LifecycleRule{DaysFromHidingToDeleting: days(-1), DaysFromUploadingToHiding: days(1)}, "DaysFromHidingToDeleting"},
+		{"negative days to hide", LifecycleRule{DaysFromUploadingToHiding: days(-3)}, "DaysFromUploadingToHiding"},
+	}
+	for _, c := range cases {
+		if err := c.Rule.Validate(); err == nil || !strings.Contains(err.Error(), c.Error) {
+			t.Errorf("%s: Expected error mentioning %s, got: %v", c.Name, c.Error, err)
+		}
+	}
+
+	requests := 0
+	clt := mockClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		writeJSON(w, 200, BucketResponse{})
+	})
+	invalid := []LifecycleRule{{FileNamePrefix: "logs/"}}
+	if _, err := clt.CreateBucket(context.Background(), "bucket", BucketTypePrivate, &CreateBucketOptions{LifecycleRules: invalid}); err == nil {
+		t.Errorf("Expected CreateBucket to reject invalid rules")
+	}
+	if _, err := clt.UpdateBucket(context.Background(), "b1", UpdateBucketOptions{LifecycleRules: invalid}); err == nil {
+		t.Errorf("Expected UpdateBucket to reject invalid rules")
+	}
+	if requests != 0 {
+		t.Fatalf("Expected invalid rules to not be sent, got: %d requests", requests)
+	}
+}